@@ -0,0 +1,184 @@
+// Package bridge manages Linux bridges and their ports: creating the
+// bridge, addressing it, plugging ports in and tuning both through sysfs.
+package bridge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const sysClassNet = "/sys/class/net"
+
+// Handle is the subset of netlink operations the bridge needs.
+// *netlink.Handle satisfies it.
+type Handle interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetMaster(link netlink.Link, master *netlink.Bridge) error
+	LinkSetHairpin(link netlink.Link, mode bool) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+	NeighSet(neigh *netlink.Neigh) error
+}
+
+// ByName looks up the bridge called name
+func ByName(h Handle, name string) (*netlink.Bridge, error) {
+	l, err := h.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup %q: %v", name, err)
+	}
+	br, ok := l.(*netlink.Bridge)
+	if !ok {
+		return nil, fmt.Errorf("%q already exists but is not a bridge", name)
+	}
+	return br, nil
+}
+
+// Ensure creates the bridge unless it exists already and sets it up
+func Ensure(h Handle, brName string, mtu int) (*netlink.Bridge, error) {
+	br := &netlink.Bridge{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: brName,
+			MTU:  mtu,
+			// Let kernel use default txqueuelen; leaving it unset
+			// means 0, and a zero-length TX queue messes up FIFO
+			// traffic shapers which use TX queue length as the
+			// default packet limit
+			TxQLen: -1,
+		},
+	}
+
+	if err := h.LinkAdd(br); err != nil {
+		if err != syscall.EEXIST {
+			return nil, fmt.Errorf("could not add %q: %v", brName, err)
+		}
+
+		// it's ok if the device already exists as long as config is similar
+		br, err = ByName(h, brName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := h.LinkSetUp(br); err != nil {
+		return nil, err
+	}
+
+	return br, nil
+}
+
+// EnsureAddr assigns ipn to the bridge, with forceAddress replacing a
+// different address of the same subnet
+func EnsureAddr(h Handle, br netlink.Link, ipn *net.IPNet, forceAddress bool) error {
+	addrs, err := h.AddrList(br, syscall.AF_INET)
+	if err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("could not get list of IP addresses: %v", err)
+	}
+
+	// addresses of other subnets are fine, like the upstream bridge
+	// plugin only a different address in the same subnet is a conflict
+	ipnStr := ipn.String()
+	for _, a := range addrs {
+		// string comp is actually easiest for doing IPNet comps
+		if a.IPNet.String() == ipnStr {
+			return nil
+		}
+		if !a.IPNet.Contains(ipn.IP) && !ipn.Contains(a.IPNet.IP) {
+			continue
+		}
+		if !forceAddress {
+			return fmt.Errorf("%q already has an IP address different from %v", br.Attrs().Name, ipn.String())
+		}
+		if err := h.AddrDel(br, &a); err != nil {
+			return fmt.Errorf("could not remove IP address %v from %q: %v", a.IPNet, br.Attrs().Name, err)
+		}
+	}
+
+	addr := &netlink.Addr{IPNet: ipn, Label: ""}
+	if err := h.AddrAdd(br, addr); err != nil {
+		return fmt.Errorf("could not add IP address to %q: %v", br.Attrs().Name, err)
+	}
+	return nil
+}
+
+// AttachPort plugs the interface port into the bridge. It must be called
+// from the host netns.
+func AttachPort(h Handle, br *netlink.Bridge, port string, hairpinMode bool) error {
+	// need to lookup the port again as its index changes on a netns move
+	link, err := h.LinkByName(port)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", port, err)
+	}
+
+	if err = h.LinkSetMaster(link, br); err != nil {
+		return fmt.Errorf("failed to connect %q to bridge %v: %v", port, br.Attrs().Name, err)
+	}
+
+	if err = h.LinkSetHairpin(link, hairpinMode); err != nil {
+		return fmt.Errorf("failed to setup hairpin mode for %v: %v", port, err)
+	}
+
+	return nil
+}
+
+// AddStaticFDB points mac at the bridge port with a static fdb entry,
+// which never ages out
+func AddStaticFDB(h Handle, port, mac string) error {
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC %q of %v: %v", mac, port, err)
+	}
+
+	link, err := h.LinkByName(port)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", port, err)
+	}
+	neigh := &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		State:        netlink.NUD_NOARP,
+		Flags:        netlink.NTF_MASTER,
+		HardwareAddr: hwaddr,
+	}
+	if err = h.NeighSet(neigh); err != nil {
+		return fmt.Errorf("failed to add fdb entry %v on %v: %v", mac, port, err)
+	}
+	return nil
+}
+
+// Ports lists the names of the interfaces plugged into the bridge
+func Ports(brName string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(sysClassNet, brName, "brif"))
+	if err != nil {
+		return nil, err
+	}
+	var ports []string
+	for _, f := range files {
+		ports = append(ports, f.Name())
+	}
+	return ports, nil
+}
+
+// SetOption sets one of the /sys/class/net/<bridge>/bridge/ knobs
+func SetOption(brName, option, value string) error {
+	return writeSysfs(filepath.Join(sysClassNet, brName, "bridge", option), value)
+}
+
+// SetPortOption sets one of the /sys/class/net/<port>/brport/ knobs
+func SetPortOption(port, option, value string) error {
+	return writeSysfs(filepath.Join(sysClassNet, port, "brport", option), value)
+}
+
+func writeSysfs(path, value string) error {
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %q to %v: %v", value, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Package firewall builds and installs the iptables rules of the plugin:
+// per container marking, connection limits, bridge wide MSS clamping and
+// conntrack zones, and the per container firewall chains.
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MSSClampPMTU clamps the MSS to the path MTU rather than a fixed value
+const MSSClampPMTU = "pmtu"
+
+// IPTables is the subset of iptables operations the rules need.
+// *iptables.IPTables satisfies it.
+type IPTables interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	List(table, chain string) ([]string, error)
+	ListChains(table string) ([]string, error)
+	NewChain(table, chain string) error
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+}
+
+// Rule is a rule in Table/Chain
+type Rule struct {
+	Table, Chain string
+	Spec         []string
+}
+
+// Append adds the rules at the end of their chains unless present
+func Append(ipt IPTables, rules []Rule) error {
+	for _, r := range rules {
+		if err := ipt.AppendUnique(r.Table, r.Chain, r.Spec...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Insert adds the rules at the head of their chains unless present, so
+// they take effect ahead of whatever the chains hold already
+func Insert(ipt IPTables, rules []Rule) error {
+	for _, r := range rules {
+		if ok, err := ipt.Exists(r.Table, r.Chain, r.Spec...); err != nil {
+			return err
+		} else if ok {
+			continue
+		}
+		if err := ipt.Insert(r.Table, r.Chain, 1, r.Spec...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the rules, skipping those that are gone already
+func Delete(ipt IPTables, rules []Rule) error {
+	for _, r := range rules {
+		if ok, err := ipt.Exists(r.Table, r.Chain, r.Spec...); err != nil || !ok {
+			continue
+		}
+		if err := ipt.Delete(r.Table, r.Chain, r.Spec...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveChain deletes the rules jumping to chain in table, then the
+// chain itself, skipping whatever is gone already
+func RemoveChain(ipt IPTables, table, chain string, jumps []Rule) error {
+	if err := Delete(ipt, jumps); err != nil {
+		return err
+	}
+	exists, err := hasChain(ipt, table, chain)
+	if err != nil || !exists {
+		return err
+	}
+	if err := ipt.ClearChain(table, chain); err != nil {
+		return err
+	}
+	return ipt.DeleteChain(table, chain)
+}
+
+// hasChain reports whether table has chain
+func hasChain(ipt IPTables, table, chain string) (bool, error) {
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range chains {
+		if c == chain {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DSCPRule marks traffic sourced from ipn with the DSCP code point
+func DSCPRule(ipn *net.IPNet, dscp int, comment string) Rule {
+	return Rule{"mangle", "PREROUTING", []string{
+		"-s", ipn.IP.String(),
+		"-m", "comment", "--comment", comment,
+		"-j", "DSCP", "--set-dscp", strconv.Itoa(dscp),
+	}}
+}
+
+// ValidateMark checks mark is "value" or "value/mask" with 32 bit
+// numbers in any base strconv understands
+func ValidateMark(mark string) error {
+	for _, part := range strings.SplitN(mark, "/", 2) {
+		if _, err := strconv.ParseUint(part, 0, 32); err != nil {
+			return fmt.Errorf("invalid mark %q", mark)
+		}
+	}
+	return nil
+}
+
+// MarkRule sets the mark of traffic sourced from ipn
+func MarkRule(ipn *net.IPNet, mark string, comment string) Rule {
+	return Rule{"mangle", "PREROUTING", []string{
+		"-s", ipn.IP.String(),
+		"-m", "comment", "--comment", comment,
+		"-j", "MARK", "--set-mark", mark,
+	}}
+}
+
+// ConnLimitRules drop new connections from and to the container at ip
+// once it has limit of them open in either direction
+func ConnLimitRules(ip net.IP, limit int, comment string) []Rule {
+	var rules []Rule
+	for _, dir := range []struct{ match, saddr string }{{"-s", "--connlimit-saddr"}, {"-d", "--connlimit-daddr"}} {
+		rules = append(rules, Rule{"filter", "FORWARD", []string{
+			dir.match, ip.String(),
+			"-m", "conntrack", "--ctstate", "NEW",
+			"-m", "connlimit", "--connlimit-above", strconv.Itoa(limit), "--connlimit-mask", "32", dir.saddr,
+			"-m", "comment", "--comment", comment,
+			"-j", "DROP",
+		}})
+	}
+	return rules
+}
+
+// MSSClampRules clamp the MSS of TCP connections forwarded through the
+// bridge, either to the path MTU (MSSClampPMTU) or to a fixed value
+func MSSClampRules(brName, clamp string) []Rule {
+	target := []string{"-j", "TCPMSS", "--clamp-mss-to-pmtu"}
+	if clamp != MSSClampPMTU {
+		target = []string{"-j", "TCPMSS", "--set-mss", clamp}
+	}
+
+	var rules []Rule
+	for _, dir := range []string{"-i", "-o"} {
+		spec := append([]string{dir, brName, "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN"}, target...)
+		rules = append(rules, Rule{"mangle", "FORWARD", spec})
+	}
+	return rules
+}
+
+// ConntrackZoneRules assign the conntrack zone to connections of the
+// bridge: those its containers open as they come in, and those the host
+// opens towards them. The zone only applies to the original direction,
+// so replies coming in on the uplink, which are tracked before the
+// bridge is known, still find their connection (and its NAT) in the
+// default zone.
+func ConntrackZoneRules(brName string, zone int) []Rule {
+	return []Rule{
+		{"raw", "PREROUTING", []string{"-i", brName, "-j", "CT", "--zone-orig", strconv.Itoa(zone)}},
+		{"raw", "OUTPUT", []string{"-o", brName, "-j", "CT", "--zone-orig", strconv.Itoa(zone)}},
+	}
+}
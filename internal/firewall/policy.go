@@ -0,0 +1,116 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Port is a port/protocol a policy applies to
+type Port struct {
+	Port  int
+	Proto string
+}
+
+// Policy is what a container asks for on traffic towards it. Denies
+// take precedence over allows.
+type Policy struct {
+	DefaultDeny           bool
+	AllowPorts, DenyPorts []Port
+	AllowFrom, DenyFrom   []net.IP
+}
+
+// ParsePorts parses a comma separated "port[/proto]" list, protocols
+// default to tcp
+func ParsePorts(list string) ([]Port, error) {
+	var ports []Port
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p := Port{Proto: "tcp"}
+		parts := strings.SplitN(s, "/", 2)
+		if len(parts) == 2 {
+			p.Proto = strings.ToLower(parts[1])
+		}
+		port, err := strconv.Atoi(parts[0])
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid firewall port %q", s)
+		}
+		switch p.Proto {
+		case "tcp", "udp", "sctp":
+		default:
+			return nil, fmt.Errorf("unsupported firewall protocol in %q", s)
+		}
+		p.Port = port
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// Rules returns the rules of the container's firewall chain, traffic
+// that gets through is RETURNed to FORWARD
+func (p *Policy) Rules() [][]string {
+	rules := [][]string{
+		{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"},
+	}
+	for _, ip := range p.DenyFrom {
+		rules = append(rules, []string{"-s", ip.String(), "-j", "DROP"})
+	}
+	for _, port := range p.DenyPorts {
+		rules = append(rules, []string{"-p", port.Proto, "--dport", strconv.Itoa(port.Port), "-j", "DROP"})
+	}
+	for _, ip := range p.AllowFrom {
+		rules = append(rules, []string{"-s", ip.String(), "-j", "RETURN"})
+	}
+	for _, port := range p.AllowPorts {
+		rules = append(rules, []string{"-p", port.Proto, "--dport", strconv.Itoa(port.Port), "-j", "RETURN"})
+	}
+	if p.DefaultDeny {
+		rules = append(rules, []string{"-j", "DROP"})
+	}
+	return rules
+}
+
+// jumpRule sends forwarded traffic to the container through its chain
+func jumpRule(chain string, ip net.IP, comment string) Rule {
+	return Rule{"filter", "FORWARD", []string{"-d", ip.String(), "-m", "comment", "--comment", comment, "-j", chain}}
+}
+
+// Install fills chain with the rules of the policy and sends forwarded
+// traffic to ip through it, ahead of whatever accepts it already
+func Install(ipt IPTables, chain string, p *Policy, ip net.IP, comment string) error {
+	exists, err := hasChain(ipt, "filter", chain)
+	if err != nil {
+		return err
+	}
+	if exists {
+		err = ipt.ClearChain("filter", chain)
+	} else {
+		err = ipt.NewChain("filter", chain)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create chain %v: %v", chain, err)
+	}
+
+	for _, rule := range p.Rules() {
+		if err := ipt.AppendUnique("filter", chain, rule...); err != nil {
+			return fmt.Errorf("failed to add firewall rule to %v: %v", chain, err)
+		}
+	}
+
+	if err := Insert(ipt, []Rule{jumpRule(chain, ip, comment)}); err != nil {
+		return fmt.Errorf("failed to hook up %v: %v", chain, err)
+	}
+	return nil
+}
+
+// Remove undoes Install. It is a no-op if chain doesn't exist.
+func Remove(ipt IPTables, chain string, ip net.IP, comment string) error {
+	exists, err := hasChain(ipt, "filter", chain)
+	if err != nil || !exists {
+		return err
+	}
+	return RemoveChain(ipt, "filter", chain, []Rule{jumpRule(chain, ip, comment)})
+}
@@ -0,0 +1,194 @@
+// Package ipconfig applies an IPAM result to an interface: its
+// addresses, routes and MAC address.
+package ipconfig
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+// RouteSrcPrimary has routes prefer the address from IPAM as source
+const RouteSrcPrimary = "primary"
+
+// Handle is the subset of netlink operations the configuration needs.
+// *netlink.Handle satisfies it.
+type Handle interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkSetUp(link netlink.Link) error
+	LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+	RouteAdd(route *netlink.Route) error
+}
+
+// GatewayIP returns the first address of the subnet of ipn
+func GatewayIP(ipn *net.IPNet) net.IP {
+	nid := ipn.IP.Mask(ipn.Mask)
+	return ip.NextIP(nid)
+}
+
+// ConfigureInterface takes the result of IPAM plugin and applies it to
+// the ifName interface, with routeSrc as preferred source of its routes
+// (see RouteSrcIP)
+func ConfigureInterface(h Handle, ifName string, res *types.Result, routeSrc string) error {
+	link, err := h.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	if err := h.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q UP: %v", ifName, err)
+	}
+
+	// no IP config at all means L2 only, addressing is up to the container
+	for _, ipc := range []*types.IPConfig{res.IP4, res.IP6} {
+		if ipc == nil {
+			continue
+		}
+		if err := configureAddress(h, link, ifName, ipc, RouteSrcIP(routeSrc, ipc)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configureAddress adds the address and routes of one family, the
+// routes with src as preferred source address if it's set
+func configureAddress(h Handle, link netlink.Link, ifName string, ipc *types.IPConfig, src net.IP) error {
+	addr := &netlink.Addr{IPNet: &ipc.IP, Label: ""}
+	if err := h.AddrAdd(link, addr); err != nil {
+		if err.Error() == "file exists" {
+			logrus.Infof("rancher-cni-bridge: Interface %q already has IP address: %v, no worries", ifName, addr)
+		} else {
+			return fmt.Errorf("failed to add IP addr to %q: %v", ifName, err)
+		}
+	}
+
+	for _, r := range ipc.Routes {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &r.Dst,
+			Src:       src,
+		}
+		gw, onlink := RouteNextHop(ipc, r)
+		route.Gw = gw
+		if r.GW != nil && r.GW.IsUnspecified() {
+			route.Scope = netlink.SCOPE_LINK
+		}
+		if onlink {
+			route.SetFlag(netlink.FLAG_ONLINK)
+		}
+		if err := h.RouteAdd(route); err != nil {
+			// we skip over duplicate routes as we assume the first one wins
+			if !os.IsExist(err) {
+				return fmt.Errorf("failed to add route '%v via %v dev %v': %v", r.Dst, gw, ifName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// RouteSrcIP returns the preferred source address routeSrc asks for on
+// routes of ipc's family: nil for none, the address of ipc for
+// RouteSrcPrimary, or the given address if it is of the same family
+func RouteSrcIP(routeSrc string, ipc *types.IPConfig) net.IP {
+	switch routeSrc {
+	case "":
+		return nil
+	case RouteSrcPrimary:
+		return ipc.IP.IP
+	}
+	src := net.ParseIP(routeSrc)
+	if (src.To4() == nil) != (ipc.IP.IP.To4() == nil) {
+		return nil
+	}
+	return src
+}
+
+// RouteNextHop returns the gateway of r, nil for a directly attached
+// route (gw 0.0.0.0), and whether it has to be marked onlink
+func RouteNextHop(ipc *types.IPConfig, r types.Route) (net.IP, bool) {
+	gw := r.GW
+	switch {
+	case gw == nil:
+		gw = ipc.Gateway
+	case gw.IsUnspecified():
+		return nil, false
+	}
+	// gateway outside the assigned prefix (e.g. /32 addressing), tell
+	// the kernel it is reachable on the link regardless
+	return gw, gw != nil && !ipc.IP.Contains(gw) && !gw.IsLinkLocalUnicast()
+}
+
+// SetMAC sets the MAC address of ifName
+func SetMAC(h Handle, ifName, mac string) error {
+	link, err := h.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("failed to parse MAC address: %v", err)
+	}
+	err = h.LinkSetHardwareAddr(link, hwaddr)
+	if err != nil {
+		return fmt.Errorf("failed to set hw address of interface: %v", err)
+	}
+
+	return nil
+}
+
+// AddLinkLocalAddr assigns ipn as a secondary, link scoped address of
+// ifName
+func AddLinkLocalAddr(h Handle, ifName string, ipn *net.IPNet) error {
+	link, err := h.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	addr := &netlink.Addr{IPNet: ipn, Scope: int(netlink.SCOPE_LINK)}
+	if err := h.AddrAdd(link, addr); err != nil && err.Error() != "file exists" {
+		return fmt.Errorf("failed to add link-local address %v to %q: %v", ipn, ifName, err)
+	}
+	return nil
+}
+
+// FirstAddr returns the first address of the family on ifName
+func FirstAddr(h Handle, ifName string, family int) (*net.IPNet, error) {
+	link, err := h.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	addrs, err := h.AddrList(link, family)
+	if err != nil || len(addrs) == 0 {
+		return nil, fmt.Errorf("failed to get IP addresses for %q: %v", ifName, err)
+	}
+	return addrs[0].IPNet, nil
+}
+
+// DelAddrs removes the addresses from ifName, skipping those that are
+// gone already along with the interface itself
+func DelAddrs(h Handle, ifName string, ipns []*net.IPNet) error {
+	link, err := h.LinkByName(ifName)
+	if err != nil {
+		return nil
+	}
+	for _, ipn := range ipns {
+		err := h.AddrDel(link, &netlink.Addr{IPNet: ipn})
+		if err != nil && err != syscall.EADDRNOTAVAIL {
+			return fmt.Errorf("failed to remove %v from %q: %v", ipn, ifName, err)
+		}
+	}
+	return nil
+}
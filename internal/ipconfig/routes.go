@@ -0,0 +1,66 @@
+package ipconfig
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+// ValidateDefaultGateways checks the ECMP gateways are IPv4 addresses
+func ValidateDefaultGateways(gws []string) error {
+	if len(gws) < 2 {
+		return fmt.Errorf("defaultGateways needs at least two gateways, use isDefaultGateway for one")
+	}
+	for _, gw := range gws {
+		if ip := net.ParseIP(gw); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid default gateway %q", gw)
+		}
+	}
+	return nil
+}
+
+// AddECMPDefaultRoute installs a default route that balances over all
+// gateways. They have to be on the subnet of ipc, multipath next hops
+// can't be marked onlink.
+func AddECMPDefaultRoute(h Handle, ifName string, ipc *types.IPConfig, gws []string, src net.IP) error {
+	link, err := h.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	route := &netlink.Route{Dst: &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, Src: src}
+	for _, gw := range gws {
+		ip := net.ParseIP(gw)
+		if !ipc.IP.Contains(ip) {
+			return fmt.Errorf("default gateway %v is not on %v", ip, ipc.IP.String())
+		}
+		route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{LinkIndex: link.Attrs().Index, Gw: ip})
+	}
+
+	if err := h.RouteAdd(route); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to add ECMP default route via %v dev %v: %v", gws, ifName, err)
+	}
+	return nil
+}
+
+// AddBlackholeRoutes drops traffic to cidrs at the routing layer,
+// whatever the other routes say. The more specific route wins, so a
+// blackhole can't take over the interface's own subnet unless it is
+// narrower than it.
+func AddBlackholeRoutes(h Handle, cidrs []string) error {
+	for _, cidr := range cidrs {
+		_, dst, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		route := &netlink.Route{Dst: dst, Type: syscall.RTN_BLACKHOLE}
+		if err := h.RouteAdd(route); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to add blackhole route %v: %v", dst, err)
+		}
+	}
+	return nil
+}
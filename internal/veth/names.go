@@ -0,0 +1,56 @@
+package veth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// MaxNameLen is the longest interface name the kernel takes, IFNAMSIZ
+// less the terminating NUL
+const MaxNameLen = syscall.IFNAMSIZ - 1
+
+// ValidateName checks name is usable as an interface name: not empty,
+// at most MaxNameLen bytes and without the characters the kernel
+// rejects
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("interface name is empty")
+	}
+	if len(name) > MaxNameLen {
+		return fmt.Errorf("interface name %q is longer than %v characters", name, MaxNameLen)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("invalid interface name %q", name)
+	}
+	if strings.ContainsAny(name, "/: \t\n") {
+		return fmt.Errorf("interface name %q contains '/', ':' or whitespace", name)
+	}
+	return nil
+}
+
+// ShortName shortens name to MaxNameLen, keeping as much of it as fits
+// ahead of a hash of the whole name so different long names stay apart
+func ShortName(name string) string {
+	if len(name) <= MaxNameLen {
+		return name
+	}
+	sum := sha1.Sum([]byte(name))
+	suffix := hex.EncodeToString(sum[:])[:5]
+	return name[:MaxNameLen-len(suffix)] + suffix
+}
+
+// HashedName returns the name for key: prefix followed by a hash of key
+// filling up MaxNameLen. Each attempt hashes differently, for when the
+// name of an earlier one is taken.
+func HashedName(prefix, key string, attempt int) string {
+	if attempt > 0 {
+		key += "-" + strconv.Itoa(attempt)
+	}
+	sum := sha1.Sum([]byte(key))
+	name := prefix + hex.EncodeToString(sum[:])
+	return name[:MaxNameLen]
+}
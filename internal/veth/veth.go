@@ -0,0 +1,158 @@
+// Package veth creates and removes the veth pairs connecting containers
+// to the host, independent of what the host end gets plugged into.
+package veth
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// Handle is the subset of netlink operations the veth setup needs, plus
+// creating a multiqueue pair, which the vendored netlink library can't
+type Handle interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	VethAddMultiQueue(name, peerName string, mtu, txQueues, rxQueues int) error
+	LinkDel(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetName(link netlink.Link, name string) error
+	LinkSetNsFd(link netlink.Link, fd int) error
+}
+
+// Options are the properties of a new veth pair, zero values leave them
+// to the kernel
+type Options struct {
+	MTU      int
+	TxQueues int
+	RxQueues int
+
+	// HostPrefix, if set, names the host end HashedName(HostPrefix,
+	// HostKey) instead of a random name
+	HostPrefix string
+	HostKey    string
+}
+
+// MaxAttempts is how many pairs of names Setup tries before it
+// gives up with a *CollisionError
+const MaxAttempts = 10
+
+// CollisionError is returned by Setup when every attempt picked a
+// temporary or host name that was taken already, which only happens
+// under heavy parallel attach
+type CollisionError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *CollisionError) Error() string {
+	return fmt.Sprintf("failed to make veth pair: names collided %v times: %v", e.Attempts, e.Err)
+}
+
+// Setup creates a veth pair with h in the host netns, moves one end into
+// netns and renames it to ifName with ch, a handle bound to netns. It
+// returns the name of the host end.
+func Setup(h, ch Handle, netns ns.NetNS, ifName string, o Options) (string, error) {
+	var err error
+	for i := 1; i <= MaxAttempts; i++ {
+		var hostVethName string
+		hostVethName, err = setup(h, ch, netns, ifName, o, i-1)
+		if err == nil {
+			return hostVethName, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		logrus.Debugf("rancher-cni-bridge: veth name collision on attempt %v: %v", i, err)
+	}
+	return "", &CollisionError{Attempts: MaxAttempts, Err: err}
+}
+
+// setup makes one attempt of Setup with fresh names. Errors from the
+// names being taken are returned as is, so Setup can retry.
+func setup(h, ch Handle, netns ns.NetNS, ifName string, o Options, attempt int) (string, error) {
+	hostVethName, err := ip.RandomVethName()
+	if err != nil {
+		return "", err
+	}
+	if o.HostPrefix != "" {
+		hostVethName = HashedName(o.HostPrefix, o.HostKey, attempt)
+	}
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return "", err
+	}
+
+	if o.TxQueues > 1 || o.RxQueues > 1 {
+		err = h.VethAddMultiQueue(tmpName, hostVethName, o.MTU, o.TxQueues, o.RxQueues)
+	} else {
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: tmpName,
+				MTU:  o.MTU,
+			},
+			PeerName: hostVethName,
+		}
+		err = h.LinkAdd(veth)
+	}
+	if os.IsExist(err) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to make veth pair: %v", err)
+	}
+
+	contVeth, err := h.LinkByName(tmpName)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup %q: %v", tmpName, err)
+	}
+	if err = h.LinkSetNsFd(contVeth, int(netns.Fd())); err != nil {
+		h.LinkDel(contVeth)
+		// the temporary name is taken in the container netns
+		if os.IsExist(err) {
+			return "", err
+		}
+		return "", fmt.Errorf("failed to move veth to container netns: %v", err)
+	}
+
+	contVeth, err = ch.LinkByName(tmpName)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup %q in %q: %v", tmpName, netns.Path(), err)
+	}
+	if err = ch.LinkSetName(contVeth, ifName); err != nil {
+		ch.LinkDel(contVeth)
+		// not a collision of the random names, ifName is taken
+		return "", fmt.Errorf("failed to rename %q to %q: %v", tmpName, ifName, err)
+	}
+	if err = ch.LinkSetUp(contVeth); err != nil {
+		return "", fmt.Errorf("failed to set %q up: %v", ifName, err)
+	}
+
+	hostVeth, err := h.LinkByName(hostVethName)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	if err = h.LinkSetUp(hostVeth); err != nil {
+		return "", fmt.Errorf("failed to set %q up: %v", hostVethName, err)
+	}
+
+	return hostVethName, nil
+}
+
+// Del deletes the interface, tolerating it being gone already
+func Del(h Handle, ifName string) error {
+	iface, err := h.LinkByName(ifName)
+	if err != nil {
+		logrus.Infof("rancher-cni-bridge: %q already gone: %v", ifName, err)
+		return nil
+	}
+
+	if err = h.LinkDel(iface); err != nil {
+		return fmt.Errorf("failed to delete %q: %v", ifName, err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/rancher/rancher-cni-bridge/pkg/bridgecni"
+)
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func main() {
+	bridgecni.Main()
+}
@@ -0,0 +1,108 @@
+package bridgecni
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// Request identifies the container interface to act on, the in-process
+// counterpart of the CNI_* environment variables
+type Request struct {
+	ContainerID string
+	Netns       string
+	IfName      string
+	// CNI_ARGS, "K1=V1;K2=V2"
+	Args string
+	// CNI_PATH, where the IPAM plugin is looked up
+	Path string
+}
+
+// LoadConfig parses and validates a network configuration the way the
+// plugin does with its stdin
+func LoadConfig(bytes []byte) (*NetConf, error) {
+	return loadNetConf(bytes)
+}
+
+// clone copies n deep enough that a call can point it at another bridge
+// or fill it in without the caller's config changing under it. It goes
+// through JSON so a pointer field added to the config is copied without
+// clone having to know about it; only the unexported fields are carried
+// over by hand.
+func (n *NetConf) clone() (*NetConf, error) {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy config: %v", err)
+	}
+	c := &NetConf{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("failed to copy config: %v", err)
+	}
+	c.raw = n.raw
+	if n.Standby != nil {
+		c.Standby.primaryBridge = n.Standby.primaryBridge
+		c.Standby.primaryUplink = n.Standby.primaryUplink
+	}
+	return c, nil
+}
+
+// cmdArgs turns r into what the plugin gets from skel, and sets up the
+// environment the IPAM plugin expects
+func (r *Request) cmdArgs(command string, n *NetConf) (*skel.CmdArgs, error) {
+	if n.raw == nil {
+		return nil, fmt.Errorf("config must come from LoadConfig")
+	}
+	args := &skel.CmdArgs{
+		ContainerID: r.ContainerID,
+		Netns:       r.Netns,
+		IfName:      r.IfName,
+		Args:        r.Args,
+		Path:        r.Path,
+		StdinData:   n.raw,
+	}
+	return args, setCNIEnv(command, args)
+}
+
+// Add attaches the container like the ADD command, and returns the
+// result instead of printing it. n is left as it is, so it can be
+// reused for other containers. The CNI_* variables of the process are
+// set for the IPAM plugin, so calls must not run concurrently.
+func Add(n *NetConf, r *Request) (*types.Result, error) {
+	args, err := r.cmdArgs("ADD", n)
+	if err != nil {
+		return nil, err
+	}
+	c, err := n.clone()
+	if err != nil {
+		return nil, err
+	}
+	return add(args, c)
+}
+
+// Del detaches the container like the DEL command
+func Del(n *NetConf, r *Request) error {
+	args, err := r.cmdArgs("DEL", n)
+	if err != nil {
+		return err
+	}
+	c, err := n.clone()
+	if err != nil {
+		return err
+	}
+	return del(args, c)
+}
+
+// Check verifies the attachment of the container like the CHECK command
+func Check(n *NetConf, r *Request) error {
+	args, err := r.cmdArgs("CHECK", n)
+	if err != nil {
+		return err
+	}
+	c, err := n.clone()
+	if err != nil {
+		return err
+	}
+	return check(args, c)
+}
@@ -0,0 +1,45 @@
+package bridgecni
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+// ARPSysctlConf pins the ARP behaviour of an interface, e.g. so a host
+// with several bridges only answers ARP for container addresses on the
+// right one. Unset ones are left alone.
+type ARPSysctlConf struct {
+	// ArpIgnore is 0-3 or 8 as in net.ipv4.conf.<if>.arp_ignore
+	ArpIgnore *int `json:"arpIgnore"`
+	// ArpAnnounce is 0-2 as in net.ipv4.conf.<if>.arp_announce
+	ArpAnnounce *int `json:"arpAnnounce"`
+}
+
+func (c *ARPSysctlConf) validate() error {
+	if c.ArpIgnore != nil && (*c.ArpIgnore < 0 || *c.ArpIgnore > 8 || (*c.ArpIgnore > 3 && *c.ArpIgnore < 8)) {
+		return fmt.Errorf("invalid arpIgnore %v, must be 0-3 or 8", *c.ArpIgnore)
+	}
+	if c.ArpAnnounce != nil && (*c.ArpAnnounce < 0 || *c.ArpAnnounce > 2) {
+		return fmt.Errorf("invalid arpAnnounce %v, must be 0, 1 or 2", *c.ArpAnnounce)
+	}
+	return nil
+}
+
+// setARPSysctls applies c to ifName
+func setARPSysctls(ifName string, c *ARPSysctlConf) error {
+	values := map[string]*int{
+		"arp_ignore":   c.ArpIgnore,
+		"arp_announce": c.ArpAnnounce,
+	}
+	for name, value := range values {
+		if value == nil {
+			continue
+		}
+		path := filepath.Join(procSys, "net/ipv4/conf", ifName, name)
+		if err := writeSysfs(path, strconv.Itoa(*value)); err != nil {
+			return fmt.Errorf("failed to set %v of %q: %v", name, ifName, err)
+		}
+	}
+	return nil
+}
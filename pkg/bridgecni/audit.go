@@ -0,0 +1,179 @@
+package bridgecni
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	Command     string    `json:"command"`
+	Network     string    `json:"network"`
+	ContainerID string    `json:"containerID"`
+	Netns       string    `json:"netns"`
+	IfName      string    `json:"ifName"`
+	Args        string    `json:"args,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	MAC         string    `json:"mac,omitempty"`
+	Gateway     string    `json:"gateway,omitempty"`
+	DurationMs  int64     `json:"durationMs"`
+	Error       string    `json:"error,omitempty"`
+
+	// traffic of the interface over its lifetime, on DEL
+	Stats *ifStats `json:"stats,omitempty"`
+
+	// PrevHash is the SHA-256 of the line before, so editing or dropping
+	// an entry breaks the chain of every one after it
+	PrevHash string `json:"prevHash"`
+}
+
+// maxAuditLine bounds how far back the previous line is looked for
+const maxAuditLine = 64 << 10
+
+// writeAudit appends a JSON record of the operation to the audit log,
+// if one is configured, with the IP and MAC of the attachment a. Failing
+// to write it never fails the operation.
+func writeAudit(n *NetConf, command string, args *skel.CmdArgs, a *attachment, stats *ifStats, opErr error, start time.Time) {
+	if n.AuditLog == "" {
+		return
+	}
+
+	entry := &auditEntry{
+		Time:        start.UTC(),
+		Command:     command,
+		Network:     n.Name,
+		ContainerID: args.ContainerID,
+		Netns:       args.Netns,
+		IfName:      args.IfName,
+		Args:        args.Args,
+		DurationMs:  int64(time.Since(start) / time.Millisecond),
+		Stats:       stats,
+	}
+	if a != nil {
+		entry.MAC = a.MAC
+		if a.Result != nil && a.Result.IP4 != nil {
+			entry.IP = a.Result.IP4.IP.String()
+			if a.Result.IP4.Gateway != nil {
+				entry.Gateway = a.Result.IP4.Gateway.String()
+			}
+		}
+	}
+	if opErr != nil {
+		entry.Error = opErr.Error()
+	}
+
+	f, err := os.OpenFile(n.AuditLog, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to open audit log: %v", err)
+		return
+	}
+	defer f.Close()
+
+	// the chain needs the previous line to stay the last one until this
+	// one is written
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to lock audit log: %v", err)
+		return
+	}
+	prev, err := lastAuditLine(f)
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to read audit log: %v", err)
+		return
+	}
+	entry.PrevHash = auditHash(prev)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to encode audit entry: %v", err)
+		return
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to write audit log: %v", err)
+	}
+}
+
+// auditHash is the PrevHash of the entry following line, "" for the
+// first entry
+func auditHash(line []byte) string {
+	if len(line) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// lastAuditLine returns the last line of the audit log without its
+// newline, nil if the log is empty
+func lastAuditLine(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return nil, nil
+	}
+	off := size - maxAuditLine
+	if off < 0 {
+		off = 0
+	}
+	buf := make([]byte, size-off)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	buf = bytes.TrimSuffix(buf, []byte("\n"))
+	i := bytes.LastIndexByte(buf, '\n')
+	if i < 0 && off > 0 {
+		return nil, fmt.Errorf("last entry is longer than %v bytes", maxAuditLine)
+	}
+	return buf[i+1:], nil
+}
+
+// runVerifyAudit checks the hash chain of an audit log and reports the
+// first entry that doesn't follow from the one before
+func runVerifyAudit(argv []string) error {
+	flags := flag.NewFlagSet("verify-audit", flag.ContinueOnError)
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: verify-audit <audit log>")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var prev []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, maxAuditLine), maxAuditLine)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		entry := &auditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return fmt.Errorf("line %v: %v", lineNo, err)
+		}
+		if entry.PrevHash != auditHash(prev) {
+			return fmt.Errorf("line %v: chain broken, the entry before was changed or removed", lineNo)
+		}
+		prev = append(prev[:0], scanner.Bytes()...)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Println("audit log intact")
+	return nil
+}
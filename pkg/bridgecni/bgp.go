@@ -0,0 +1,99 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	bgpAnnounceSubnet = "subnet"
+	bgpAnnounceHost   = "host"
+)
+
+// BGPConf has the daemon announce container prefixes through a local
+// gobgpd, so upstream routers can route to containers natively.
+// Announce is "subnet" for the network's subnet or "host" for a /32
+// per container.
+type BGPConf struct {
+	Announce string `json:"announce"`
+
+	// gobgpd API endpoint, the gobgp CLI default if unset
+	Host string `json:"host"`
+	Port int    `json:"port"`
+
+	// NextHop to announce, gobgpd picks its own address if unset
+	NextHop string `json:"nextHop"`
+}
+
+func (b *BGPConf) validate() error {
+	if b.Announce != bgpAnnounceSubnet && b.Announce != bgpAnnounceHost {
+		return fmt.Errorf("invalid bgp announce %q, must be %q or %q", b.Announce, bgpAnnounceSubnet, bgpAnnounceHost)
+	}
+	if b.Port < 0 || b.Port > 65535 {
+		return fmt.Errorf("invalid bgp port %v", b.Port)
+	}
+	if b.NextHop != "" && net.ParseIP(b.NextHop) == nil {
+		return fmt.Errorf("invalid bgp nextHop %q", b.NextHop)
+	}
+	return nil
+}
+
+// bgpPrefix is what gets announced for a container with address ipn
+func bgpPrefix(b *BGPConf, ipn *net.IPNet) *net.IPNet {
+	if b.Announce == bgpAnnounceHost {
+		return &net.IPNet{IP: ipn.IP, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask}
+}
+
+// bgpAnnounce adds prefix to the global RIB of gobgpd, announcing an
+// already announced prefix again is harmless
+func bgpAnnounce(b *BGPConf, prefix *net.IPNet) error {
+	args := []string{"global", "rib", "add", "-a", "ipv4", prefix.String()}
+	if b.NextHop != "" {
+		args = append(args, "nexthop", b.NextHop)
+	}
+	return gobgp(b, args...)
+}
+
+// bgpWithdraw removes prefix from the global RIB of gobgpd
+func bgpWithdraw(b *BGPConf, prefix *net.IPNet) error {
+	return gobgp(b, "global", "rib", "del", "-a", "ipv4", prefix.String())
+}
+
+func gobgp(b *BGPConf, args ...string) error {
+	var global []string
+	if b.Host != "" {
+		global = append(global, "-u", b.Host)
+	}
+	if b.Port != 0 {
+		global = append(global, "-p", fmt.Sprint(b.Port))
+	}
+	out, err := exec.Command("gobgp", append(global, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("gobgp %v failed: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// bgpAfterAdd announces the container's prefix after a successful ADD
+func bgpAfterAdd(n *NetConf, ipn *net.IPNet) {
+	if err := bgpAnnounce(n.BGP, bgpPrefix(n.BGP, ipn)); err != nil {
+		logrus.Errorf("rancher-cni-bridge: %v", err)
+	}
+}
+
+// bgpAfterDel withdraws the container's /32. A subnet stays announced
+// as long as the host serves the network.
+func bgpAfterDel(n *NetConf, ipn *net.IPNet) {
+	if n.BGP.Announce != bgpAnnounceHost {
+		return
+	}
+	if err := bgpWithdraw(n.BGP, bgpPrefix(n.BGP, ipn)); err != nil {
+		logrus.Errorf("rancher-cni-bridge: %v", err)
+	}
+}
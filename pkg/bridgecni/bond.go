@@ -0,0 +1,98 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const defaultBondMiimon = 100
+
+// BondConf bonds physical NICs into the uplink of the bridge
+type BondConf struct {
+	Name   string   `json:"name"`
+	Mode   string   `json:"mode"`
+	Slaves []string `json:"slaves"`
+	// link monitoring interval in ms
+	Miimon int `json:"miimon"`
+}
+
+// validate fills in the defaults and checks the bond can be built
+func (b *BondConf) validate() error {
+	if b.Name == "" || len(b.Slaves) == 0 {
+		return fmt.Errorf("bond needs a name and slaves")
+	}
+	if len(b.Name) > 15 {
+		return fmt.Errorf("bond name %q is longer than 15 characters", b.Name)
+	}
+	if b.Mode == "" {
+		b.Mode = "active-backup"
+	}
+	switch b.Mode {
+	case "802.3ad", "active-backup":
+	default:
+		return fmt.Errorf("unsupported bond mode %q, must be 802.3ad or active-backup", b.Mode)
+	}
+	if b.Miimon == 0 {
+		b.Miimon = defaultBondMiimon
+	}
+	if b.Miimon < 0 {
+		return fmt.Errorf("bond miimon must not be negative")
+	}
+	return nil
+}
+
+// ensureBond creates the bond if needed, enslaves the NICs missing from
+// it and plugs it into the bridge
+func ensureBond(b *BondConf, br netlink.Link, mtu int) error {
+	h := ops.Host()
+	link, err := h.LinkByName(b.Name)
+	if err != nil {
+		bond := netlink.NewLinkBond(netlink.LinkAttrs{Name: b.Name, MTU: mtu})
+		bond.Mode = netlink.StringToBondModeMap[b.Mode]
+		bond.Miimon = b.Miimon
+		if err = h.LinkAdd(bond); err != nil {
+			return fmt.Errorf("failed to create bond %q: %v", b.Name, err)
+		}
+		if link, err = h.LinkByName(b.Name); err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", b.Name, err)
+		}
+		logrus.Infof("rancher-cni-bridge: created %v bond %v", b.Mode, b.Name)
+	} else if link.Type() != "bond" {
+		return fmt.Errorf("%q already exists but is a %v, not a bond", b.Name, link.Type())
+	}
+
+	for _, name := range b.Slaves {
+		slave, err := h.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup bond slave %q: %v", name, err)
+		}
+		if slave.Attrs().MasterIndex == link.Attrs().Index {
+			continue
+		}
+		// only a down NIC can join a bond
+		if err = h.LinkSetDown(slave); err != nil {
+			return fmt.Errorf("failed to set %q down: %v", name, err)
+		}
+		if err = h.LinkSetMasterByIndex(slave, link.Attrs().Index); err != nil {
+			return fmt.Errorf("failed to add %q to bond %q: %v", name, b.Name, err)
+		}
+		if err = h.LinkSetUp(slave); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", name, err)
+		}
+	}
+
+	if link.Attrs().MasterIndex != br.Attrs().Index {
+		if err = h.LinkSetMasterByIndex(link, br.Attrs().Index); err != nil {
+			return fmt.Errorf("failed to add bond %q to bridge: %v", b.Name, err)
+		}
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err = h.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", b.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,863 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridgecni
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/utils"
+	"github.com/rancher/rancher-cni-bridge/internal/bridge"
+	"github.com/rancher/rancher-cni-bridge/internal/ipconfig"
+	"github.com/rancher/rancher-cni-bridge/internal/veth"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultBrName = "cni0"
+	dockerBrName  = "docker0"
+)
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	result, err := add(args, n)
+	if err != nil {
+		return err
+	}
+	return printResult(args, n, result)
+}
+
+// add runs ADD with everything around it: hooks, audit, metrics and
+// notifications
+func add(args *skel.CmdArgs, n *NetConf) (*types.Result, error) {
+	if err := fixIfName(n, args); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	var result *types.Result
+	err := runHooks(n, "preAdd", args, nil, nil)
+	if err == nil {
+		result, err = execAdd(args, n)
+	}
+	var a *attachment
+	if err == nil {
+		// hooks and audit get the MAC ADD ended up with from the record
+		var lerr error
+		if a, lerr = loadAttachment(n, args.ContainerID, args.IfName); lerr != nil {
+			logrus.Errorf("rancher-cni-bridge: %v", lerr)
+		}
+	}
+	writeAudit(n, "ADD", args, a, nil, err, start)
+	emitMetrics(n, "ADD", err, start)
+	if err != nil {
+		if n.Diagnostics {
+			writeDiagnostics(n, args, err)
+		}
+		return nil, err
+	}
+	updateReadiness(n, true)
+
+	logHookError(runHooks(n, "postAdd", args, a, nil))
+	notifyWebhook(n, "attach", args, a)
+	return result, nil
+}
+
+// execAdd runs ADD through the daemon if one is configured and
+// reachable, in-process otherwise
+func execAdd(args *skel.CmdArgs, n *NetConf) (*types.Result, error) {
+	if n.DaemonSocket != "" {
+		result, err := daemonAdd(n.DaemonSocket, args)
+		if err != errDaemonUnavailable {
+			return result, err
+		}
+		logrus.Debugf("rancher-cni-bridge: daemon not reachable at %v, running in-process", n.DaemonSocket)
+	}
+
+	return addNetwork(args, n)
+}
+
+// addNetwork does the actual work of ADD and returns the result
+// instead of printing it, so it can be shared with the daemon.
+func addNetwork(args *skel.CmdArgs, n *NetConf) (_ *types.Result, err error) {
+	defer setupLogging(n)()
+	logVersion()
+
+	unlock, err := lockNetwork(n)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	nArgs, err := loadNetArgs(args.Args)
+	if err != nil {
+		return nil, err
+	}
+	applyRuntimeMAC(n, nArgs)
+	if err = resolveBridgeName(n, nArgs); err != nil {
+		return nil, err
+	}
+	selectActiveBridge(n)
+
+	if result, err := checkDuplicateAdd(args, n); result != nil || err != nil {
+		return result, err
+	}
+
+	if err = validateMTU(n); err != nil {
+		return nil, err
+	}
+
+	var br netlink.Link
+	if bridgeName(n) != "" {
+		if br, err = setupBridge(n); err != nil {
+			return nil, err
+		}
+	}
+
+	netns, err := ops.OpenNS(args.Netns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	// all container side netlink operations go through a handle bound
+	// to the container netns, so they can't land in the wrong namespace
+	// regardless of which OS thread the goroutine runs on
+	ch, err := ops.NSHandle(netns)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Delete()
+
+	var (
+		result                   = &types.Result{}
+		hostVethName, hostDevice string
+		vf                       *int
+		allocated, created       bool
+		allocator                string
+	)
+	// a failed ADD takes back whatever it got to: the host rules, the
+	// interface it created and the address, so nothing leaks and a retry
+	// starts from scratch
+	defer func() {
+		if err == nil {
+			return
+		}
+		if allocated && result.IP4 != nil {
+			if err := teardownHostRules(args, n, nil, &result.IP4.IP); err != nil {
+				logrus.Errorf("rancher-cni-bridge: failed to clean up after ADD of %v: %v", args.ContainerID, err)
+			}
+		}
+		if created {
+			if err := delContainerLinks(ch, args, n, &attachment{HostDevice: hostDevice, VF: vf}); err != nil {
+				logrus.Errorf("rancher-cni-bridge: failed to clean up after ADD of %v: %v", args.ContainerID, err)
+			}
+		}
+		if allocated {
+			releaseIPAM(n, args, allocator)
+		}
+	}()
+
+	// run the IPAM plugin and get back the config to apply. This is done
+	// up front so that all of the container side work below can happen
+	// in one pass.
+	if !ipamDisabled(n) {
+		result, allocator, err = execIPAMAdd(n, args, nArgs)
+		if err != nil {
+			return nil, err
+		}
+		allocated = true
+
+		// TODO: make this optional when IPv6 is supported
+		if result.IP4 == nil {
+			return nil, errors.New("IPAM plugin returned missing IPv4 config")
+		}
+
+		if result.IP4.Gateway == nil && n.IsGW {
+			result.IP4.Gateway = ipconfig.GatewayIP(&result.IP4.IP)
+		}
+
+		if n.Mode == modeRouted {
+			routedResult(result)
+		}
+
+		if result.IP6 != nil && result.IP6.Gateway == nil {
+			if result.IP6.Gateway, err = ensureBridgeGatewayV6(n.BrName); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, r := range n.DeviceRoutes {
+			_, dst, _ := net.ParseCIDR(r)
+			result.IP4.Routes = append(result.IP4.Routes, types.Route{Dst: *dst, GW: net.IPv4zero})
+		}
+
+		if n.MetadataRoute {
+			if err = addMetadataRoute(n, result.IP4); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if n.DisableContainerRoutes {
+		for _, ipc := range []*types.IPConfig{result.IP4, result.IP6} {
+			if ipc != nil {
+				ipc.Routes = nil
+			}
+		}
+	}
+
+	// Check if the container interface already exists. Creating it needs
+	// the host netns too, so it happens before entering the container's.
+	if _, err := ch.LinkByName(args.IfName); err != nil {
+		switch n.Mode {
+		case modeHostDevice:
+			hostDevice, err = moveHostDevice(ch, netns, args.IfName, n)
+		case modeSRIOV:
+			var idx int
+			idx, hostDevice, err = attachVF(ch, netns, args.IfName, n, string(nArgs.MACAddress))
+			vf = &idx
+		default:
+			hostVethName, err = setupContainerVeth(ch, netns, args.ContainerID, args.IfName, n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		created = true
+	} else {
+		logrus.Infof("rancher-cni-bridge: container already has interface: %v, no worries", args.IfName)
+	}
+
+	// the rest of the container side happens in one pass through its
+	// netns: sysctls, ethtool and packet sockets follow the thread,
+	// netlink goes through ch
+	if err = netns.Do(func(_ ns.NetNS) error {
+		// a VF got its MAC through the PF already
+		if nArgs.MACAddress != "" && n.Mode != modeSRIOV {
+			err := ipconfig.SetMAC(ch, args.IfName, string(nArgs.MACAddress))
+			if err != nil {
+				logrus.Errorf("error setting MAC address: %v", err)
+				return fmt.Errorf("couldn't set the MAC Address of the interface: %v", err)
+			}
+			logrus.Debugf("rancher-cni-bridge: have set the %v interface %v MAC address: %v", args.ContainerID, args.IfName, nArgs.MACAddress)
+		} else {
+			logrus.Infof("rancher-cni-bridge: no MAC address specified to set for container: %v", args.ContainerID)
+		}
+
+		overHeadToUse := 0
+		if nArgs.LinkMTUOverhead != "" {
+			var err error
+			overHeadToUse, err = strconv.Atoi(string(nArgs.LinkMTUOverhead))
+			if err != nil {
+				logrus.Errorf("Error converting LinkMTUOverhead: %v to int", nArgs.LinkMTUOverhead)
+				overHeadToUse = n.LinkMTUOverhead
+			}
+		} else {
+			overHeadToUse = n.LinkMTUOverhead
+		}
+
+		linkMTU := n.MTU - overHeadToUse
+		logrus.Debugf("rancher-cni-bridge: overHeadToUse: %v, linkMTU: %v", overHeadToUse, linkMTU)
+
+		if linkMTU > 0 {
+			logrus.Debugf("rancher-cni-bridge: setting %v linkMTU: %v", args.IfName, linkMTU)
+			cIntf, err := ch.LinkByName(args.IfName)
+			if err != nil {
+				err = fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+				return err
+			}
+
+			err = ch.LinkSetMTU(cIntf, linkMTU)
+			if err != nil {
+				err = fmt.Errorf("failed to set link MTU: %v", err)
+				return err
+			}
+		}
+
+		if n.EnableDAD != nil || n.IPv6AddrGen != "" {
+			// down drops the link-local address made up the default way,
+			// ConfigureInterface brings the link back up with a new one
+			cIntf, err := ch.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+			}
+			if err = ch.LinkSetDown(cIntf); err != nil {
+				return fmt.Errorf("failed to set %q down: %v", args.IfName, err)
+			}
+		}
+
+		if n.EnableDAD != nil {
+			if err := setDAD(args.IfName, *n.EnableDAD); err != nil {
+				return err
+			}
+		}
+
+		if n.IPv6AddrGen != "" {
+			if err := setIPv6AddrGen(args.IfName, args.ContainerID, n.IPv6AddrGen, n.IPv6Token); err != nil {
+				return err
+			}
+		}
+
+		// set the default gateway if requested
+		if n.IsDefaultGW {
+			_, defaultNet, err := net.ParseCIDR("0.0.0.0/0")
+			if err != nil {
+				return err
+			}
+
+			for _, route := range result.IP4.Routes {
+				if defaultNet.String() == route.Dst.String() {
+					if route.GW != nil && !route.GW.Equal(result.IP4.Gateway) {
+						return fmt.Errorf(
+							"isDefaultGateway ineffective because IPAM sets default route via %q",
+							route.GW,
+						)
+					}
+				}
+			}
+
+			result.IP4.Routes = append(
+				result.IP4.Routes,
+				types.Route{Dst: *defaultNet, GW: result.IP4.Gateway},
+			)
+
+			// TODO: IPV6
+		}
+
+		if len(n.DefaultGateways) > 0 {
+			for _, route := range result.IP4.Routes {
+				if route.Dst.String() == "0.0.0.0/0" {
+					return fmt.Errorf("defaultGateways ineffective because IPAM sets default route via %q", route.GW)
+				}
+			}
+		}
+
+		if err := ipconfig.ConfigureInterface(ch, args.IfName, result, n.RouteSrc); err != nil {
+			return err
+		}
+		if len(n.DefaultGateways) > 0 {
+			if err := ipconfig.AddECMPDefaultRoute(ch, args.IfName, result.IP4, n.DefaultGateways, ipconfig.RouteSrcIP(n.RouteSrc, result.IP4)); err != nil {
+				return err
+			}
+		}
+		if n.LinkLocalIPv4 {
+			if err := addLinkLocalAddr(ch, args.IfName, args.ContainerID); err != nil {
+				return err
+			}
+		}
+		if err := ipconfig.AddBlackholeRoutes(ch, n.BlackholeRoutes); err != nil {
+			return err
+		}
+
+		if n.Offloads != nil {
+			if err := setOffloads(args.IfName, n.Offloads); err != nil {
+				return err
+			}
+		}
+
+		if n.RouteMetrics != nil {
+			if err := setRouteMetrics(ch, args.IfName, result, n.DefaultGateways, n.RouteSrc, n.RouteMetrics); err != nil {
+				return err
+			}
+		}
+
+		containerIPv6 := n.ContainerIPv6
+		if containerIPv6 == nil && n.SLAAC {
+			containerIPv6 = slaacContainerIPv6
+		}
+		if containerIPv6 != nil {
+			return setIPv6Sysctls(args.IfName, containerIPv6)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if hostVethName != "" {
+		if n.Mode == modeRouted {
+			err = setupRoutedPort(ch, args.IfName, hostVethName, result.IP4.IP.IP)
+		} else {
+			err = attachPort(n, br, hostVethName, args)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = configureHostPort(n, nArgs, hostVethName); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.HostRoutes != nil {
+		if err = setupHostRoute(n.BrName, result.IP4.IP.IP, n.HostRoutes); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.VXLAN != nil {
+		// a stale fdb only costs flooding, so don't fail the ADD over it
+		if err := syncFDB(n); err != nil {
+			logrus.Errorf("rancher-cni-bridge: failed to sync VXLAN fdb: %v", err)
+		}
+	}
+
+	if n.IsGW {
+		gwn := &net.IPNet{
+			IP:   result.IP4.Gateway,
+			Mask: result.IP4.IP.Mask,
+		}
+
+		if n.AdoptExisting {
+			logrus.Debugf("rancher-cni-bridge: not assigning gateway %v to adopted bridge %v", gwn, n.BrName)
+		} else if err = bridge.EnsureAddr(ops.Host(), br, gwn, n.ForceAddress); err != nil {
+			return nil, err
+		}
+
+		if err := ops.EnableIP4Forward(); err != nil {
+			return nil, fmt.Errorf("failed to enable forwarding: %v", err)
+		}
+	}
+
+	if n.IPMasq {
+		chain := utils.FormatChainName(n.Name, args.ContainerID)
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = ops.SetupIPMasq(ip.Network(&result.IP4.IP), chain, comment); err != nil {
+			return nil, err
+		}
+	}
+
+	if clamp := mssClamp(n); clamp != "" {
+		if err = setupMSSClamp(n.BrName, clamp); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.ConntrackZone != 0 {
+		if err = setupConntrackZone(n.BrName, n.ConntrackZone); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(n.RuntimeConfig.PortMappings) > 0 {
+		if err = setupPortMappings(n, args.ContainerID, result.IP4.IP.IP); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.Firewall != nil {
+		if err = setupFirewall(n, args.ContainerID, string(nArgs.RancherContainerUUID), result.IP4.IP.IP); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.DSCP != 0 {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = setupDSCP(&result.IP4.IP, n.DSCP, comment); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.Mark != "" {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = setupMark(&result.IP4.IP, n.Mark, comment); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.ConnLimit != 0 {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = setupConnLimit(result.IP4.IP.IP, n.ConnLimit, comment); err != nil {
+			return nil, err
+		}
+	}
+
+	result.DNS = resultDNS(n, nArgs)
+
+	var mac string
+	if link, err := ch.LinkByName(args.IfName); err == nil {
+		mac = link.Attrs().HardwareAddr.String()
+	}
+	if n.StaticFDB && hostVethName != "" {
+		if err = bridge.AddStaticFDB(ops.Host(), hostVethName, mac); err != nil {
+			return nil, err
+		}
+	}
+
+	// started last, nothing tears the capture down when ADD fails
+	if hostVethName != "" {
+		capture, err := boolArg("Capture", nArgs.Capture, n.Capture != nil)
+		if err != nil {
+			return nil, err
+		}
+		if capture {
+			c := n.Capture
+			if c == nil {
+				c = &CaptureConf{}
+				c.validate()
+			}
+			startCapture(n, args.ContainerID, hostVethName, c)
+		}
+	}
+
+	a := &attachment{
+		ContainerID:  args.ContainerID,
+		IfName:       args.IfName,
+		Netns:        args.Netns,
+		Bridge:       bridgeName(n),
+		HostVeth:     hostVethName,
+		HostDevice:   hostDevice,
+		MAC:          mac,
+		Args:         args.Args,
+		VF:           vf,
+		IPMasq:       n.IPMasq,
+		DSCP:         n.DSCP,
+		Mark:         n.Mark,
+		ConnLimit:    n.ConnLimit,
+		PortMappings: n.RuntimeConfig.PortMappings,
+		HostRoutes:   n.HostRoutes,
+		IPAM:         allocator,
+		Result:       result,
+	}
+	if err = saveAttachment(n, a); err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to record attachment of %v: %v", args.ContainerID, err)
+	}
+	announceLLDP(n, a, false)
+	if result.IP4 != nil {
+		announceGARP(n, netns, args.IfName, result.IP4.IP.IP)
+	}
+
+	return result, nil
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return del(args, n)
+}
+
+// del runs DEL with everything around it: hooks, audit, metrics and
+// notifications
+func del(args *skel.CmdArgs, n *NetConf) error {
+	if err := fixIfName(n, args); err != nil {
+		// ADD would have refused it, so there is nothing to delete
+		logrus.Infof("rancher-cni-bridge: %v: %v, nothing to delete", args.ContainerID, err)
+		return nil
+	}
+
+	// DEL forgets the attachment, hand the hooks what it was
+	a, err := loadAttachment(n, args.ContainerID, args.IfName)
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: %v", err)
+	}
+	logHookError(runHooks(n, "preDel", args, a, nil))
+
+	// the counters go away with the veth
+	stats := snapshotStats(a)
+
+	start := time.Now()
+	err = execDel(args, n)
+	writeAudit(n, "DEL", args, a, stats, err, start)
+	emitMetrics(n, "DEL", err, start)
+	if err == nil {
+		emitStats(n, stats)
+	}
+	logHookError(runHooks(n, "postDel", args, a, err))
+	if err == nil {
+		notifyWebhook(n, "detach", args, a)
+	}
+	return err
+}
+
+// execDel runs DEL through the daemon if one is configured and
+// reachable, in-process otherwise
+func execDel(args *skel.CmdArgs, n *NetConf) error {
+	if n.DaemonSocket != "" {
+		err := daemonDel(n.DaemonSocket, args)
+		if err != errDaemonUnavailable {
+			return err
+		}
+		logrus.Debugf("rancher-cni-bridge: daemon not reachable at %v, running in-process", n.DaemonSocket)
+	}
+
+	return delNetwork(args, n)
+}
+
+// delNetwork does the actual work of DEL, shared with the daemon.
+func delNetwork(args *skel.CmdArgs, n *NetConf) error {
+	if owner := sandboxOwner(args, n); owner != "" {
+		logrus.Infof("rancher-cni-bridge: %v is a duplicate of the sandbox of %v, leaving %v to it", args.ContainerID, owner, args.IfName)
+		return nil
+	}
+	if err := recordedBridgeName(n, args); err != nil {
+		return err
+	}
+	if err := delAttachment(args, n); err != nil {
+		return err
+	}
+	return removeBridgeIfEmpty(n)
+}
+
+// delAttachment tears down everything ADD set up for the container,
+// from the outside in: NAT, port and filter rules, then host routes,
+// then the container's addresses, then its links, and only then is the
+// address given back to IPAM. Every step tolerates its part being gone
+// already. A failing step stops DEL before the address is released, so
+// no rule is left pointing at an address another container may get.
+func delAttachment(args *skel.CmdArgs, n *NetConf) error {
+	defer setupLogging(n)()
+	logVersion()
+
+	// a crashed container may have taken its netns along, the host side
+	// still needs cleaning up then
+	var ch nlHandle
+	if args.Netns != "" {
+		netns, err := ops.OpenNS(args.Netns)
+		if err == nil {
+			defer netns.Close()
+			if ch, err = ops.NSHandle(netns); err != nil {
+				return err
+			}
+			defer ch.Delete()
+		} else {
+			logrus.Infof("rancher-cni-bridge: netns of %v is gone (%v), cleaning up the host side only", args.ContainerID, err)
+		}
+	}
+
+	// what ADD recorded takes precedence over the current config, so
+	// exactly what was set up gets removed
+	a, err := loadAttachment(n, args.ContainerID, args.IfName)
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: ignoring unreadable state of %v: %v", args.ContainerID, err)
+	}
+	announceLLDP(n, a, true)
+
+	if ipn := containerAddr(ch, args.IfName, a); ipn != nil {
+		if err = teardownHostRules(args, n, a, ipn); err != nil {
+			return err
+		}
+	}
+
+	if ch != nil && a != nil && a.Result != nil {
+		var ipns []*net.IPNet
+		for _, ipc := range []*types.IPConfig{a.Result.IP4, a.Result.IP6} {
+			if ipc != nil {
+				ipns = append(ipns, &ipc.IP)
+			}
+		}
+		if err = ipconfig.DelAddrs(ch, args.IfName, ipns); err != nil {
+			return err
+		}
+	}
+
+	if err = delContainerLinks(ch, args, n, a); err != nil {
+		return err
+	}
+
+	if !ipamDisabled(n) {
+		var allocator string
+		if a != nil {
+			allocator = a.IPAM
+		}
+		if err = execIPAMDel(n, args, allocator); err != nil {
+			return err
+		}
+	}
+
+	return removeAttachment(n, args.ContainerID, args.IfName)
+}
+
+// containerAddr returns the IPv4 address of the container: the one
+// handed out by ADD, or what the interface has if nothing was recorded.
+// nil means it has none.
+func containerAddr(ch nlHandle, ifName string, a *attachment) *net.IPNet {
+	if a != nil && a.Result != nil {
+		if a.Result.IP4 == nil {
+			return nil
+		}
+		return &a.Result.IP4.IP
+	}
+	if ch == nil {
+		return nil
+	}
+	ipn, err := ipconfig.FirstAddr(ch, ifName, netlink.FAMILY_V4)
+	if err != nil {
+		logrus.Infof("rancher-cni-bridge: no address of %v to clean up after: %v", ifName, err)
+		return nil
+	}
+	return ipn
+}
+
+// teardownHostRules removes the host side rules and routes of the
+// container at ipn, the NAT and port rules first
+func teardownHostRules(args *skel.CmdArgs, n *NetConf, a *attachment, ipn *net.IPNet) error {
+	ipMasq, dscp, mark, connLimit, hostRoutes := n.IPMasq, n.DSCP, n.Mark, n.ConnLimit, n.HostRoutes
+	if a != nil {
+		ipMasq, dscp, mark, connLimit, hostRoutes = a.IPMasq, a.DSCP, a.Mark, a.ConnLimit, a.HostRoutes
+	}
+	comment := utils.FormatComment(n.Name, args.ContainerID)
+
+	if err := teardownPortMappings(n, args.ContainerID, ipn.IP); err != nil {
+		return err
+	}
+
+	if ipMasq {
+		chain := utils.FormatChainName(n.Name, args.ContainerID)
+		if err := ops.TeardownIPMasq(ipn, chain, comment); err != nil {
+			return err
+		}
+	}
+
+	if err := teardownFirewall(n, args.ContainerID, ipn.IP); err != nil {
+		return err
+	}
+
+	if connLimit != 0 {
+		if err := teardownConnLimit(ipn.IP, connLimit, comment); err != nil {
+			return err
+		}
+	}
+
+	if dscp != 0 {
+		if err := teardownDSCP(ipn, dscp, comment); err != nil {
+			return err
+		}
+	}
+
+	if mark != "" {
+		if err := teardownMark(ipn, mark, comment); err != nil {
+			return err
+		}
+	}
+
+	if hostRoutes != nil {
+		teardownHostRoute(n.BrName, ipn.IP, hostRoutes)
+	}
+	return nil
+}
+
+// delContainerLinks removes the container interface, or hands a host
+// device or VF back, and unplugs it from an OVS bridge
+func delContainerLinks(ch nlHandle, args *skel.CmdArgs, n *NetConf, a *attachment) error {
+	switch {
+	case ch == nil:
+		// the interface went with the netns, a VF or host device is
+		// back in the host netns already
+	case n.Mode == modeHostDevice || n.Mode == modeSRIOV:
+		hostDevice := n.Device
+		if a != nil && a.HostDevice != "" {
+			hostDevice = a.HostDevice
+		}
+		if err := restoreHostDevice(ch, args.IfName, hostDevice); err != nil {
+			return err
+		}
+	default:
+		if err := veth.Del(ch, args.IfName); err != nil {
+			return err
+		}
+	}
+
+	// the host end of a recorded veth outlives a container end that was
+	// renamed or moved away
+	if a != nil && a.HostVeth != "" {
+		h := ops.Host()
+		if link, err := h.LinkByName(a.HostVeth); err == nil {
+			if err = h.LinkDel(link); err != nil {
+				return fmt.Errorf("failed to delete %q: %v", a.HostVeth, err)
+			}
+		}
+	}
+
+	if a != nil && a.VF != nil {
+		if err := releaseVF(n.PF, *a.VF); err != nil {
+			logrus.Errorf("rancher-cni-bridge: %v", err)
+		}
+	}
+
+	if n.Datapath == datapathOVS {
+		return delOVSPort(n.BrName, args.ContainerID, args.IfName)
+	}
+	return nil
+}
+
+// Main runs the plugin binary: one of the subcommands, or the CNI
+// command from the environment
+func Main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "daemon":
+			if err := runDaemon(os.Args[2:]); err != nil {
+				logrus.Fatalf("rancher-cni-bridge: daemon exited: %v", err)
+			}
+			return
+		case "sync-fdb":
+			if err := runSyncFDB(os.Args[2:]); err != nil {
+				logrus.Fatalf("rancher-cni-bridge: %v", err)
+			}
+			return
+		case "selftest":
+			if err := runSelftest(os.Args[2:]); err != nil {
+				logrus.Fatalf("rancher-cni-bridge: %v", err)
+			}
+			return
+		case "flush-cache":
+			if err := runFlushCache(os.Args[2:]); err != nil {
+				logrus.Fatalf("rancher-cni-bridge: %v", err)
+			}
+			return
+		case "reattach":
+			if err := runReattach(os.Args[2:]); err != nil {
+				logrus.Fatalf("rancher-cni-bridge: %v", err)
+			}
+			return
+		case "verify-audit":
+			if err := runVerifyAudit(os.Args[2:]); err != nil {
+				logrus.Fatalf("rancher-cni-bridge: %v", err)
+			}
+			return
+		case "validate":
+			if err := runValidate(os.Args[2:]); err != nil {
+				logrus.Fatalf("rancher-cni-bridge: invalid config: %v", err)
+			}
+			return
+		}
+	}
+
+	switch os.Getenv("CNI_COMMAND") {
+	case "CHECK":
+		runExtraVerb("CHECK", "0.4.0", withRecover("CHECK", cmdCheck))
+		return
+	case "GC":
+		runExtraVerb("GC", "1.1.0", withRecover("GC", cmdGC))
+		return
+	case "STATUS":
+		runExtraVerb("STATUS", "1.1.0", withRecover("STATUS", cmdStatus))
+		return
+	}
+
+	skel.PluginMain(withRecover("ADD", cmdAdd), withRecover("DEL", cmdDel), pluginVersions)
+}
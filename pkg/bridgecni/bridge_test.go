@@ -0,0 +1,468 @@
+//go:build test
+// +build test
+
+package bridgecni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/vishvananda/netlink"
+)
+
+const testConfig = `{
+	"name": "test", "type": "rancher-bridge", "dataDir": %q,
+	"bridge": "br0", "bridgeSubnet": "10.1.0.0/24", "isDefaultGateway": true
+}`
+
+// testNetConf loads config, a format string taking the data dir, with
+// the state kept in a temporary dir
+func testNetConf(t *testing.T, config string) (*NetConf, func()) {
+	dir, err := ioutil.TempDir("", "rancher-cni-bridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := loadNetConf([]byte(fmt.Sprintf(config, dir)))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return n, func() { os.RemoveAll(dir) }
+}
+
+func testArgs(n *NetConf, containerID string, netns *fakeNS) *skel.CmdArgs {
+	return &skel.CmdArgs{
+		ContainerID: containerID,
+		Netns:       netns.Path(),
+		IfName:      "eth0",
+		StdinData:   n.raw,
+	}
+}
+
+// hasAddr tells whether the link named name in netns has addr
+func hasAddr(netns *fakeNS, name, addr string) bool {
+	for _, a := range netns.Addrs(name) {
+		if a.IPNet.String() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAddDel(t *testing.T) {
+	f := newFakeOps()
+	cns := f.NewNS("/var/run/netns/c1")
+	n, cleanup := testNetConf(t, testConfig)
+	defer cleanup()
+	args := testArgs(n, "c1", cns)
+
+	result, err := addNetwork(args, n)
+	if err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+	if got := result.IP4.IP.String(); got != "10.1.0.2/24" {
+		t.Errorf("ADD handed out %v, want 10.1.0.2/24", got)
+	}
+	if got := result.IP4.Gateway.String(); got != "10.1.0.1" {
+		t.Errorf("ADD reported gateway %v, want 10.1.0.1", got)
+	}
+
+	br := f.host.Link("br0")
+	if br == nil {
+		t.Fatal("bridge br0 wasn't created")
+	}
+	if !hasAddr(f.host, "br0", "10.1.0.1/24") {
+		t.Errorf("br0 has %v, want 10.1.0.1/24", f.host.Addrs("br0"))
+	}
+	if cns.Link("eth0") == nil {
+		t.Fatal("eth0 wasn't created in the container")
+	}
+	if !hasAddr(cns, "eth0", "10.1.0.2/24") {
+		t.Errorf("eth0 has %v, want 10.1.0.2/24", cns.Addrs("eth0"))
+	}
+	var defaultRoute bool
+	for _, r := range cns.Routes() {
+		if r.Dst.String() == "0.0.0.0/0" && r.Gw.String() == "10.1.0.1" {
+			defaultRoute = true
+		}
+	}
+	if !defaultRoute {
+		t.Errorf("no default route via 10.1.0.1 in %v", cns.Routes())
+	}
+
+	a, err := loadAttachment(n, "c1", "eth0")
+	if err != nil || a == nil {
+		t.Fatalf("attachment not recorded: %v", err)
+	}
+	veth := f.host.Link(a.HostVeth)
+	if veth == nil {
+		t.Fatalf("host veth %v not found", a.HostVeth)
+	}
+	if veth.Attrs().MasterIndex != br.Attrs().Index {
+		t.Errorf("host veth %v isn't plugged into br0", a.HostVeth)
+	}
+
+	if err := delAttachment(args, n); err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	if f.host.Link(a.HostVeth) != nil || cns.Link("eth0") != nil {
+		t.Error("veth pair left after DEL")
+	}
+	if a, _ := loadAttachment(n, "c1", "eth0"); a != nil {
+		t.Error("attachment still recorded after DEL")
+	}
+
+	// DEL is repeated by runtimes, and must find nothing left to do
+	if err := delAttachment(args, n); err != nil {
+		t.Errorf("repeated DEL failed: %v", err)
+	}
+
+	// the address went back to IPAM
+	result, err = addNetwork(testArgs(n, "c2", f.NewNS("/var/run/netns/c2")), n)
+	if err != nil {
+		t.Fatalf("second ADD failed: %v", err)
+	}
+	if got := result.IP4.IP.String(); got != "10.1.0.2/24" {
+		t.Errorf("second ADD handed out %v, want the released 10.1.0.2/24", got)
+	}
+}
+
+func TestAddFailureCleansUp(t *testing.T) {
+	f := newFakeOps()
+	cns := f.NewNS("/var/run/netns/c1")
+	n, cleanup := testNetConf(t, testConfig)
+	defer cleanup()
+
+	// NAT is set up once the veth pair is in place and the address
+	// handed out
+	n.IPMasq = true
+	f.masqErr = fmt.Errorf("no NAT")
+	if _, err := addNetwork(testArgs(n, "c1", cns), n); err == nil {
+		t.Fatal("ADD succeeded without NAT")
+	}
+	if cns.Link("eth0") != nil {
+		t.Error("eth0 left in the container after the failed ADD")
+	}
+
+	for _, l := range f.host.links {
+		if l.Type() == "veth" {
+			t.Errorf("veth %v left after the failed ADD", l.Attrs().Name)
+		}
+	}
+	f.masqErr = nil
+	result, err := addNetwork(testArgs(n, "c2", f.NewNS("/var/run/netns/c2")), n)
+	if err != nil {
+		t.Fatalf("ADD after the failed one failed: %v", err)
+	}
+	if got := result.IP4.IP.String(); got != "10.1.0.2/24" {
+		t.Errorf("ADD handed out %v, the failed ADD kept 10.1.0.2/24", got)
+	}
+}
+
+// testIPAM installs an IPAM plugin handing out addr with gateway gw
+// into a temporary CNI_PATH
+func testIPAM(t *testing.T, name, addr, gw string) (string, func()) {
+	dir, err := ioutil.TempDir("", "rancher-cni-bridge-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := fmt.Sprintf("#!/bin/sh\n[ \"$CNI_COMMAND\" = ADD ] && echo '{\"ip4\": {\"ip\": %q, \"gateway\": %q}}'\nexit 0\n", addr, gw)
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestAddStandby(t *testing.T) {
+	f := newFakeOps()
+	cns := f.NewNS("/var/run/netns/c1")
+	h := f.Host()
+	// only the uplink of the standby bridge has carrier
+	for _, uplink := range []struct {
+		name  string
+		flags uint32
+	}{{"eth1", 0}, {"eth2", iffLowerUp}} {
+		link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: uplink.name, RawFlags: uplink.flags}}
+		if err := h.LinkAdd(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cniPath, cleanupIPAM := testIPAM(t, "test-ipam", "10.2.0.5/24", "10.2.0.1")
+	defer cleanupIPAM()
+
+	// the config of the README, with the state in a temporary dir
+	n, cleanup := testNetConf(t, `{
+		"cniVersion": "0.3.1", "name": "ha", "type": "rancher-cni-bridge", "dataDir": %q,
+		"bridge": "br-a", "uplink": "eth1",
+		"standby": {"bridge": "br-b", "uplink": "eth2"},
+		"ipam": {"type": "test-ipam", "subnet": "10.2.0.0/24", "gateway": "10.2.0.1"}
+	}`)
+	defer cleanup()
+	args := testArgs(n, "c1", cns)
+	args.Path = cniPath
+	if err := setCNIEnv("ADD", args); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := addNetwork(args, n)
+	if err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+	if got := result.IP4.IP.String(); got != "10.2.0.5/24" {
+		t.Errorf("ADD handed out %v, want 10.2.0.5/24", got)
+	}
+	a, err := loadAttachment(n, "c1", "eth0")
+	if err != nil || a == nil {
+		t.Fatalf("attachment not recorded: %v", err)
+	}
+	if a.Bridge != "br-b" {
+		t.Errorf("attached to %q, want br-b, the primary uplink has no carrier", a.Bridge)
+	}
+	br := f.host.Link("br-b")
+	if br == nil {
+		t.Fatal("bridge br-b wasn't created")
+	}
+	if addrs := f.host.Addrs("br-b"); len(addrs) > 0 {
+		t.Errorf("br-b has addresses %v", addrs)
+	}
+	if f.host.Link("eth2").Attrs().MasterIndex != br.Attrs().Index {
+		t.Error("eth2 isn't plugged into br-b")
+	}
+	if f.host.Link("eth1").Attrs().MasterIndex == br.Attrs().Index {
+		t.Error("eth1 is plugged into br-b")
+	}
+	if !hasAddr(cns, "eth0", "10.2.0.5/24") {
+		t.Errorf("eth0 has %v, want 10.2.0.5/24", cns.Addrs("eth0"))
+	}
+}
+
+func TestGCOrphanVeths(t *testing.T) {
+	f := newFakeOps()
+	cns := f.NewNS("/var/run/netns/c1")
+	n, cleanup := testNetConf(t, testConfig)
+	defer cleanup()
+	if _, err := addNetwork(testArgs(n, "c1", cns), n); err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+
+	h := f.Host()
+	br := f.host.Link("br0")
+	for _, v := range []struct {
+		name  string
+		flags uint32
+	}{{"vethdead", 0}, {"vethlive", iffLowerUp}, {"other", 0}} {
+		link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: v.name}, PeerName: v.name + "p"}
+		if err := h.LinkAdd(link); err != nil {
+			t.Fatal(err)
+		}
+		link.Attrs().RawFlags = v.flags
+		link.Attrs().MasterIndex = br.Attrs().Index
+	}
+
+	var conf map[string]interface{}
+	if err := json.Unmarshal(n.raw, &conf); err != nil {
+		t.Fatal(err)
+	}
+	conf["cni.dev/valid-attachments"] = []GCAttachment{{ContainerID: "c1", IfName: "eth0"}}
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdGC(&skel.CmdArgs{StdinData: stdin}); err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+
+	if f.host.Link("vethdead") != nil {
+		t.Error("orphaned vethdead wasn't collected")
+	}
+	for _, name := range []string{"vethlive", "other"} {
+		if f.host.Link(name) == nil {
+			t.Errorf("GC deleted %v", name)
+		}
+	}
+	if cns.Link("eth0") == nil {
+		t.Error("GC deleted the valid attachment")
+	}
+
+	// without the list every attachment would look stale
+	if err := cmdGC(&skel.CmdArgs{StdinData: n.raw}); err == nil {
+		t.Error("GC ran without cni.dev/valid-attachments")
+	}
+}
+
+func TestAddAfterContainerLinkGone(t *testing.T) {
+	f := newFakeOps()
+	cns := f.NewNS("/var/run/netns/c1")
+	n, cleanup := testNetConf(t, testConfig)
+	defer cleanup()
+	args := testArgs(n, "c1", cns)
+
+	if _, err := addNetwork(args, n); err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+	a, _ := loadAttachment(n, "c1", "eth0")
+	// the container end goes, leaving the host end behind
+	delete(cns.links, "eth0")
+
+	result, err := addNetwork(args, n)
+	if err != nil {
+		t.Fatalf("repeated ADD failed: %v", err)
+	}
+	if got := result.IP4.IP.String(); got != "10.1.0.2/24" {
+		t.Errorf("repeated ADD handed out %v, the stale record kept 10.1.0.2/24", got)
+	}
+	if f.host.Link(a.HostVeth) != nil {
+		t.Errorf("stale host veth %v left", a.HostVeth)
+	}
+}
+
+func TestDelReleasesFromRecordedAllocator(t *testing.T) {
+	f := newFakeOps()
+	cns := f.NewNS("/var/run/netns/c1")
+	n, cleanup := testNetConf(t, `{
+		"name": "test", "type": "rancher-bridge", "dataDir": %q,
+		"bridge": "br0", "bridgeSubnet": "10.1.0.0/24", "isDefaultGateway": true,
+		"ipam": {"type": "test-ipam"}
+	}`)
+	defer cleanup()
+	args := testArgs(n, "c1", cns)
+	emptyPath, err := ioutil.TempDir("", "rancher-cni-bridge-path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(emptyPath)
+	args.Path = emptyPath
+	if err := setCNIEnv("ADD", args); err != nil {
+		t.Fatal(err)
+	}
+
+	// the plugin isn't installed, the embedded allocator stands in
+	if _, err := addNetwork(args, n); err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+	if a, _ := loadAttachment(n, "c1", "eth0"); a == nil || a.IPAM != ipamEmbedded {
+		t.Fatalf("embedded allocator not recorded: %+v", a)
+	}
+
+	// DEL after the plugin got installed still releases from the store
+	cniPath, cleanupIPAM := testIPAM(t, "test-ipam", "10.1.0.9/24", "10.1.0.1")
+	defer cleanupIPAM()
+	args.Path = cniPath
+	if err := setCNIEnv("DEL", args); err != nil {
+		t.Fatal(err)
+	}
+	if err := delAttachment(args, n); err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	files, err := ioutil.ReadDir(ipamStoreDir(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 0 {
+		t.Errorf("embedded reservation %v leaked", files[0].Name())
+	}
+}
+
+// fillPointers sets every nil pointer field of the struct v points to,
+// recursing into the structs it reaches
+func fillPointers(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.Ptr:
+			if f.IsNil() {
+				f.Set(reflect.New(f.Type().Elem()))
+			}
+			switch e := f.Elem(); e.Kind() {
+			case reflect.Struct:
+				fillPointers(e)
+			case reflect.Slice:
+				e.Set(reflect.MakeSlice(e.Type(), 0, 0))
+			}
+		case reflect.Struct:
+			fillPointers(f)
+		}
+	}
+}
+
+// sharedPointer names the first pointer field a and b both point at
+func sharedPointer(a, b reflect.Value, path string) string {
+	for i := 0; i < a.NumField(); i++ {
+		fa, fb := a.Field(i), b.Field(i)
+		name := path + "." + a.Type().Field(i).Name
+		switch fa.Kind() {
+		case reflect.Ptr:
+			if fa.IsNil() || fb.IsNil() {
+				continue
+			}
+			if fa.Pointer() == fb.Pointer() {
+				return name
+			}
+			if fa.Elem().Kind() == reflect.Struct {
+				if s := sharedPointer(fa.Elem(), fb.Elem(), name); s != "" {
+					return s
+				}
+			}
+		case reflect.Struct:
+			if s := sharedPointer(fa, fb, name); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+func TestCloneCopiesPointers(t *testing.T) {
+	n, cleanup := testNetConf(t, testConfig)
+	defer cleanup()
+	fillPointers(reflect.ValueOf(n).Elem())
+
+	c, err := n.clone()
+	if err != nil {
+		t.Fatalf("clone failed: %v", err)
+	}
+	if !reflect.DeepEqual(c, n) {
+		t.Errorf("clone differs from the config:\n%+v\n%+v", c, n)
+	}
+	if s := sharedPointer(reflect.ValueOf(c).Elem(), reflect.ValueOf(n).Elem(), "NetConf"); s != "" {
+		t.Errorf("clone shares %v with the config", s)
+	}
+}
+
+func TestAddRouteMetrics(t *testing.T) {
+	f := newFakeOps()
+	cns := f.NewNS("/var/run/netns/c1")
+	n, cleanup := testNetConf(t, `{
+	"name": "test", "type": "rancher-bridge", "dataDir": %q,
+	"bridge": "br0", "bridgeSubnet": "10.1.0.0/24", "isDefaultGateway": true,
+	"routeMetrics": {"mtu": 1400, "lockMTU": true}
+}`)
+	defer cleanup()
+
+	if _, err := addNetwork(testArgs(n, "c1", cns), n); err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+	want := "0.0.0.0/0 via 10.1.0.1 dev eth0 mtu lock 1400"
+	var found bool
+	for _, spec := range cns.RouteSpecs() {
+		if spec == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("container routes replaced with %v, want %q", cns.RouteSpecs(), want)
+	}
+	if len(f.host.RouteSpecs()) != 0 {
+		t.Errorf("routes replaced on the host: %v", f.host.RouteSpecs())
+	}
+}
@@ -0,0 +1,86 @@
+package bridgecni
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/rancher-cni-bridge/internal/bridge"
+	"github.com/rancher/rancher-cni-bridge/internal/veth"
+)
+
+// removeBridgeIfEmpty deletes the bridge of n, along with radvd and the
+// bridge wide iptables rules, when removeBridgeOnEmpty is set and no
+// container is left on it. The uplink doesn't count as a container.
+// The network lock keeps an ADD from plugging into the bridge between
+// the check and the delete.
+func removeBridgeIfEmpty(n *NetConf) error {
+	if !n.RemoveBridgeOnEmpty {
+		return nil
+	}
+	unlock, err := lockNetwork(n)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	as, err := listAttachments(n)
+	if err != nil {
+		return err
+	}
+	for _, a := range as {
+		if a.Bridge == n.BrName {
+			return nil
+		}
+	}
+	ports, err := bridgePorts(n)
+	if err != nil {
+		// gone already
+		return nil
+	}
+	uplink := uplinkName(n)
+	for _, port := range ports {
+		if port != uplink {
+			return nil
+		}
+	}
+
+	logrus.Infof("rancher-cni-bridge: last container left %v, removing it", n.BrName)
+	if n.SLAAC {
+		stopRadvd(n)
+	}
+	if err = teardownBridgeRules(n); err != nil {
+		return err
+	}
+	if n.Datapath == datapathOVS {
+		_, err = ovsVsctl("--if-exists", "del-br", n.BrName)
+		return err
+	}
+	return veth.Del(ops.Host(), n.BrName)
+}
+
+// bridgePorts lists the names of the interfaces plugged into the bridge
+func bridgePorts(n *NetConf) ([]string, error) {
+	if n.Datapath == datapathOVS {
+		out, err := ovsVsctl("list-ports", n.BrName)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(out), nil
+	}
+
+	return bridge.Ports(n.BrName)
+}
+
+// stopRadvd stops the radvd serving the bridge and removes its files
+func stopRadvd(n *NetConf) {
+	dir := filepath.Join(dataDir(n), n.Name)
+	pidPath := filepath.Join(dir, "radvd-"+n.BrName+".pid")
+	if pid := runningPid(pidPath); pid > 0 {
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+	os.Remove(pidPath)
+	os.Remove(filepath.Join(dir, "radvd-"+n.BrName+".conf"))
+}
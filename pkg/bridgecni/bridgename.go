@@ -0,0 +1,69 @@
+package bridgecni
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+const (
+	// bridgeFromMetadata as bridge name picks the bridge by the Rancher
+	// environment of the container
+	bridgeFromMetadata = "metadata"
+
+	envBridgePrefix = "br-"
+)
+
+// envBridgeName is the bridge of the Rancher environment with the given
+// UUID, short enough for IFNAMSIZ
+func envBridgeName(envUUID string) string {
+	name := envBridgePrefix + strings.Replace(envUUID, "-", "", -1)
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+// resolveBridgeName replaces the "metadata" bridge name of n with the
+// bridge of the environment the container belongs to. Hosts in several
+// environments so keep the containers of each on their own bridge.
+func resolveBridgeName(n *NetConf, nArgs *NetArgs) error {
+	if n.BrName != bridgeFromMetadata {
+		return nil
+	}
+	if nArgs.RancherContainerUUID == "" {
+		return fmt.Errorf("bridge %q needs the RancherContainerUUID arg", bridgeFromMetadata)
+	}
+
+	c, _, err := metadataContainers(n.MetadataURL, string(nArgs.RancherContainerUUID))
+	if err != nil {
+		return fmt.Errorf("failed to resolve bridge: %v", err)
+	}
+	if c.EnvironmentUUID == "" {
+		return fmt.Errorf("failed to resolve bridge: container %v has no environment", c.UUID)
+	}
+	n.BrName = envBridgeName(c.EnvironmentUUID)
+	return nil
+}
+
+// recordedBridgeName points n at the bridge the attachment was made to
+// when the bridge isn't fixed by the config: with a "metadata" bridge,
+// so DEL doesn't depend on metadata, and with a standby bridge
+func recordedBridgeName(n *NetConf, args *skel.CmdArgs) error {
+	if n.BrName != bridgeFromMetadata && n.Standby == nil {
+		return nil
+	}
+	a, err := loadAttachment(n, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	if a == nil || a.Bridge == "" {
+		if n.Standby != nil {
+			return nil
+		}
+		return fmt.Errorf("no recorded bridge of %v as %v", args.ContainerID, args.IfName)
+	}
+	useBridge(n, a.Bridge)
+	return nil
+}
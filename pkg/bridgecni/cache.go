@@ -0,0 +1,112 @@
+package bridgecni
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// cachedResult is an IPAM result kept for re-ADDs of the same
+// containerID and ifName until DEL releases it
+type cachedResult struct {
+	Created time.Time     `json:"created"`
+	Result  *types.Result `json:"result"`
+	// IPAM is the allocator the result came from
+	IPAM string `json:"ipam,omitempty"`
+}
+
+func resultCacheDir(n *NetConf) string {
+	return filepath.Join(dataDir(n), n.Name, "cache")
+}
+
+func resultCachePath(n *NetConf, containerID, ifName string) string {
+	return filepath.Join(resultCacheDir(n), containerID+"-"+ifName+".json")
+}
+
+// loadCachedResult returns the cached IPAM result of the container if it
+// is younger than resultCacheTTL, nil otherwise
+func loadCachedResult(n *NetConf, containerID, ifName string) *cachedResult {
+	if n.ResultCacheTTL <= 0 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(resultCachePath(n, containerID, ifName))
+	if err != nil {
+		return nil
+	}
+	c := &cachedResult{}
+	if err := json.Unmarshal(b, c); err != nil || c.Result == nil {
+		logrus.Debugf("rancher-cni-bridge: ignoring undecodable cached result of %v", containerID)
+		return nil
+	}
+	if time.Since(c.Created) > time.Duration(n.ResultCacheTTL)*time.Second {
+		return nil
+	}
+	return c
+}
+
+// cacheResult keeps the IPAM result of the container, failing to do so
+// only costs an IPAM call on the next ADD
+func cacheResult(n *NetConf, containerID, ifName string, result *types.Result, allocator string) {
+	if n.ResultCacheTTL <= 0 {
+		return
+	}
+	b, err := json.Marshal(&cachedResult{Created: time.Now(), Result: result, IPAM: allocator})
+	if err == nil {
+		err = os.MkdirAll(resultCacheDir(n), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(resultCachePath(n, containerID, ifName), b, 0600)
+	}
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to cache result of %v: %v", containerID, err)
+	}
+}
+
+// invalidateResult drops the cached result of the container, whenever
+// its addresses are released
+func invalidateResult(n *NetConf, containerID, ifName string) {
+	err := os.Remove(resultCachePath(n, containerID, ifName))
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("rancher-cni-bridge: failed to invalidate cached result of %v: %v", containerID, err)
+	}
+}
+
+// runFlushCache implements the flush-cache subcommand, which drops the
+// cached results of a network, or of one container
+func runFlushCache(argv []string) error {
+	flags := flag.NewFlagSet("flush-cache", flag.ContinueOnError)
+	config := flags.String("config", "", "path of the network config file")
+	containerID := flags.String("container-id", "", "only flush the result of this container")
+	ifName := flags.String("ifname", "eth0", "name of the container interface")
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+	if *config == "" {
+		return fmt.Errorf("--config is required")
+	}
+
+	bytes, err := ioutil.ReadFile(*config)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", *config, err)
+	}
+	n, err := loadNetConf(bytes)
+	if err != nil {
+		return err
+	}
+
+	if *containerID != "" {
+		invalidateResult(n, *containerID, *ifName)
+		return nil
+	}
+	if err := os.RemoveAll(resultCacheDir(n)); err != nil {
+		return fmt.Errorf("failed to flush cache: %v", err)
+	}
+	return nil
+}
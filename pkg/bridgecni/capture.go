@@ -0,0 +1,72 @@
+package bridgecni
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultCaptureCount    = 1000
+	defaultCaptureDuration = 30
+	maxCaptureCount        = 100000
+	maxCaptureDuration     = 300
+)
+
+// CaptureConf bounds the packet capture started on the host veth of new
+// containers. Duration is in seconds.
+type CaptureConf struct {
+	Count    int `json:"count"`
+	Duration int `json:"duration"`
+}
+
+// validate fills in the defaults and checks the caps
+func (c *CaptureConf) validate() error {
+	if c.Count == 0 {
+		c.Count = defaultCaptureCount
+	}
+	if c.Duration == 0 {
+		c.Duration = defaultCaptureDuration
+	}
+	if c.Count < 0 || c.Count > maxCaptureCount {
+		return fmt.Errorf("invalid capture count %v, must be between 1 and %v", c.Count, maxCaptureCount)
+	}
+	if c.Duration < 0 || c.Duration > maxCaptureDuration {
+		return fmt.Errorf("invalid capture duration %v, must be between 1 and %v seconds", c.Duration, maxCaptureDuration)
+	}
+	return nil
+}
+
+// startCapture starts tcpdump on the host veth in the background, writing
+// into dataDir. It stops after c.Count packets or c.Duration seconds,
+// whatever comes first, and outlives the plugin. A capture that can't be
+// started never fails the ADD.
+func startCapture(n *NetConf, containerID, hostVethName string, c *CaptureConf) {
+	dir := filepath.Join(dataDir(n), "captures")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to create captures dir: %v", err)
+		return
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%v-%v.pcap", time.Now().UTC().Format("20060102T150405Z"), containerID))
+
+	// with -W 1 tcpdump exits at the first -G rotation
+	cmd := exec.Command("tcpdump", "-i", hostVethName, "-n", "-U",
+		"-c", strconv.Itoa(c.Count),
+		"-G", strconv.Itoa(c.Duration), "-W", "1",
+		"-w", path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to start capture on %v: %v", hostVethName, err)
+		return
+	}
+	// don't leave a zombie behind while the daemon lives on
+	go cmd.Wait()
+
+	logrus.Infof("rancher-cni-bridge: capturing up to %v packets or %vs of %v to %v", c.Count, c.Duration, containerID, path)
+}
@@ -0,0 +1,120 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// cmdCheck compares the live state of the attachment against the result
+// recorded by ADD and fails if anything drifted. With repairOnCheck a
+// host veth that fell off the bridge is plugged back in instead.
+func cmdCheck(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return check(args, n)
+}
+
+// check runs CHECK and audits it
+func check(args *skel.CmdArgs, n *NetConf) error {
+	if err := fixIfName(n, args); err != nil {
+		return err
+	}
+	start := time.Now()
+	a, err := loadAttachment(n, args.ContainerID, args.IfName)
+	if err == nil {
+		err = execCheck(args, n, a)
+	}
+	writeAudit(n, "CHECK", args, a, nil, err, start)
+	return err
+}
+
+func execCheck(args *skel.CmdArgs, n *NetConf, a *attachment) error {
+	if a == nil || a.Result == nil {
+		return fmt.Errorf("no recorded attachment of %v as %v", args.ContainerID, args.IfName)
+	}
+
+	netns, err := ops.OpenNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	ch, err := ops.NSHandle(netns)
+	if err != nil {
+		return err
+	}
+	defer ch.Delete()
+
+	if err := checkContainerInterface(ch, args.IfName, a); err != nil {
+		return err
+	}
+	if err := checkPrevResult(n, a); err != nil {
+		return err
+	}
+	if n.RepairOnCheck {
+		if err := recordedBridgeName(n, args); err != nil {
+			return err
+		}
+		nArgs, err := loadNetArgs(args.Args)
+		if err != nil {
+			return err
+		}
+		return repairHostPort(args, n, nArgs, a)
+	}
+	return checkHostPort(n, a)
+}
+
+// checkContainerInterface verifies the container interface still has the
+// address handed out by ADD
+func checkContainerInterface(ch nlHandle, ifName string, a *attachment) error {
+	link, err := ch.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	if a.Result.IP4 == nil {
+		return nil
+	}
+	addrs, err := ch.AddrList(link, syscall.AF_INET)
+	if err != nil {
+		return fmt.Errorf("could not get list of IP addresses: %v", err)
+	}
+	want := a.Result.IP4.IP.String()
+	for _, addr := range addrs {
+		if addr.IPNet.String() == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is missing address %v", ifName, want)
+}
+
+// checkHostPort verifies the host end of the veth is still plugged into
+// the bridge
+func checkHostPort(n *NetConf, a *attachment) error {
+	if a.HostVeth == "" || n.Datapath == datapathOVS || n.Mode == modeRouted {
+		return nil
+	}
+
+	h := ops.Host()
+	hostVeth, err := h.LinkByName(a.HostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", a.HostVeth, err)
+	}
+	br, err := h.LinkByName(a.Bridge)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", a.Bridge, err)
+	}
+	if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+		return fmt.Errorf("%q is not attached to bridge %q", a.HostVeth, a.Bridge)
+	}
+	if hostVeth.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%q is down", a.HostVeth)
+	}
+	return nil
+}
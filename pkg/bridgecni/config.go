@@ -0,0 +1,700 @@
+package bridgecni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/rancher/rancher-cni-bridge/internal/firewall"
+	"github.com/rancher/rancher-cni-bridge/internal/ipconfig"
+)
+
+// NetArgs holds the args passed to the network plugin
+type NetArgs struct {
+	types.CommonArgs
+	RancherContainerUUID types.UnmarshallableString
+	LinkMTUOverhead      types.UnmarshallableString
+	MACAddress           types.UnmarshallableString
+	IP                   types.UnmarshallableString
+	Isolated             types.UnmarshallableString
+	MirrorTo             types.UnmarshallableString
+	Capture              types.UnmarshallableString
+	NetemLatency         types.UnmarshallableString
+	NetemJitter          types.UnmarshallableString
+	NetemLoss            types.UnmarshallableString
+
+	// passed by the kubelet, they identify the pod sandbox
+	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_NAME               types.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+}
+
+// BPFConf references pinned eBPF programs to attach to the tc hooks of
+// every host veth. Note the hooks are from the host veth's point of view:
+// Ingress sees the traffic sent by the container, Egress what it receives.
+type BPFConf struct {
+	Ingress string `json:"ingress"`
+	Egress  string `json:"egress"`
+}
+
+// NetConf is used to hold the config of the network
+type NetConf struct {
+	types.NetConf
+	BrName          string `json:"bridge"`
+	BrSubnet        string `json:"bridgeSubnet"`
+	BrIP            string `json:"bridgeIP"`
+	BrSubnetV6      string `json:"bridgeSubnetV6"`
+	LogToFile       string `json:"logToFile"`
+	LogToSyslog     bool   `json:"logToSyslog"`
+	LogToJournald   bool   `json:"logToJournald"`
+	AuditLog        string `json:"auditLog"`
+	StatsdAddress   string `json:"statsdAddress"`
+	MetricsPrefix   string `json:"metricsPrefix"`
+	WebhookURL      string `json:"webhookURL"`
+	MetadataURL     string `json:"metadataURL"`
+	ReadinessFile   string `json:"readinessFile"`
+	ResultCacheTTL  int    `json:"resultCacheTTL"`
+	Diagnostics     bool   `json:"diagnosticsOnFailure"`
+	IsDebugLevel    string `json:"isDebugLevel"`
+	IsGW            bool   `json:"isGateway"`
+	IsDefaultGW     bool   `json:"isDefaultGateway"`
+	ForceAddress    bool   `json:"forceAddress"`
+	IPMasq          bool   `json:"ipMasq"`
+	MTU             int    `json:"mtu"`
+	Uplink          string `json:"uplink"`
+	ClampMTU        bool   `json:"clampMTU"`
+	LinkMTUOverhead int    `json:"linkMTUOverhead"`
+	HairpinMode     bool   `json:"hairpinMode"`
+	PromiscMode     bool   `json:"promiscMode"`
+	DaemonSocket    string `json:"daemonSocket"`
+	DataDir         string `json:"dataDir"`
+	Datapath        string `json:"datapath"`
+	AdoptExisting   bool   `json:"adoptExisting"`
+	RepairOnCheck   bool   `json:"repairOnCheck"`
+
+	// RemoveBridgeOnEmpty deletes the bridge, with its addresses and
+	// rules, once the last container left it
+	RemoveBridgeOnEmpty bool `json:"removeBridgeOnEmpty"`
+
+	// Mode is "bridge" (the default), "routed", which skips the bridge
+	// and routes a /32 to every container over its veth, "host-device",
+	// which moves Device (or the NIC at PCIAddress) into the container,
+	// or "sriov", which gives every container a VF of PF on VLAN
+	Mode       string `json:"mode"`
+	Device     string `json:"device"`
+	PCIAddress string `json:"pciAddress"`
+	PF         string `json:"pf"`
+	VLAN       int    `json:"vlan"`
+
+	// SLAAC has the bridge advertise bridgeSubnetV6 (through radvd) so
+	// containers autoconfigure IPv6 addresses, instead of using v6 IPAM
+	SLAAC bool `json:"slaac"`
+
+	DHCPv6PD *DHCPv6PDConf `json:"dhcpv6PD"`
+
+	VRF *VRFConf `json:"vrf"`
+
+	HostRoutes *HostRouteConf `json:"hostRoutes"`
+
+	// BridgeNoIP keeps the host off the container L2 segment: the bridge
+	// gets no address and the host reaches containers through their
+	// hostRoutes, which are turned on with defaults if not configured
+	BridgeNoIP bool `json:"bridgeNoIP"`
+
+	Hooks *HooksConf `json:"hooks"`
+
+	// BGP announcements are made by the daemon only, a plugin running
+	// in-process ignores them
+	BGP *BGPConf `json:"bgp"`
+
+	// DefaultGateways installs an ECMP default route in the container,
+	// balancing over all of them, for active/active upstreams
+	DefaultGateways []string `json:"defaultGateways"`
+
+	// LinkLocalIPv4 gives every container a stable 169.254/16 address
+	// next to the routable one
+	LinkLocalIPv4 bool `json:"linkLocalIPv4"`
+
+	// MetadataRoute routes the Rancher metadata/DNS address
+	// 169.254.169.250 via the bridge in every container, so it stays
+	// reachable when the default route points elsewhere
+	MetadataRoute bool `json:"metadataRoute"`
+
+	// BlackholeRoutes are dropped inside the container, e.g. ranges
+	// containers must never reach
+	BlackholeRoutes []string `json:"blackholeRoutes"`
+
+	// RouteSrc sets the preferred source address of the container
+	// routes: "primary" for the address from IPAM, or a given address
+	// the container has, e.g. a secondary one
+	RouteSrc string `json:"routeSrc"`
+
+	RouteMetrics *RouteMetricsConf `json:"routeMetrics"`
+
+	// DisableContainerRoutes assigns the address but installs no routes
+	// at all in the container, not even those from IPAM, for containers
+	// running their own routing daemons
+	DisableContainerRoutes bool `json:"disableContainerRoutes"`
+
+	// DeviceRoutes are extra subnets reachable directly on the container
+	// interface, installed as scope link routes without a gateway. IPAM
+	// can ask for the same with a route whose gw is 0.0.0.0.
+	DeviceRoutes []string `json:"deviceRoutes"`
+
+	// STP settings of the bridge, timers are in seconds. BrSTP turns
+	// STP on or off, bridges created by the plugin start with it off.
+	// Unset ones leave the kernel default in place.
+	BrSTP          *bool `json:"bridgeSTP"`
+	BrPriority     *int  `json:"bridgePriority"`
+	BrHelloTime    *int  `json:"bridgeHelloTime"`
+	BrMaxAge       *int  `json:"bridgeMaxAge"`
+	BrForwardDelay *int  `json:"bridgeForwardDelay"`
+
+	// BrGroupFwdMask selects which 01:80:C2:00:00:0X link local groups
+	// the bridge forwards instead of dropping, e.g. 0x4000 for LLDP
+	BrGroupFwdMask int `json:"bridgeGroupFwdMask"`
+
+	// Explicitly enable or disable net.bridge.bridge-nf-call-ip(6)tables,
+	// left untouched when unset
+	BridgeNFCallIPTables  *bool `json:"bridgeNFCallIPTables"`
+	BridgeNFCallIP6Tables *bool `json:"bridgeNFCallIP6Tables"`
+
+	// IgnoreRoutesWithLinkdown sets ignore_routes_with_linkdown of the
+	// bridge and host veths, so routes through a link that lost carrier
+	// are skipped instead of blackholing. Left untouched when unset.
+	IgnoreRoutesWithLinkdown *bool `json:"ignoreRoutesWithLinkdown"`
+
+	// Raise net.ipv4.neigh.default.gc_thresh1/2/3 to at least these
+	// values, the defaults are too small for hundreds of containers on
+	// one bridge. Higher host settings are left alone.
+	ARPGCThresh1 int `json:"arpGCThresh1"`
+	ARPGCThresh2 int `json:"arpGCThresh2"`
+	ARPGCThresh3 int `json:"arpGCThresh3"`
+
+	// Isolated sets the bridge port isolation bit on container ports so
+	// they can only talk to the bridge/uplink, not to each other.
+	// Can be overridden per container with the Isolated CNI_ARG.
+	Isolated bool `json:"isolated"`
+
+	// Turn off flooding of unknown unicast/multicast traffic to
+	// container ports
+	DisableUnicastFlood   bool `json:"disableUnicastFlood"`
+	DisableMulticastFlood bool `json:"disableMulticastFlood"`
+
+	// StaticFDB turns off learning and ageing on the bridge, container
+	// MACs are programmed as static fdb entries from the recorded state
+	// and unknown unicast is never flooded to container ports
+	StaticFDB bool `json:"staticFDB"`
+
+	// HostVethPrefix names host veths by a hash of the container ID and
+	// interface, e.g. "veth" gives "veth1a2b3c4d5e6" instead of random
+	// names. RepairIfName shortens a CNI_IFNAME longer than IFNAMSIZ
+	// instead of failing ADD.
+	HostVethPrefix string `json:"hostVethPrefix"`
+	RepairIfName   bool   `json:"repairIfName"`
+
+	VXLAN *VXLANConf `json:"vxlan"`
+
+	// MirrorTo names an interface all traffic of the containers is
+	// copied to. Can be overridden per container with the MirrorTo
+	// CNI_ARG.
+	MirrorTo string `json:"mirrorTo"`
+
+	// LLDP announces every container port on the uplink
+	LLDP *LLDPConf `json:"lldp"`
+
+	// GARP announces the container address with gratuitous ARPs once
+	// it is attached
+	GARP *GARPConf `json:"garp"`
+
+	// Bond creates a bond of physical NICs as the uplink of the bridge
+	Bond *BondConf `json:"bond"`
+
+	// Standby is a second bridge containers fail over to
+	Standby *StandbyConf `json:"standby"`
+
+	// MetadataDNS takes the nameservers and search domains of the
+	// result from rancher-metadata
+	MetadataDNS *MetadataDNSConf `json:"metadataDNS"`
+
+	// Firewall filters the traffic towards each container by the allow
+	// and deny policy in its io.rancher.firewall.* labels
+	Firewall *FirewallConf `json:"firewall"`
+
+	// Capture starts a bounded packet capture on the host veth of every
+	// new container. The Capture CNI_ARG turns it on or off for a
+	// single container.
+	Capture *CaptureConf `json:"capture"`
+
+	// FqCodel replaces the default root qdisc of host veths with fq_codel
+	FqCodel bool `json:"fqCodel"`
+
+	BPF *BPFConf `json:"bpf"`
+
+	// Number of TX/RX queues of both veth ends, and the CPU masks (hex,
+	// as in /sys/class/net/<dev>/queues) for RPS/XPS on the host end
+	NumTxQueues int    `json:"numTxQueues"`
+	NumRxQueues int    `json:"numRxQueues"`
+	RPSCPUs     string `json:"rpsCPUs"`
+	XPSCPUs     string `json:"xpsCPUs"`
+
+	// Offloads tunes the offloads of both ends of the container veth
+	Offloads *OffloadConf `json:"offloads"`
+
+	// EnableDAD turns IPv6 duplicate address detection on the container
+	// interface on or off, left to the host default when unset
+	EnableDAD *bool `json:"enableDad"`
+
+	// IPv6AddrGen is how the container interface makes up the interface
+	// identifier of its link-local and autoconfigured addresses: eui64,
+	// stable-privacy or token. IPv6Token is the identifier in token
+	// mode, derived from the container ID when unset.
+	IPv6AddrGen string `json:"ipv6AddrGen"`
+	IPv6Token   string `json:"ipv6Token"`
+
+	// IPv6 sysctls of the container interface and of the host veth
+	ContainerIPv6 *IPv6SysctlConf `json:"containerIPv6"`
+	HostIPv6      *IPv6SysctlConf `json:"hostIPv6"`
+
+	// HostARP sets arp_ignore/arp_announce of every host veth
+	HostARP *ARPSysctlConf `json:"hostARP"`
+
+	// StormControlPPS caps the broadcast/multicast packets per second
+	// each container can send
+	StormControlPPS int `json:"stormControlPPS"`
+
+	// ARPRateLimitPPS caps the ARP packets per second each container
+	// can send
+	ARPRateLimitPPS int `json:"arpRateLimitPPS"`
+
+	// ClampMSS clamps the TCP MSS of connections forwarded through the
+	// bridge to the path MTU, ClampMSSTo to a fixed number of bytes
+	ClampMSS   bool `json:"clampMSS"`
+	ClampMSSTo int  `json:"clampMSSTo"`
+
+	// ConntrackZone puts the connections of the bridge's containers into
+	// their own conntrack zone (1-65535) in the original direction, so
+	// networks with overlapping subnets on one host don't share entries
+	// while replies from the uplink still find theirs
+	ConntrackZone int `json:"conntrackZone"`
+
+	// DSCP marks the traffic sent by containers with the given code
+	// point (1-63) so QoS policies upstream can prioritize it
+	DSCP int `json:"dscp"`
+
+	// ConnLimit caps the connections each container can have tracked,
+	// so one container can't fill the conntrack table of the host
+	ConnLimit int `json:"connLimit"`
+
+	// Mark sets the skb mark, "value" or "value/mask" (e.g. "0x10/0xff"),
+	// of traffic sent by containers so host policy routing and shaping
+	// can key on it
+	Mark string `json:"mark"`
+
+	// Policing of the traffic sent by the container, rate in bits per
+	// second and burst in bytes
+	IngressRate  int `json:"ingressRate"`
+	IngressBurst int `json:"ingressBurst"`
+
+	// RuntimeConfig holds per container values passed by the runtime,
+	// they take precedence over the network wide settings
+	RuntimeConfig struct {
+		IngressRate  int             `json:"ingressRate"`
+		IngressBurst int             `json:"ingressBurst"`
+		PortMappings []PortMapping   `json:"portMappings"`
+		Netem        *NetemConf      `json:"netem"`
+		Bandwidth    *BandwidthEntry `json:"bandwidth"`
+		// MAC is the mac capability, it takes precedence over
+		// MACAddress in CNI_ARGS
+		MAC string `json:"mac"`
+	} `json:"runtimeConfig"`
+
+	// PrevResult is what the plugins ahead in a conflist returned
+	PrevResult json.RawMessage `json:"prevResult,omitempty"`
+
+	// ValidAttachments is passed to GC, everything else gets cleaned
+	// up. nil means the runtime didn't send the list at all.
+	ValidAttachments *[]GCAttachment `json:"cni.dev/valid-attachments"`
+
+	// the config as loaded, for the IPAM plugin
+	raw []byte
+}
+
+func loadNetConf(raw []byte) (*NetConf, error) {
+	bytes, err := prepareConfig(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &NetConf{
+		BrName: defaultBrName,
+		raw:    raw,
+	}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	// as in the upstream bridge plugin, the default gateway has to be
+	// the bridge
+	if n.IsDefaultGW {
+		n.IsGW = true
+	}
+
+	if err := validateBridgeSTP(n); err != nil {
+		return nil, err
+	}
+
+	if n.BrGroupFwdMask < 0 || n.BrGroupFwdMask > 0xffff {
+		return nil, fmt.Errorf("invalid bridgeGroupFwdMask %#x, must fit in 16 bits", n.BrGroupFwdMask)
+	}
+	if n.BrGroupFwdMask&restrictedGroupFwdMask != 0 {
+		return nil, fmt.Errorf("invalid bridgeGroupFwdMask %#x, the kernel does not allow forwarding STP, pause and bond frames (%#x)", n.BrGroupFwdMask, restrictedGroupFwdMask)
+	}
+
+	if n.HostVethPrefix != "" {
+		if err := validateHostVethPrefix(n.HostVethPrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.StaticFDB && (bridgeName(n) == "" || n.Datapath == datapathOVS || n.AdoptExisting) {
+		return nil, fmt.Errorf("staticFDB needs a linux bridge created by the plugin")
+	}
+
+	// isolation is a linux bridge port flag, a network relying on it
+	// must not come up without
+	if n.Isolated && (bridgeName(n) == "" || n.Datapath == datapathOVS) {
+		return nil, fmt.Errorf("isolated needs a linux bridge")
+	}
+
+	if n.LLDP != nil {
+		if n.LLDP.TTL == 0 {
+			n.LLDP.TTL = defaultLLDPTTL
+		}
+		if n.LLDP.TTL < 4 || n.LLDP.TTL > 65535 {
+			return nil, fmt.Errorf("invalid lldp ttl %v, must be between 4 and 65535", n.LLDP.TTL)
+		}
+		if uplinkName(n) == "" {
+			return nil, fmt.Errorf("lldp needs an uplink")
+		}
+	}
+
+	if n.Bond != nil {
+		if err := n.Bond.validate(); err != nil {
+			return nil, err
+		}
+		if bridgeName(n) == "" || n.BrName == bridgeFromMetadata || n.Datapath == datapathOVS || n.AdoptExisting ||
+			n.Uplink != "" || n.VXLAN != nil || n.Standby != nil {
+			return nil, fmt.Errorf("bond needs a linux bridge created by the plugin and replaces uplink, vxlan and standby")
+		}
+	}
+
+	if n.Standby != nil {
+		if err := validateStandby(n); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.BrName == bridgeFromMetadata && (n.Uplink != "" || n.VXLAN != nil || n.BrSubnet != "" || n.BrIP != "" || n.BrSubnetV6 != "") {
+		return nil, fmt.Errorf("bridge %q doesn't support uplink, vxlan, bridgeSubnet, bridgeIP or bridgeSubnetV6, the bridges of all environments would share them", bridgeFromMetadata)
+	}
+
+	if n.VXLAN != nil && n.VXLAN.Device == "" {
+		return nil, fmt.Errorf("vxlan.device must be specified")
+	}
+
+	if n.IngressRate < 0 || n.IngressBurst < 0 || n.RuntimeConfig.IngressRate < 0 || n.RuntimeConfig.IngressBurst < 0 {
+		return nil, fmt.Errorf("ingressRate and ingressBurst must not be negative")
+	}
+	if n.RuntimeConfig.MAC != "" {
+		if _, err := net.ParseMAC(n.RuntimeConfig.MAC); err != nil {
+			return nil, fmt.Errorf("invalid runtimeConfig mac %q: %v", n.RuntimeConfig.MAC, err)
+		}
+	}
+	if bw := n.RuntimeConfig.Bandwidth; bw != nil && (bw.EgressRate < 0 || bw.EgressBurst < 0) {
+		return nil, fmt.Errorf("bandwidth egressRate and egressBurst must not be negative")
+	}
+
+	for i := range n.RuntimeConfig.PortMappings {
+		if err := n.RuntimeConfig.PortMappings[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.NumTxQueues < 0 || n.NumRxQueues < 0 {
+		return nil, fmt.Errorf("numTxQueues and numRxQueues must not be negative")
+	}
+
+	if n.ARPGCThresh1 < 0 || n.ARPGCThresh2 < 0 || n.ARPGCThresh3 < 0 {
+		return nil, fmt.Errorf("arpGCThresh1/2/3 must not be negative")
+	}
+
+	if n.StormControlPPS < 0 {
+		return nil, fmt.Errorf("stormControlPPS must not be negative")
+	}
+
+	if n.ResultCacheTTL < 0 {
+		return nil, fmt.Errorf("resultCacheTTL must not be negative")
+	}
+
+	if n.ARPRateLimitPPS < 0 {
+		return nil, fmt.Errorf("arpRateLimitPPS must not be negative")
+	}
+
+	if n.ClampMSSTo < 0 || n.ClampMSSTo > 65535 {
+		return nil, fmt.Errorf("invalid clampMSSTo %v, must be between 1 and 65535", n.ClampMSSTo)
+	}
+	if n.ClampMSS && n.ClampMSSTo != 0 {
+		return nil, fmt.Errorf("clampMSS and clampMSSTo are mutually exclusive")
+	}
+
+	if n.DSCP < 0 || n.DSCP > 63 {
+		return nil, fmt.Errorf("invalid dscp %v, must be between 0 and 63", n.DSCP)
+	}
+
+	if n.ConntrackZone < 0 || n.ConntrackZone > 65535 {
+		return nil, fmt.Errorf("invalid conntrackZone %v, must be between 1 and 65535, or 0 for none", n.ConntrackZone)
+	}
+
+	if n.ConnLimit < 0 {
+		return nil, fmt.Errorf("connLimit must not be negative")
+	}
+
+	if n.Mark != "" {
+		if err := firewall.ValidateMark(n.Mark); err != nil {
+			return nil, err
+		}
+	}
+
+	switch n.Datapath {
+	case "", datapathLinux, datapathOVS:
+	default:
+		return nil, fmt.Errorf("unsupported datapath %q", n.Datapath)
+	}
+
+	if n.SLAAC {
+		_, prefix, err := net.ParseCIDR(n.BrSubnetV6)
+		if err != nil || prefix.IP.To4() != nil {
+			return nil, fmt.Errorf("slaac needs an IPv6 bridgeSubnetV6, got %q", n.BrSubnetV6)
+		}
+		if ones, _ := prefix.Mask.Size(); ones != 64 {
+			return nil, fmt.Errorf("slaac needs a /64 bridgeSubnetV6, got %v", prefix)
+		}
+	}
+
+	if n.VLAN < 0 || n.VLAN > 4094 {
+		return nil, fmt.Errorf("invalid vlan %v, must be between 0 and 4094", n.VLAN)
+	}
+
+	if n.DisableContainerRoutes && (n.IsDefaultGW || len(n.DefaultGateways) > 0 || len(n.DeviceRoutes) > 0 ||
+		n.MetadataRoute || len(n.BlackholeRoutes) > 0 || n.RouteMetrics != nil || n.RouteSrc != "") {
+		return nil, fmt.Errorf("disableContainerRoutes excludes isDefaultGateway, defaultGateways, deviceRoutes, metadataRoute, blackholeRoutes, routeMetrics and routeSrc")
+	}
+
+	if n.BridgeNoIP {
+		if bridgeName(n) == "" || n.AdoptExisting || n.IsGW || n.SLAAC || n.MetadataRoute || ipamDisabled(n) {
+			return nil, fmt.Errorf("bridgeNoIP needs a bridge created by the plugin and IPAM, and doesn't support isGateway, slaac or metadataRoute")
+		}
+		if n.HostRoutes == nil {
+			n.HostRoutes = &HostRouteConf{}
+		}
+	}
+
+	if n.HostRoutes != nil {
+		if err := n.HostRoutes.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.WebhookURL != "" {
+		u, err := url.Parse(n.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid webhookURL %q", n.WebhookURL)
+		}
+	}
+
+	if len(n.DefaultGateways) > 0 {
+		if n.IsDefaultGW {
+			return nil, fmt.Errorf("defaultGateways and isDefaultGateway are mutually exclusive")
+		}
+		if err := ipconfig.ValidateDefaultGateways(n.DefaultGateways); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.RouteSrc != "" && n.RouteSrc != ipconfig.RouteSrcPrimary && net.ParseIP(n.RouteSrc) == nil {
+		return nil, fmt.Errorf("invalid routeSrc %q, must be %q or an address", n.RouteSrc, ipconfig.RouteSrcPrimary)
+	}
+
+	if n.RouteMetrics != nil {
+		if err := n.RouteMetrics.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.BGP != nil {
+		if err := n.BGP.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.Hooks != nil {
+		if err := n.Hooks.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.VRF != nil {
+		if n.VRF.Name == "" {
+			return nil, fmt.Errorf("vrf.name must be specified")
+		}
+		if n.VRF.Table <= 0 || (n.VRF.Table >= 253 && n.VRF.Table <= 255) {
+			return nil, fmt.Errorf("invalid vrf.table %v, must be positive and not one of the reserved tables 253-255", n.VRF.Table)
+		}
+	}
+
+	if n.DHCPv6PD != nil {
+		if n.DHCPv6PD.Interface == "" {
+			return nil, fmt.Errorf("dhcpv6PD.interface must be specified")
+		}
+		if n.DHCPv6PD.PrefixLength < 0 || n.DHCPv6PD.PrefixLength > 128 || n.DHCPv6PD.Timeout < 0 {
+			return nil, fmt.Errorf("invalid dhcpv6PD prefixLength %v or timeout %v", n.DHCPv6PD.PrefixLength, n.DHCPv6PD.Timeout)
+		}
+	}
+
+	for _, c := range []*IPv6SysctlConf{n.ContainerIPv6, n.HostIPv6} {
+		if c == nil {
+			continue
+		}
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.IPv6AddrGen != "" || n.IPv6Token != "" {
+		if err := validateIPv6AddrGen(n.IPv6AddrGen, n.IPv6Token); err != nil {
+			return nil, err
+		}
+		// the kernel only takes a token on interfaces accepting RAs
+		if n.IPv6AddrGen == ipv6AddrGenToken && n.ContainerIPv6 != nil && n.ContainerIPv6.AcceptRA != nil && *n.ContainerIPv6.AcceptRA == 0 {
+			return nil, fmt.Errorf("ipv6AddrGen token needs router advertisements, containerIPv6 has acceptRA 0")
+		}
+	}
+
+	if n.HostARP != nil {
+		if err := n.HostARP.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range n.DeviceRoutes {
+		if _, _, err := net.ParseCIDR(r); err != nil {
+			return nil, fmt.Errorf("invalid deviceRoutes entry %q: %v", r, err)
+		}
+	}
+
+	for _, r := range n.BlackholeRoutes {
+		if _, _, err := net.ParseCIDR(r); err != nil {
+			return nil, fmt.Errorf("invalid blackholeRoutes entry %q: %v", r, err)
+		}
+	}
+
+	switch n.Mode {
+	case "", modeBridge:
+	case modeRouted:
+		if n.Datapath == datapathOVS || n.AdoptExisting || n.IsGW || n.IsDefaultGW || n.VXLAN != nil || n.SLAAC ||
+			n.DHCPv6PD != nil || n.VRF != nil || n.HostRoutes != nil || mssClamp(n) != "" || n.ConntrackZone != 0 || ipamDisabled(n) {
+			return nil, fmt.Errorf("%v mode needs IPAM and doesn't support the ovs datapath, adoptExisting, isGateway, isDefaultGateway, vxlan, slaac, dhcpv6PD, vrf, hostRoutes, clampMSS or conntrackZone", modeRouted)
+		}
+	case modeHostDevice, modeSRIOV:
+		if n.Mode == modeHostDevice && (n.Device == "") == (n.PCIAddress == "") {
+			return nil, fmt.Errorf("%v mode needs exactly one of device and pciAddress", modeHostDevice)
+		}
+		if n.Mode == modeSRIOV && n.PF == "" {
+			return nil, fmt.Errorf("%v mode needs a pf", modeSRIOV)
+		}
+		if n.Datapath == datapathOVS || n.AdoptExisting || n.IsGW || n.IsDefaultGW || n.VXLAN != nil || n.SLAAC ||
+			n.DHCPv6PD != nil || n.VRF != nil || n.HostRoutes != nil || mssClamp(n) != "" || n.ConntrackZone != 0 || n.IPMasq || len(n.RuntimeConfig.PortMappings) > 0 || n.MetadataRoute {
+			return nil, fmt.Errorf("%v mode doesn't support the ovs datapath, adoptExisting, isGateway, isDefaultGateway, vxlan, slaac, dhcpv6PD, vrf, hostRoutes, clampMSS, conntrackZone, ipMasq, portMappings or metadataRoute", n.Mode)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported mode %q", n.Mode)
+	}
+
+	if n.Capture != nil {
+		if err := n.Capture.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.GARP != nil {
+		if err := n.GARP.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.MirrorTo != "" && (n.Mode == modeHostDevice || n.Mode == modeSRIOV) {
+		return nil, fmt.Errorf("mirrorTo needs a veth, not supported in %v mode", n.Mode)
+	}
+
+	if n.Firewall != nil {
+		if n.Datapath == datapathOVS {
+			return nil, fmt.Errorf("firewall needs a linux bridge or routed mode, OVS traffic bypasses iptables")
+		}
+		// bridged traffic only sees FORWARD with br_netfilter
+		if bridgeName(n) != "" {
+			if n.BridgeNFCallIPTables != nil && !*n.BridgeNFCallIPTables {
+				return nil, fmt.Errorf("firewall needs bridgeNFCallIPTables on a bridge")
+			}
+			on := true
+			n.BridgeNFCallIPTables = &on
+		}
+	}
+
+	if n.RemoveBridgeOnEmpty && (bridgeName(n) == "" || n.AdoptExisting) {
+		return nil, fmt.Errorf("removeBridgeOnEmpty needs a bridge created by the plugin")
+	}
+
+	if _, err := l2Reflection(n); err != nil {
+		return nil, err
+	}
+
+	if ipamDisabled(n) {
+		if n.IsGW || n.IsDefaultGW || len(n.DefaultGateways) > 0 || n.IPMasq || n.DSCP != 0 || n.Mark != "" || n.ConnLimit != 0 || len(n.RuntimeConfig.PortMappings) > 0 || len(n.DeviceRoutes) > 0 || n.DHCPv6PD != nil || n.HostRoutes != nil || n.MetadataRoute || n.Firewall != nil {
+			return nil, fmt.Errorf("isGateway, isDefaultGateway, defaultGateways, ipMasq, dscp, mark, connLimit, portMappings, deviceRoutes, dhcpv6PD, hostRoutes, metadataRoute and firewall need an IPAM plugin")
+		}
+	}
+	return n, nil
+}
+
+func loadNetArgs(args string) (*NetArgs, error) {
+	nArgs := &NetArgs{}
+	if err := types.LoadArgs(args, nArgs); err != nil {
+		return nil, fmt.Errorf("failed to parse args %s: %v", args, err)
+	}
+
+	return nArgs, nil
+}
+
+// applyRuntimeMAC hands the MAC from runtimeConfig on as if it had come
+// in CNI_ARGS, overriding MACAddress
+func applyRuntimeMAC(n *NetConf, nArgs *NetArgs) {
+	if n.RuntimeConfig.MAC != "" {
+		nArgs.MACAddress = types.UnmarshallableString(n.RuntimeConfig.MAC)
+	}
+}
+
+// boolArg parses a boolean CNI_ARG, returning def when it wasn't passed
+func boolArg(name string, arg types.UnmarshallableString, def bool) (bool, error) {
+	if arg == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(string(arg))
+	if err != nil {
+		return def, fmt.Errorf("invalid value %q for %v: %v", arg, name, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,165 @@
+package bridgecni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// BandwidthEntry is the bandwidth capability of a conflist, rates in
+// bits per second and bursts in bits. Only the egress side, what the
+// container sends, maps onto the policing of the host veth.
+type BandwidthEntry struct {
+	IngressRate  int `json:"ingressRate"`
+	IngressBurst int `json:"ingressBurst"`
+	EgressRate   int `json:"egressRate"`
+	EgressBurst  int `json:"egressBurst"`
+}
+
+// listResult is the 0.3.x shape of a result, which plugins of a conflist
+// hand each other as prevResult
+type listResult struct {
+	CNIVersion string           `json:"cniVersion"`
+	Interfaces []*listInterface `json:"interfaces,omitempty"`
+	IPs        []*listIPConfig  `json:"ips,omitempty"`
+	Routes     []*listRoute     `json:"routes,omitempty"`
+	DNS        types.DNS        `json:"dns,omitempty"`
+}
+
+type listInterface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type listIPConfig struct {
+	Version   string      `json:"version,omitempty"`
+	Interface *int        `json:"interface,omitempty"`
+	Address   types.IPNet `json:"address"`
+	Gateway   net.IP      `json:"gateway,omitempty"`
+}
+
+type listRoute struct {
+	Dst types.IPNet `json:"dst"`
+	GW  net.IP      `json:"gw,omitempty"`
+}
+
+// listVersion reports whether the config is of a spec version with
+// conflists, whose results are 0.3.x shaped
+func listVersion(n *NetConf) bool {
+	return versionAtLeast(n.CNIVersion, "0.3.0")
+}
+
+// prevResult decodes the result of the plugins ahead in the conflist,
+// nil when the plugin runs first or on its own
+func prevResult(n *NetConf) (*listResult, error) {
+	if len(n.PrevResult) == 0 || !listVersion(n) {
+		return nil, nil
+	}
+	prev := &listResult{}
+	if err := json.Unmarshal(n.PrevResult, prev); err != nil {
+		return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+	}
+	return prev, nil
+}
+
+// printResult writes the result of ADD in the shape the config's spec
+// version asks for. In a conflist that is what the plugins ahead
+// returned with the bridge, host veth and container interface appended,
+// so the plugins after it see the whole picture.
+func printResult(args *skel.CmdArgs, n *NetConf, result *types.Result) error {
+	if !listVersion(n) {
+		return result.Print()
+	}
+
+	out, err := prevResult(n)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		out = &listResult{}
+	}
+	out.CNIVersion = n.CNIVersion
+
+	a, err := loadAttachment(n, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	if a != nil {
+		if a.Bridge != "" {
+			out.Interfaces = append(out.Interfaces, &listInterface{Name: a.Bridge, Mac: hostMAC(a.Bridge)})
+		}
+		if a.HostVeth != "" {
+			out.Interfaces = append(out.Interfaces, &listInterface{Name: a.HostVeth, Mac: hostMAC(a.HostVeth)})
+		}
+	}
+	container := &listInterface{Name: args.IfName, Sandbox: args.Netns}
+	if a != nil {
+		container.Mac = a.MAC
+	}
+	out.Interfaces = append(out.Interfaces, container)
+	idx := len(out.Interfaces) - 1
+
+	for _, c := range []struct {
+		version string
+		ipc     *types.IPConfig
+	}{{"4", result.IP4}, {"6", result.IP6}} {
+		if c.ipc == nil {
+			continue
+		}
+		ipc := &listIPConfig{
+			Interface: &idx,
+			Address:   types.IPNet(c.ipc.IP),
+			Gateway:   c.ipc.Gateway,
+		}
+		// 1.0.0 dropped the version, it's implied by the address
+		if !versionAtLeast(n.CNIVersion, "1.0.0") {
+			ipc.Version = c.version
+		}
+		out.IPs = append(out.IPs, ipc)
+		for _, r := range c.ipc.Routes {
+			out.Routes = append(out.Routes, &listRoute{Dst: types.IPNet(r.Dst), GW: r.GW})
+		}
+	}
+
+	if len(result.DNS.Nameservers) > 0 || result.DNS.Domain != "" || len(result.DNS.Search) > 0 || len(result.DNS.Options) > 0 {
+		out.DNS = result.DNS
+	}
+
+	b, err := json.MarshalIndent(out, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+// hostMAC returns the MAC address of the host interface, empty if it
+// can't be looked up
+func hostMAC(name string) string {
+	link, err := ops.Host().LinkByName(name)
+	if err != nil {
+		return ""
+	}
+	return link.Attrs().HardwareAddr.String()
+}
+
+// checkPrevResult verifies the result CHECK is handed by the runtime
+// still lists the address the attachment was given
+func checkPrevResult(n *NetConf, a *attachment) error {
+	prev, err := prevResult(n)
+	if err != nil || prev == nil || a.Result.IP4 == nil {
+		return err
+	}
+	want := a.Result.IP4.IP.String()
+	for _, ipc := range prev.IPs {
+		if addr := net.IPNet(ipc.Address); addr.String() == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("prevResult doesn't list address %v of %v", want, a.ContainerID)
+}
@@ -0,0 +1,281 @@
+package bridgecni
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const (
+	defaultDaemonSocket = "/var/run/rancher-cni-bridge.sock"
+	daemonDialTimeout   = 2 * time.Second
+
+	// how long a client gets to send its request and to take the
+	// response, so a stalled one doesn't hold on to its connection
+	daemonIOTimeout = 10 * time.Second
+)
+
+// errDaemonUnavailable is returned by the shim when nothing is listening
+// on the configured socket, in which case the plugin runs in-process.
+var errDaemonUnavailable = errors.New("daemon unavailable")
+
+// daemonRequest is what the shim sends to the daemon for one invocation
+type daemonRequest struct {
+	Command     string `json:"command"`
+	ContainerID string `json:"containerID"`
+	Netns       string `json:"netns"`
+	IfName      string `json:"ifName"`
+	Args        string `json:"args"`
+	Path        string `json:"path"`
+	StdinData   []byte `json:"stdinData"`
+}
+
+// daemonResponse carries either the ADD result or the error back to the shim
+type daemonResponse struct {
+	Result *types.Result `json:"result,omitempty"`
+	Error  *types.Error  `json:"error,omitempty"`
+}
+
+func daemonAdd(socket string, args *skel.CmdArgs) (*types.Result, error) {
+	resp, err := daemonCall(socket, "ADD", args)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Result == nil {
+		return nil, fmt.Errorf("daemon returned an empty result")
+	}
+	return resp.Result, nil
+}
+
+func daemonDel(socket string, args *skel.CmdArgs) error {
+	_, err := daemonCall(socket, "DEL", args)
+	return err
+}
+
+func daemonCall(socket, command string, args *skel.CmdArgs) (*daemonResponse, error) {
+	conn, err := net.DialTimeout("unix", socket, daemonDialTimeout)
+	if err != nil {
+		return nil, errDaemonUnavailable
+	}
+	defer conn.Close()
+
+	// the daemon opens a netns fd of ours through /proc, which works
+	// since we wait for its answer
+	req := &daemonRequest{
+		Command:     command,
+		ContainerID: args.ContainerID,
+		Netns:       netnsForPid(args.Netns, os.Getpid()),
+		IfName:      args.IfName,
+		Args:        args.Args,
+		Path:        args.Path,
+		StdinData:   args.StdinData,
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request to daemon: %v", err)
+	}
+
+	resp := &daemonResponse{}
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, fmt.Errorf("failed to read response from daemon: %v", err)
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp, nil
+}
+
+// runDaemon listens on a Unix socket and serves ADD/DEL requests
+// forwarded by the shim. Connections are served concurrently, but the
+// requests are handled one at a time on the main (locked) OS thread,
+// since the delegated IPAM plugin picks up its CNI_* variables from our
+// environment.
+func runDaemon(argv []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	socket := flags.String("socket", defaultDaemonSocket, "path of the Unix socket to listen on")
+	debug := flags.Bool("debug", false, "enable debug logging")
+	watch := flags.Bool("watch-bridges", true, "recreate bridges deleted underneath the daemon")
+	probe := flags.Int("probe-interval", defaultProbeInterval, "seconds between uplink probes of networks with a standby bridge")
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+
+	if *debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	if err := os.Remove(*socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %v: %v", *socket, err)
+	}
+
+	// the socket is created with the umask, so it must not be reachable
+	// by others before the chmod below
+	oldMask := syscall.Umask(0077)
+	l, err := net.Listen("unix", *socket)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %v", *socket, err)
+	}
+	defer l.Close()
+
+	if err := os.Chmod(*socket, 0600); err != nil {
+		return fmt.Errorf("failed to set permissions on %v: %v", *socket, err)
+	}
+
+	w := newBridgeWatcher(&sync.Mutex{})
+	go w.probeUplinks(time.Duration(*probe) * time.Second)
+	go w.reannounceLLDP()
+	if *watch {
+		go func() {
+			if err := w.run(); err != nil {
+				logrus.Errorf("rancher-cni-bridge: failed to watch bridges: %v", err)
+			}
+		}()
+	}
+
+	logrus.Infof("rancher-cni-bridge: daemon listening on %v", *socket)
+	jobs := make(chan *daemonJob)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				logrus.Errorf("rancher-cni-bridge: %v", err)
+				close(jobs)
+				return
+			}
+			go serveDaemonConn(conn, jobs)
+		}
+	}()
+
+	for job := range jobs {
+		w.mu.Lock()
+		result, err := handleDaemonRequest(job.req, w)
+		w.mu.Unlock()
+		job.done <- daemonResult(result, err)
+	}
+	return fmt.Errorf("stopped accepting connections on %v", *socket)
+}
+
+// daemonJob is a request read off a connection, waiting for the main
+// thread to handle it
+type daemonJob struct {
+	req  *daemonRequest
+	done chan *daemonResponse
+}
+
+// serveDaemonConn reads the request off conn, has it handled and writes
+// the response back. Connections are served concurrently, only the
+// requests themselves are handled one at a time.
+func serveDaemonConn(conn net.Conn, jobs chan<- *daemonJob) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(daemonIOTimeout))
+	req := &daemonRequest{}
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to decode daemon request: %v", err)
+		return
+	}
+
+	job := &daemonJob{req: req, done: make(chan *daemonResponse, 1)}
+	jobs <- job
+	resp := <-job.done
+
+	conn.SetDeadline(time.Now().Add(daemonIOTimeout))
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to write daemon response: %v", err)
+	}
+}
+
+// daemonResult turns the outcome of a request into its response
+func daemonResult(result *types.Result, err error) *daemonResponse {
+	if err == nil {
+		return &daemonResponse{Result: result}
+	}
+	if e, ok := err.(*types.Error); ok {
+		return &daemonResponse{Error: e}
+	}
+	return &daemonResponse{Error: &types.Error{Code: 100, Msg: err.Error()}}
+}
+
+func handleDaemonRequest(req *daemonRequest, w *bridgeWatcher) (result *types.Result, err error) {
+	// a panic in one request must not take the daemon down
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, recoverError(req.Command, r)
+		}
+	}()
+
+	args := &skel.CmdArgs{
+		ContainerID: req.ContainerID,
+		Netns:       req.Netns,
+		IfName:      req.IfName,
+		Args:        req.Args,
+		Path:        req.Path,
+		StdinData:   req.StdinData,
+	}
+
+	if err := setCNIEnv(req.Command, args); err != nil {
+		return nil, err
+	}
+
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Command {
+	case "ADD":
+		result, err := addNetwork(args, n)
+		if err == nil {
+			w.remember(n)
+			if n.BGP != nil && result.IP4 != nil {
+				bgpAfterAdd(n, &result.IP4.IP)
+			}
+		}
+		return result, err
+	case "DEL":
+		// the address is forgotten by DEL
+		var ipn *net.IPNet
+		if n.BGP != nil {
+			if a, _ := loadAttachment(n, args.ContainerID, args.IfName); a != nil && a.Result != nil && a.Result.IP4 != nil {
+				ipn = &a.Result.IP4.IP
+			}
+		}
+		err := delNetwork(args, n)
+		if err == nil && ipn != nil {
+			bgpAfterDel(n, ipn)
+		}
+		return nil, err
+	default:
+		return nil, fmt.Errorf("unknown command: %v", req.Command)
+	}
+}
+
+// setCNIEnv sets the CNI_* variables for a command the plugin runs on
+// its own behalf, the delegated IPAM plugin inherits them from our
+// environment
+func setCNIEnv(command string, args *skel.CmdArgs) error {
+	env := map[string]string{
+		"CNI_COMMAND":     command,
+		"CNI_CONTAINERID": args.ContainerID,
+		"CNI_NETNS":       args.Netns,
+		"CNI_IFNAME":      args.IfName,
+		"CNI_ARGS":        args.Args,
+		"CNI_PATH":        args.Path,
+	}
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			return fmt.Errorf("failed to set %v: %v", k, err)
+		}
+	}
+	return nil
+}
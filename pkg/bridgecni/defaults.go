@@ -0,0 +1,74 @@
+package bridgecni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	defaultDefaultsFile = "/etc/rancher/cni-bridge-defaults.json"
+
+	// defaultsFileEnv points at another defaults file
+	defaultsFileEnv = "RANCHER_CNI_BRIDGE_DEFAULTS"
+)
+
+// prepareConfig turns the config handed to the plugin into the one it
+// works with: host defaults merged in and variables expanded
+func prepareConfig(conf []byte) ([]byte, error) {
+	conf, err := mergeDefaults(conf)
+	if err != nil {
+		return nil, err
+	}
+	return expandConfig(conf)
+}
+
+// mergeDefaults merges the host defaults file, if there is one, under
+// conf: whatever conf sets wins, objects are merged key by key
+func mergeDefaults(conf []byte) ([]byte, error) {
+	path := os.Getenv(defaultsFileEnv)
+	if path == "" {
+		path = defaultDefaultsFile
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return conf, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read defaults: %v", err)
+	}
+
+	var defaults, v map[string]interface{}
+	if err := decodeJSON(b, &defaults); err != nil {
+		return nil, fmt.Errorf("failed to load defaults %v: %v", path, err)
+	}
+	if err := decodeJSON(conf, &v); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	return json.Marshal(mergeJSON(defaults, v))
+}
+
+func mergeJSON(defaults, v map[string]interface{}) map[string]interface{} {
+	for k, d := range defaults {
+		cur, ok := v[k]
+		if !ok {
+			v[k] = d
+			continue
+		}
+		dm, dok := d.(map[string]interface{})
+		cm, cok := cur.(map[string]interface{})
+		if dok && cok {
+			v[k] = mergeJSON(dm, cm)
+		}
+	}
+	return v
+}
+
+// decodeJSON decodes keeping numbers as they are
+func decodeJSON(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
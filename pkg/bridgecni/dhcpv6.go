@@ -0,0 +1,402 @@
+package bridgecni
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+// DHCPv6 message types and options (RFC 8415) needed for prefix delegation
+const (
+	dhcp6Solicit   = 1
+	dhcp6Advertise = 2
+	dhcp6Request   = 3
+	dhcp6Reply     = 7
+	dhcp6Release   = 8
+
+	dhcp6OptClientID    = 1
+	dhcp6OptServerID    = 2
+	dhcp6OptElapsedTime = 8
+	dhcp6OptStatusCode  = 13
+	dhcp6OptIAPD        = 25
+	dhcp6OptIAPrefix    = 26
+
+	dhcp6ClientPort = 546
+	dhcp6ServerPort = 547
+
+	defaultDHCPv6Timeout = 5
+)
+
+var dhcp6AllServers = net.ParseIP("ff02::1:2")
+
+// DHCPv6PDConf has every container get its own IPv6 prefix delegated by
+// the DHCPv6 server reachable on Interface. The container uses the first
+// address of the prefix and the whole prefix is routed to it.
+//
+// Leases are not renewed, so the server has to hand out lifetimes that
+// outlast the containers.
+type DHCPv6PDConf struct {
+	Interface    string `json:"interface"`
+	PrefixLength int    `json:"prefixLength"`
+	Timeout      int    `json:"timeout"`
+}
+
+// dhcpv6Lease is the delegation kept on disk for DEL
+type dhcpv6Lease struct {
+	Prefix   string `json:"prefix"`
+	IAID     uint32 `json:"iaid"`
+	ServerID []byte `json:"serverID"`
+	IAPD     []byte `json:"iaPD"`
+}
+
+func dhcpv6LeasePath(n *NetConf, containerID, ifName string) string {
+	return filepath.Join(dataDir(n), n.Name, "dhcpv6", containerID+"-"+ifName+".json")
+}
+
+// requestDelegatedPrefix gets a prefix for the container, routes it
+// through the bridge and adds the matching IPv6 config to result
+func requestDelegatedPrefix(n *NetConf, containerID, ifName string, result *types.Result) error {
+	c, err := newDHCPv6Client(n)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	iaid := dhcpv6IAID(containerID, ifName)
+	adv, err := c.exchange(dhcp6Solicit, dhcp6Advertise, c.iaPD(iaid))
+	if err != nil {
+		return fmt.Errorf("DHCPv6 solicit failed: %v", err)
+	}
+	serverID, iaPD, err := leaseOptions(adv)
+	if err != nil {
+		return err
+	}
+
+	reply, err := c.exchange(dhcp6Request, dhcp6Reply, dhcp6Opt(dhcp6OptServerID, serverID), dhcp6Opt(dhcp6OptIAPD, iaPD))
+	if err != nil {
+		return fmt.Errorf("DHCPv6 request failed: %v", err)
+	}
+	if _, iaPD, err = leaseOptions(reply); err != nil {
+		return err
+	}
+	prefix, err := delegatedPrefix(iaPD)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("rancher-cni-bridge: delegated %v to %v", prefix, containerID)
+
+	lease := &dhcpv6Lease{Prefix: prefix.String(), IAID: iaid, ServerID: serverID, IAPD: iaPD}
+	if err = saveDHCPv6Lease(dhcpv6LeasePath(n, containerID, ifName), lease); err != nil {
+		return err
+	}
+
+	addr := delegatedAddress(prefix)
+	if err = addDelegatedRoutes(n.BrName, prefix, addr.IP); err != nil {
+		return err
+	}
+
+	_, defaultNet, _ := net.ParseCIDR("::/0")
+	result.IP6 = &types.IPConfig{
+		IP:     *addr,
+		Routes: []types.Route{{Dst: *defaultNet}},
+	}
+	return nil
+}
+
+// releaseDelegatedPrefix gives back the prefix of the container and
+// removes its routes. The release message is best effort, the server
+// reclaims the prefix when it expires anyway.
+func releaseDelegatedPrefix(n *NetConf, containerID, ifName string) error {
+	path := dhcpv6LeasePath(n, containerID, ifName)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read DHCPv6 lease: %v", err)
+	}
+	lease := &dhcpv6Lease{}
+	if err = json.Unmarshal(b, lease); err != nil {
+		return fmt.Errorf("failed to decode DHCPv6 lease: %v", err)
+	}
+
+	if _, prefix, err := net.ParseCIDR(lease.Prefix); err == nil {
+		delDelegatedRoutes(n.BrName, prefix, delegatedAddress(prefix).IP)
+	}
+
+	if c, err := newDHCPv6Client(n); err != nil {
+		logrus.Errorf("rancher-cni-bridge: not releasing %v: %v", lease.Prefix, err)
+	} else {
+		if _, err := c.exchange(dhcp6Release, dhcp6Reply, dhcp6Opt(dhcp6OptServerID, lease.ServerID), dhcp6Opt(dhcp6OptIAPD, lease.IAPD)); err != nil {
+			logrus.Errorf("rancher-cni-bridge: failed to release %v: %v", lease.Prefix, err)
+		}
+		c.close()
+	}
+
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove DHCPv6 lease: %v", err)
+	}
+	return nil
+}
+
+func saveDHCPv6Lease(path string, lease *dhcpv6Lease) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %v: %v", filepath.Dir(path), err)
+	}
+	b, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, b, 0600); err != nil {
+		return fmt.Errorf("failed to record DHCPv6 lease: %v", err)
+	}
+	return nil
+}
+
+// delegatedAddress is the address the container uses out of its prefix
+func delegatedAddress(prefix *net.IPNet) *net.IPNet {
+	addr := make(net.IP, net.IPv6len)
+	copy(addr, prefix.IP.To16())
+	addr[net.IPv6len-1] |= 1
+	return &net.IPNet{IP: addr, Mask: net.CIDRMask(128, 128)}
+}
+
+// addDelegatedRoutes routes the container address onto the bridge and
+// the rest of the prefix through it
+func addDelegatedRoutes(brName string, prefix *net.IPNet, addr net.IP) error {
+	h := ops.Host()
+	br, err := h.LinkByName(brName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", brName, err)
+	}
+
+	routes := []*netlink.Route{
+		{LinkIndex: br.Attrs().Index, Dst: &net.IPNet{IP: addr, Mask: net.CIDRMask(128, 128)}, Scope: netlink.SCOPE_LINK},
+		{LinkIndex: br.Attrs().Index, Dst: prefix, Gw: addr},
+	}
+	for _, r := range routes {
+		if err := h.RouteAdd(r); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to add route to %v: %v", r.Dst, err)
+		}
+	}
+	return nil
+}
+
+func delDelegatedRoutes(brName string, prefix *net.IPNet, addr net.IP) {
+	h := ops.Host()
+	br, err := h.LinkByName(brName)
+	if err != nil {
+		return
+	}
+	for _, dst := range []*net.IPNet{prefix, {IP: addr, Mask: net.CIDRMask(128, 128)}} {
+		if err := h.RouteDel(&netlink.Route{LinkIndex: br.Attrs().Index, Dst: dst}); err != nil {
+			logrus.Debugf("rancher-cni-bridge: failed to remove route to %v: %v", dst, err)
+		}
+	}
+}
+
+func dhcpv6IAID(containerID, ifName string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(containerID + "-" + ifName))
+	return h.Sum32()
+}
+
+type dhcpv6Client struct {
+	conf  *DHCPv6PDConf
+	conn  *net.UDPConn
+	lock  *os.File
+	duid  []byte
+	start time.Time
+}
+
+// newDHCPv6Client binds the client port on the uplink. Only one client
+// can hold the port, so concurrent ADD/DEL are serialized on a lock file.
+func newDHCPv6Client(n *NetConf) (*dhcpv6Client, error) {
+	iface, err := net.InterfaceByName(n.DHCPv6PD.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", n.DHCPv6PD.Interface, err)
+	}
+	if len(iface.HardwareAddr) == 0 {
+		return nil, fmt.Errorf("%q has no hardware address to build a DUID from", iface.Name)
+	}
+
+	lockPath := filepath.Join(dataDir(n), "dhcpv6.lock")
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(lockPath, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %v", lockPath, err)
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock %v: %v", lockPath, err)
+	}
+
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: dhcp6ClientPort, Zone: iface.Name})
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to open DHCPv6 client socket: %v", err)
+	}
+
+	// DUID-LL of the uplink, so the server sees the same client on
+	// every run
+	duid := []byte{0, 3, 0, 1}
+	duid = append(duid, iface.HardwareAddr...)
+
+	return &dhcpv6Client{conf: n.DHCPv6PD, conn: conn, lock: lock, duid: duid, start: time.Now()}, nil
+}
+
+func (c *dhcpv6Client) close() {
+	c.conn.Close()
+	c.lock.Close()
+}
+
+// iaPD builds an IA_PD option asking for a prefix of the configured
+// length
+func (c *dhcpv6Client) iaPD(iaid uint32) []byte {
+	iaPrefix := make([]byte, 25)
+	iaPrefix[8] = byte(c.conf.PrefixLength)
+
+	body := make([]byte, 12)
+	binary.BigEndian.PutUint32(body, iaid)
+	return dhcp6Opt(dhcp6OptIAPD, append(body, dhcp6Opt(dhcp6OptIAPrefix, iaPrefix)...))
+}
+
+// exchange sends a message of msgType with the client id, elapsed time
+// and opts, and waits for the answer of wantType, retransmitting a few
+// times within the configured timeout
+func (c *dhcpv6Client) exchange(msgType, wantType byte, opts ...[]byte) ([]byte, error) {
+	xid := make([]byte, 3)
+	if _, err := rand.Read(xid); err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(c.conf.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = defaultDHCPv6Timeout * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	dst := &net.UDPAddr{IP: dhcp6AllServers, Port: dhcp6ServerPort, Zone: c.conf.Interface}
+
+	buf := make([]byte, 1500)
+	for attempt := 0; time.Now().Before(deadline); attempt++ {
+		elapsed := make([]byte, 2)
+		binary.BigEndian.PutUint16(elapsed, uint16(time.Since(c.start)/(10*time.Millisecond)))
+
+		msg := append([]byte{msgType}, xid...)
+		msg = append(msg, dhcp6Opt(dhcp6OptClientID, c.duid)...)
+		msg = append(msg, dhcp6Opt(dhcp6OptElapsedTime, elapsed)...)
+		for _, o := range opts {
+			msg = append(msg, o...)
+		}
+		if _, err := c.conn.WriteToUDP(msg, dst); err != nil {
+			return nil, err
+		}
+
+		wait := time.Now().Add(time.Second << uint(attempt))
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		c.conn.SetReadDeadline(wait)
+		for {
+			nr, _, err := c.conn.ReadFromUDP(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if nr < 4 || buf[0] != wantType || !bytes.Equal(buf[1:4], xid) {
+				continue
+			}
+			return append([]byte(nil), buf[4:nr]...), nil
+		}
+	}
+	return nil, errors.New("no answer from a DHCPv6 server")
+}
+
+func dhcp6Opt(code uint16, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint16(b, code)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(data)))
+	return append(b, data...)
+}
+
+// dhcp6Opts splits a list of options into code and body
+func dhcp6Opts(b []byte) (map[uint16][]byte, error) {
+	opts := map[uint16][]byte{}
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("truncated DHCPv6 option")
+		}
+		code, l := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+l {
+			return nil, errors.New("truncated DHCPv6 option")
+		}
+		if _, ok := opts[code]; !ok {
+			opts[code] = b[4 : 4+l]
+		}
+		b = b[4+l:]
+	}
+	return opts, nil
+}
+
+// dhcp6Status returns the error of a status code option, if any
+func dhcp6Status(opts map[uint16][]byte) error {
+	s, ok := opts[dhcp6OptStatusCode]
+	if !ok || len(s) < 2 || binary.BigEndian.Uint16(s) == 0 {
+		return nil
+	}
+	return fmt.Errorf("DHCPv6 server refused: status %d %s", binary.BigEndian.Uint16(s), s[2:])
+}
+
+// leaseOptions returns the server id and the IA_PD body of an
+// advertise/reply
+func leaseOptions(msg []byte) ([]byte, []byte, error) {
+	opts, err := dhcp6Opts(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = dhcp6Status(opts); err != nil {
+		return nil, nil, err
+	}
+	serverID, iaPD := opts[dhcp6OptServerID], opts[dhcp6OptIAPD]
+	if serverID == nil || len(iaPD) < 12 {
+		return nil, nil, errors.New("DHCPv6 server did not delegate a prefix")
+	}
+	return serverID, iaPD, nil
+}
+
+// delegatedPrefix extracts the prefix from an IA_PD body
+func delegatedPrefix(iaPD []byte) (*net.IPNet, error) {
+	opts, err := dhcp6Opts(iaPD[12:])
+	if err != nil {
+		return nil, err
+	}
+	if err = dhcp6Status(opts); err != nil {
+		return nil, err
+	}
+	p := opts[dhcp6OptIAPrefix]
+	if len(p) < 25 || p[8] > 128 {
+		return nil, errors.New("DHCPv6 server did not delegate a prefix")
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p[9:25])
+	mask := net.CIDRMask(int(p[8]), 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
@@ -0,0 +1,145 @@
+package bridgecni
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// keepDiagBundles is how many diagnostic bundles are kept around, older
+// ones are pruned when a new one is written
+const keepDiagBundles = 10
+
+// diagCommands are run on the host and, with the netns entered, in the
+// container for the bundle
+var diagCommands = map[string][]string{
+	"ip-link.txt":       {"ip", "-d", "link", "show"},
+	"ip-addr.txt":       {"ip", "addr", "show"},
+	"ip-route.txt":      {"ip", "route", "show", "table", "all"},
+	"ip-neigh.txt":      {"ip", "neigh", "show"},
+	"ip-rule.txt":       {"ip", "rule", "show"},
+	"bridge-link.txt":   {"bridge", "-d", "link", "show"},
+	"bridge-fdb.txt":    {"bridge", "fdb", "show"},
+	"bridge-vlan.txt":   {"bridge", "vlan", "show"},
+	"iptables-save.txt": {"iptables-save"},
+}
+
+// diagSysctls are the host sysctls recorded in the bundle
+var diagSysctls = []string{
+	"net.ipv4.ip_forward",
+	"net.ipv6.conf.all.forwarding",
+	"net.bridge.bridge-nf-call-iptables",
+	"net.bridge.bridge-nf-call-ip6tables",
+	"net.ipv4.neigh.default.gc_thresh1",
+	"net.ipv4.neigh.default.gc_thresh2",
+	"net.ipv4.neigh.default.gc_thresh3",
+}
+
+// writeDiagnostics gathers the network state of the host and the
+// container plus the netconf into a timestamped tarball under dataDir
+// after a failed ADD, so it can be looked at without reproducing
+func writeDiagnostics(n *NetConf, args *skel.CmdArgs, addErr error) {
+	dir := filepath.Join(dataDir(n), "diagnostics")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to create diagnostics dir: %v", err)
+		return
+	}
+
+	files := map[string][]byte{
+		"error.txt":    []byte(addErr.Error() + "\n"),
+		"netconf.json": args.StdinData,
+		"args.txt": []byte(fmt.Sprintf("CNI_CONTAINERID=%v\nCNI_NETNS=%v\nCNI_IFNAME=%v\nCNI_ARGS=%v\n",
+			args.ContainerID, args.Netns, args.IfName, args.Args)),
+	}
+	for name, argv := range diagCommands {
+		files["host/"+name] = diagOutput(argv)
+		if args.Netns != "" && argv[0] != "bridge" {
+			files["container/"+name] = diagOutput(append([]string{"nsenter", "--net=" + resolveNetnsPath(args.Netns)}, argv...))
+		}
+	}
+	sysctls := ""
+	for _, name := range diagSysctls {
+		value, err := readSysfs(filepath.Join(procSys, strings.Replace(name, ".", "/", -1)))
+		if err != nil {
+			value = err.Error()
+		}
+		sysctls += name + " = " + value + "\n"
+	}
+	files["host/sysctls.txt"] = []byte(sysctls)
+	if br := bridgeName(n); br != "" {
+		files["host/bridge.txt"] = diagOutput([]string{"grep", "-r", ".", filepath.Join(sysClassNet, br, "bridge")})
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%v-%v.tar.gz", time.Now().UTC().Format("20060102T150405Z"), args.ContainerID))
+	if err := writeTarball(path, files); err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to write diagnostics: %v", err)
+		return
+	}
+	logrus.Infof("rancher-cni-bridge: wrote diagnostics of failed ADD of %v to %v", args.ContainerID, path)
+	pruneDiagnostics(dir)
+}
+
+// diagOutput runs argv and returns its output, or why it failed
+func diagOutput(argv []string) []byte {
+	out, err := exec.Command(argv[0], argv[1:]...).CombinedOutput()
+	if err != nil {
+		out = append(out, []byte(fmt.Sprintf("\n%v failed: %v\n", argv[0], err))...)
+	}
+	return out
+}
+
+// writeTarball writes files into a gzipped tarball at path
+func writeTarball(path string, files map[string][]byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(files[name])), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// pruneDiagnostics removes all but the newest keepDiagBundles bundles
+func pruneDiagnostics(dir string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	// the names start with the timestamp, so ReadDir's order is by age
+	for len(infos) > keepDiagBundles {
+		os.Remove(filepath.Join(dir, infos[0].Name()))
+		infos = infos[1:]
+	}
+}
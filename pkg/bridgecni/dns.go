@@ -0,0 +1,86 @@
+package bridgecni
+
+import (
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// rancherDNSDomain is the domain of Rancher's service discovery
+const rancherDNSDomain = "rancher.internal"
+
+// MetadataDNSConf fills the DNS of the result from rancher-metadata.
+// Options are added as is, e.g. "ndots:5".
+type MetadataDNSConf struct {
+	MetadataURL string   `json:"metadataURL"`
+	Options     []string `json:"options"`
+}
+
+// metadataDNS returns the DNS settings for the container with the given
+// rancher UUID: its nameservers and search domains from rancher-metadata,
+// or Rancher DNS and the domains of its service and stack when the
+// record has none. Whatever the network config sets statically follows.
+func metadataDNS(conf *MetadataDNSConf, containerUUID string, static types.DNS) (types.DNS, error) {
+	c, _, err := metadataContainers(conf.MetadataURL, containerUUID)
+	if err != nil {
+		return static, err
+	}
+
+	dns := types.DNS{
+		Nameservers: c.DNS,
+		Domain:      static.Domain,
+		Search:      c.DNSSearch,
+		Options:     conf.Options,
+	}
+	if len(dns.Nameservers) == 0 {
+		ip, _, _ := net.ParseCIDR(metadataAddress)
+		dns.Nameservers = []string{ip.String()}
+	}
+	if len(dns.Search) == 0 {
+		dns.Search = rancherSearchDomains(c.StackName, c.ServiceName)
+	}
+
+	dns.Nameservers = appendMissing(dns.Nameservers, static.Nameservers)
+	dns.Search = appendMissing(dns.Search, static.Search)
+	dns.Options = appendMissing(dns.Options, static.Options)
+	return dns, nil
+}
+
+// rancherSearchDomains are the search domains Rancher gives containers
+// of service in stack, most specific first
+func rancherSearchDomains(stack, service string) []string {
+	var search []string
+	stack, service = strings.ToLower(stack), strings.ToLower(service)
+	if stack != "" && service != "" {
+		search = append(search, service+"."+stack+"."+rancherDNSDomain)
+	}
+	if stack != "" {
+		search = append(search, stack+"."+rancherDNSDomain)
+	}
+	return append(search, rancherDNSDomain)
+}
+
+// appendMissing appends the elements of extra not in list yet
+func appendMissing(list, extra []string) []string {
+	for _, e := range extra {
+		if !containsString(list, e) {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// resultDNS is the DNS block of the result for the container
+func resultDNS(n *NetConf, nArgs *NetArgs) types.DNS {
+	if n.MetadataDNS == nil || nArgs.RancherContainerUUID == "" {
+		return n.DNS
+	}
+	dns, err := metadataDNS(n.MetadataDNS, string(nArgs.RancherContainerUUID), n.DNS)
+	if err != nil {
+		// a wrong resolv.conf is no reason to fail the container
+		logrus.Errorf("rancher-cni-bridge: failed to get DNS from metadata, using the configured DNS: %v", err)
+	}
+	return dns
+}
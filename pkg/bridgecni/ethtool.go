@@ -0,0 +1,90 @@
+package bridgecni
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// legacy ethtool commands toggling a single offload
+const (
+	ethtoolSTXCSUM = 0x17
+	ethtoolSTSO    = 0x1f
+	ethtoolSGSO    = 0x24
+	ethtoolSGRO    = 0x2c
+	siocEthtool    = 0x8946
+)
+
+// OffloadConf selects the offloads to turn on or off on container veths,
+// unset ones are left as the kernel created them
+type OffloadConf struct {
+	TSO        *bool `json:"tso"`
+	GSO        *bool `json:"gso"`
+	GRO        *bool `json:"gro"`
+	TxChecksum *bool `json:"txChecksum"`
+}
+
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+type ifreqData struct {
+	name [syscall.IFNAMSIZ]byte
+	data uintptr
+	_    [16]byte
+}
+
+// setOffloads applies conf to ifName in the netns of the calling thread
+func setOffloads(ifName string, conf *OffloadConf) error {
+	settings := []struct {
+		name  string
+		cmd   uint32
+		value *bool
+	}{
+		// tx checksumming first, the kernel refuses TSO without it
+		{"tx-checksumming", ethtoolSTXCSUM, conf.TxChecksum},
+		{"tso", ethtoolSTSO, conf.TSO},
+		{"gso", ethtoolSGSO, conf.GSO},
+		{"gro", ethtoolSGRO, conf.GRO},
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open ethtool socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	for _, s := range settings {
+		if s.value == nil {
+			continue
+		}
+		value := ethtoolValue{cmd: s.cmd}
+		if *s.value {
+			value.data = 1
+		}
+		if err := ethtoolIoctl(fd, ifName, &value); err != nil {
+			return fmt.Errorf("failed to set %v of %v to %v: %v", s.name, ifName, *s.value, err)
+		}
+		logrus.Debugf("rancher-cni-bridge: set %v of %v to %v", s.name, ifName, *s.value)
+	}
+	return nil
+}
+
+func ethtoolIoctl(fd int, ifName string, value *ethtoolValue) error {
+	if len(ifName) >= syscall.IFNAMSIZ {
+		return fmt.Errorf("interface name too long")
+	}
+	req := ifreqData{data: uintptr(unsafe.Pointer(value))}
+	copy(req.name[:], ifName)
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&req)))
+	runtime.KeepAlive(value)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
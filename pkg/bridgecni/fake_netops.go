@@ -0,0 +1,629 @@
+//go:build test
+// +build test
+
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/rancher/rancher-cni-bridge/internal/firewall"
+	"github.com/vishvananda/netlink"
+)
+
+// fakeOps is an in-memory netOps backend for tests. It models a set of
+// network namespaces holding links, addresses and routes, and records
+// the iptables/sysctl side effects instead of applying them.
+type fakeOps struct {
+	host       *fakeNS
+	namespaces map[string]*fakeNS
+	nextFd     uintptr
+	nextIndex  int
+
+	peers     map[netlink.Link]netlink.Link
+	hairpin   map[netlink.Link]bool
+	masq      map[string]*net.IPNet
+	vfs       map[string]*fakeVF
+	forwardV4 bool
+	ipt       *fakeIPTables
+
+	// masqErr, if set, fails SetupIPMasq, late in ADD
+	masqErr error
+}
+
+// newFakeOps returns an empty fake backend and installs it as ops
+func newFakeOps() *fakeOps {
+	f := &fakeOps{
+		namespaces: map[string]*fakeNS{},
+		peers:      map[netlink.Link]netlink.Link{},
+		hairpin:    map[netlink.Link]bool{},
+		masq:       map[string]*net.IPNet{},
+		vfs:        map[string]*fakeVF{},
+		ipt:        &fakeIPTables{rules: map[string][]string{}},
+	}
+	f.host = f.NewNS("/proc/self/ns/net")
+	ops = f
+	return f
+}
+
+// NewNS creates a fake netns reachable through OpenNS at path
+func (f *fakeOps) NewNS(path string) *fakeNS {
+	f.nextFd++
+	n := &fakeNS{
+		ops:   f,
+		path:  path,
+		fd:    f.nextFd,
+		links: map[string]netlink.Link{},
+		addrs: map[netlink.Link][]netlink.Addr{},
+	}
+	f.namespaces[path] = n
+	return n
+}
+
+func (f *fakeOps) Host() nlHandle {
+	return &fakeHandle{ns: f.host}
+}
+
+func (f *fakeOps) OpenNS(path string) (ns.NetNS, error) {
+	n, ok := f.namespaces[path]
+	if !ok {
+		return nil, ns.NSPathNotExistErr{}
+	}
+	return n, nil
+}
+
+func (f *fakeOps) NSHandle(netns ns.NetNS) (nlHandle, error) {
+	n, ok := netns.(*fakeNS)
+	if !ok {
+		return nil, fmt.Errorf("not a fake netns: %v", netns.Path())
+	}
+	return &fakeHandle{ns: n}, nil
+}
+
+func (f *fakeOps) IPTables() (firewall.IPTables, error) {
+	return f.ipt, nil
+}
+
+func (f *fakeOps) EnableIP4Forward() error {
+	f.forwardV4 = true
+	return nil
+}
+
+func (f *fakeOps) SetupIPMasq(ipn *net.IPNet, chain, comment string) error {
+	if f.masqErr != nil {
+		return f.masqErr
+	}
+	f.masq[chain] = ipn
+	return nil
+}
+
+func (f *fakeOps) TeardownIPMasq(ipn *net.IPNet, chain, comment string) error {
+	delete(f.masq, chain)
+	return nil
+}
+
+// nsByFd finds the fake netns the given fd refers to
+func (f *fakeOps) nsByFd(fd int) *fakeNS {
+	for _, n := range f.namespaces {
+		if n.fd == uintptr(fd) {
+			return n
+		}
+	}
+	return nil
+}
+
+// fakeVF is the admin config of a VF, as set on its PF
+type fakeVF struct {
+	mac  net.HardwareAddr
+	vlan int
+}
+
+// VF returns the config of VF vf of the PF named pf
+func (f *fakeOps) VF(pf string, vf int) *fakeVF {
+	key := fmt.Sprintf("%v/%v", pf, vf)
+	if f.vfs[key] == nil {
+		f.vfs[key] = &fakeVF{}
+	}
+	return f.vfs[key]
+}
+
+// fakeNS is an in-memory network namespace
+type fakeNS struct {
+	ops    *fakeOps
+	path   string
+	fd     uintptr
+	links  map[string]netlink.Link
+	addrs  map[netlink.Link][]netlink.Addr
+	routes []netlink.Route
+	rules  []netlink.Rule
+	neighs []netlink.Neigh
+
+	// what went through RouteReplace and TC, as their arguments
+	routeSpecs []string
+	tc         []string
+}
+
+// Do runs toRun directly; fake namespaces don't need a thread switch
+func (n *fakeNS) Do(toRun func(ns.NetNS) error) error {
+	return toRun(n.ops.host)
+}
+
+func (n *fakeNS) Set() error   { return nil }
+func (n *fakeNS) Path() string { return n.path }
+func (n *fakeNS) Fd() uintptr  { return n.fd }
+func (n *fakeNS) Close() error { return nil }
+
+// Link returns the link named name, or nil
+func (n *fakeNS) Link(name string) netlink.Link {
+	return n.links[name]
+}
+
+// Addrs returns the addresses configured on the link named name
+func (n *fakeNS) Addrs(name string) []netlink.Addr {
+	return n.addrs[n.links[name]]
+}
+
+// Routes returns all routes in the namespace
+func (n *fakeNS) Routes() []netlink.Route {
+	return n.routes
+}
+
+// RouteSpecs returns the routes replaced as ip route arguments
+func (n *fakeNS) RouteSpecs() []string {
+	return n.routeSpecs
+}
+
+// TC returns the tc commands run in the namespace
+func (n *fakeNS) TC() []string {
+	return n.tc
+}
+
+// Rules returns all ip rules in the namespace
+func (n *fakeNS) Rules() []netlink.Rule {
+	return n.rules
+}
+
+func (n *fakeNS) remove(link netlink.Link) {
+	delete(n.links, link.Attrs().Name)
+	delete(n.addrs, link)
+	routes := n.routes[:0]
+	for _, r := range n.routes {
+		if r.LinkIndex != link.Attrs().Index {
+			routes = append(routes, r)
+		}
+	}
+	n.routes = routes
+}
+
+// fakeHandle implements nlHandle on top of a fakeNS
+type fakeHandle struct {
+	ns *fakeNS
+}
+
+func (h *fakeHandle) lookup(link netlink.Link) (netlink.Link, error) {
+	l, ok := h.ns.links[link.Attrs().Name]
+	if !ok {
+		return nil, fmt.Errorf("Link not found")
+	}
+	return l, nil
+}
+
+func (h *fakeHandle) LinkByName(name string) (netlink.Link, error) {
+	l, ok := h.ns.links[name]
+	if !ok {
+		return nil, fmt.Errorf("Link not found")
+	}
+	return l, nil
+}
+
+func (h *fakeHandle) LinkList() ([]netlink.Link, error) {
+	var links []netlink.Link
+	for _, l := range h.ns.links {
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+func (h *fakeHandle) LinkAdd(link netlink.Link) error {
+	if _, ok := h.ns.links[link.Attrs().Name]; ok {
+		return syscall.EEXIST
+	}
+
+	f := h.ns.ops
+	f.nextIndex++
+	link.Attrs().Index = f.nextIndex
+	h.ns.links[link.Attrs().Name] = link
+
+	if veth, ok := link.(*netlink.Veth); ok {
+		if _, ok := h.ns.links[veth.PeerName]; ok {
+			delete(h.ns.links, link.Attrs().Name)
+			return syscall.EEXIST
+		}
+		f.nextIndex++
+		peer := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:  veth.PeerName,
+				MTU:   veth.MTU,
+				Index: f.nextIndex,
+			},
+			PeerName: veth.Name,
+		}
+		h.ns.links[peer.Name] = peer
+		f.peers[link] = peer
+		f.peers[peer] = link
+	}
+	return nil
+}
+
+func (h *fakeHandle) LinkDel(link netlink.Link) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	h.ns.remove(l)
+
+	// deleting one end of a veth pair takes the other with it
+	f := h.ns.ops
+	if peer, ok := f.peers[l]; ok {
+		for _, n := range f.namespaces {
+			if n.links[peer.Attrs().Name] == peer {
+				n.remove(peer)
+			}
+		}
+		delete(f.peers, peer)
+		delete(f.peers, l)
+	}
+	return nil
+}
+
+func (h *fakeHandle) LinkSetUp(link netlink.Link) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	l.Attrs().Flags |= net.FlagUp
+	return nil
+}
+
+func (h *fakeHandle) LinkSetDown(link netlink.Link) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	l.Attrs().Flags &^= net.FlagUp
+	return nil
+}
+
+func (h *fakeHandle) LinkSetMTU(link netlink.Link, mtu int) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	l.Attrs().MTU = mtu
+	return nil
+}
+
+func (h *fakeHandle) LinkSetName(link netlink.Link, name string) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	if _, ok := h.ns.links[name]; ok {
+		return syscall.EEXIST
+	}
+	delete(h.ns.links, l.Attrs().Name)
+	l.Attrs().Name = name
+	h.ns.links[name] = l
+	return nil
+}
+
+func (h *fakeHandle) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	l.Attrs().HardwareAddr = hwaddr
+	return nil
+}
+
+func (h *fakeHandle) LinkSetMaster(link netlink.Link, master *netlink.Bridge) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	l.Attrs().MasterIndex = master.Attrs().Index
+	return nil
+}
+
+func (h *fakeHandle) LinkSetMasterByIndex(link netlink.Link, masterIndex int) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	l.Attrs().MasterIndex = masterIndex
+	return nil
+}
+
+func (h *fakeHandle) LinkSetHairpin(link netlink.Link, mode bool) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	h.ns.ops.hairpin[l] = mode
+	return nil
+}
+
+func (h *fakeHandle) LinkSetNsFd(link netlink.Link, fd int) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	target := h.ns.ops.nsByFd(fd)
+	if target == nil {
+		return syscall.EBADF
+	}
+	if _, ok := target.links[l.Attrs().Name]; ok {
+		return syscall.EEXIST
+	}
+	h.ns.remove(l)
+	target.links[l.Attrs().Name] = l
+	return nil
+}
+
+func (h *fakeHandle) LinkSetVfHardwareAddr(link netlink.Link, vf int, hwaddr net.HardwareAddr) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	h.ns.ops.VF(l.Attrs().Name, vf).mac = hwaddr
+	return nil
+}
+
+func (h *fakeHandle) LinkSetVfVlan(link netlink.Link, vf, vlan int) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	h.ns.ops.VF(l.Attrs().Name, vf).vlan = vlan
+	return nil
+}
+
+func (h *fakeHandle) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	l, err := h.lookup(link)
+	if err != nil {
+		return nil, err
+	}
+	return h.ns.addrs[l], nil
+}
+
+func (h *fakeHandle) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	for _, a := range h.ns.addrs[l] {
+		if a.IPNet.String() == addr.IPNet.String() {
+			return syscall.EEXIST
+		}
+	}
+	h.ns.addrs[l] = append(h.ns.addrs[l], *addr)
+	return nil
+}
+
+func (h *fakeHandle) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	for i, a := range h.ns.addrs[l] {
+		if a.IPNet.String() == addr.IPNet.String() {
+			h.ns.addrs[l] = append(h.ns.addrs[l][:i], h.ns.addrs[l][i+1:]...)
+			return nil
+		}
+	}
+	return syscall.EADDRNOTAVAIL
+}
+
+func (h *fakeHandle) RouteAdd(route *netlink.Route) error {
+	for _, r := range h.ns.routes {
+		if r.Dst.String() == route.Dst.String() && r.Table == route.Table {
+			return syscall.EEXIST
+		}
+	}
+	h.ns.routes = append(h.ns.routes, *route)
+	return nil
+}
+
+func (h *fakeHandle) RouteDel(route *netlink.Route) error {
+	for i, r := range h.ns.routes {
+		if r.Dst.String() == route.Dst.String() && r.Table == route.Table {
+			h.ns.routes = append(h.ns.routes[:i], h.ns.routes[i+1:]...)
+			return nil
+		}
+	}
+	return syscall.ESRCH
+}
+
+func (h *fakeHandle) RuleAdd(rule *netlink.Rule) error {
+	for _, r := range h.ns.rules {
+		if r.String() == rule.String() && r.Dst.String() == rule.Dst.String() {
+			return syscall.EEXIST
+		}
+	}
+	h.ns.rules = append(h.ns.rules, *rule)
+	return nil
+}
+
+func (h *fakeHandle) RuleDel(rule *netlink.Rule) error {
+	for i, r := range h.ns.rules {
+		if r.String() == rule.String() && r.Dst.String() == rule.Dst.String() {
+			h.ns.rules = append(h.ns.rules[:i], h.ns.rules[i+1:]...)
+			return nil
+		}
+	}
+	return syscall.ENOENT
+}
+
+func (h *fakeHandle) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	var neighs []netlink.Neigh
+	for _, n := range h.ns.neighs {
+		if (linkIndex == 0 || n.LinkIndex == linkIndex) && (family == 0 || n.Family == family) {
+			neighs = append(neighs, n)
+		}
+	}
+	return neighs, nil
+}
+
+func sameNeigh(a, b *netlink.Neigh) bool {
+	return a.LinkIndex == b.LinkIndex && a.Family == b.Family &&
+		a.HardwareAddr.String() == b.HardwareAddr.String() && a.IP.Equal(b.IP)
+}
+
+func (h *fakeHandle) NeighSet(neigh *netlink.Neigh) error {
+	for i := range h.ns.neighs {
+		if sameNeigh(&h.ns.neighs[i], neigh) {
+			h.ns.neighs[i] = *neigh
+			return nil
+		}
+	}
+	h.ns.neighs = append(h.ns.neighs, *neigh)
+	return nil
+}
+
+func (h *fakeHandle) NeighDel(neigh *netlink.Neigh) error {
+	for i := range h.ns.neighs {
+		if sameNeigh(&h.ns.neighs[i], neigh) {
+			h.ns.neighs = append(h.ns.neighs[:i], h.ns.neighs[i+1:]...)
+			return nil
+		}
+	}
+	return syscall.ENOENT
+}
+
+func (h *fakeHandle) Delete() {}
+
+func (h *fakeHandle) LinkSetPromiscOn(link netlink.Link) error {
+	l, err := h.lookup(link)
+	if err != nil {
+		return err
+	}
+	l.Attrs().Promisc = 1
+	return nil
+}
+
+func (h *fakeHandle) LinkAddVRF(name string, table int) error {
+	return h.LinkAdd(&netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: name}, LinkType: "vrf"})
+}
+
+// VethAddMultiQueue ignores the queues, fake links have none
+func (h *fakeHandle) VethAddMultiQueue(name, peerName string, mtu, txQueues, rxQueues int) error {
+	return h.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu}, PeerName: peerName})
+}
+
+func (h *fakeHandle) RouteReplace(spec []string) error {
+	h.ns.routeSpecs = append(h.ns.routeSpecs, strings.Join(spec, " "))
+	return nil
+}
+
+func (h *fakeHandle) TC(args ...string) error {
+	h.ns.tc = append(h.ns.tc, strings.Join(args, " "))
+	return nil
+}
+
+// fakeIPTables keeps rules as strings per "table/chain"
+type fakeIPTables struct {
+	rules map[string][]string
+}
+
+func (t *fakeIPTables) key(table, chain string) string {
+	return table + "/" + chain
+}
+
+// Rules returns the rules of the given chain
+func (t *fakeIPTables) Rules(table, chain string) []string {
+	return t.rules[t.key(table, chain)]
+}
+
+func (t *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	rule := strings.Join(rulespec, " ")
+	for _, r := range t.rules[t.key(table, chain)] {
+		if r == rule {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *fakeIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	k := t.key(table, chain)
+	rules := t.rules[k]
+	if pos < 1 || pos > len(rules)+1 {
+		return fmt.Errorf("index of insertion too big")
+	}
+	rules = append(rules, "")
+	copy(rules[pos:], rules[pos-1:])
+	rules[pos-1] = strings.Join(rulespec, " ")
+	t.rules[k] = rules
+	return nil
+}
+
+func (t *fakeIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	if ok, _ := t.Exists(table, chain, rulespec...); ok {
+		return nil
+	}
+	k := t.key(table, chain)
+	t.rules[k] = append(t.rules[k], strings.Join(rulespec, " "))
+	return nil
+}
+
+func (t *fakeIPTables) Delete(table, chain string, rulespec ...string) error {
+	k := t.key(table, chain)
+	rule := strings.Join(rulespec, " ")
+	for i, r := range t.rules[k] {
+		if r == rule {
+			t.rules[k] = append(t.rules[k][:i], t.rules[k][i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("Bad rule (does a matching rule exist in that chain?)")
+}
+
+func (t *fakeIPTables) List(table, chain string) ([]string, error) {
+	var rules []string
+	for _, r := range t.rules[t.key(table, chain)] {
+		rules = append(rules, "-A "+chain+" "+r)
+	}
+	return rules, nil
+}
+
+func (t *fakeIPTables) ListChains(table string) ([]string, error) {
+	var chains []string
+	for k := range t.rules {
+		if strings.HasPrefix(k, table+"/") {
+			chains = append(chains, strings.TrimPrefix(k, table+"/"))
+		}
+	}
+	return chains, nil
+}
+
+func (t *fakeIPTables) NewChain(table, chain string) error {
+	k := t.key(table, chain)
+	if _, ok := t.rules[k]; ok {
+		return fmt.Errorf("Chain already exists")
+	}
+	t.rules[k] = []string{}
+	return nil
+}
+
+func (t *fakeIPTables) ClearChain(table, chain string) error {
+	t.rules[t.key(table, chain)] = []string{}
+	return nil
+}
+
+func (t *fakeIPTables) DeleteChain(table, chain string) error {
+	delete(t.rules, t.key(table, chain))
+	return nil
+}
@@ -0,0 +1,198 @@
+package bridgecni
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// zeroMAC is the MAC of the flood entries of a VXLAN device
+var zeroMAC = make(net.HardwareAddr, 6)
+
+// VXLANConf holds the settings of the VXLAN backed mode, where the
+// bridge is extended across hosts through a VXLAN device enslaved to it
+type VXLANConf struct {
+	// Device is the name of the VXLAN device attached to the bridge
+	Device string `json:"device"`
+	// MetadataURL is the rancher-metadata endpoint remote MACs are
+	// fetched from
+	MetadataURL string `json:"metadataURL"`
+}
+
+// fdbStatePath is where syncFDB keeps the MACs it installed on the
+// VXLAN device, the only ones it ever removes
+func fdbStatePath(n *NetConf) string {
+	return filepath.Join(dataDir(n), n.Name, "fdb-"+n.VXLAN.Device+".json")
+}
+
+// loadFDBState returns the MACs installed by the last sync
+func loadFDBState(n *NetConf) map[string]bool {
+	installed := map[string]bool{}
+	b, err := ioutil.ReadFile(fdbStatePath(n))
+	if err != nil {
+		return installed
+	}
+	var macs []string
+	if err := json.Unmarshal(b, &macs); err != nil {
+		logrus.Errorf("rancher-cni-bridge: ignoring undecodable fdb state: %v", err)
+		return installed
+	}
+	for _, mac := range macs {
+		installed[mac] = true
+	}
+	return installed
+}
+
+func saveFDBState(n *NetConf, wanted map[string]*netlink.Neigh) error {
+	macs := []string{}
+	for mac := range wanted {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	b, err := json.Marshal(macs)
+	if err != nil {
+		return err
+	}
+	path := fdbStatePath(n)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state dir: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record fdb state: %v", err)
+	}
+	return nil
+}
+
+// syncFDB installs a static fdb entry on the VXLAN device for the MAC of
+// every container running on another host, pointing at that host's VTEP,
+// and removes the entries it installed for containers that went away.
+// This avoids flood-and-learn over the overlay. Entries it didn't
+// install, like the all-zero flood entries, are left alone.
+func syncFDB(n *NetConf) error {
+	conf := n.VXLAN
+	var (
+		self       metadataHost
+		hosts      []metadataHost
+		containers []metadataContainer
+	)
+	if err := getMetadata(conf.MetadataURL, "self/host", &self); err != nil {
+		return err
+	}
+	if err := getMetadata(conf.MetadataURL, "hosts", &hosts); err != nil {
+		return err
+	}
+	if err := getMetadata(conf.MetadataURL, "containers", &containers); err != nil {
+		return err
+	}
+
+	vteps := map[string]net.IP{}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h.AgentIP); ip != nil {
+			vteps[h.UUID] = ip
+		}
+	}
+
+	h := ops.Host()
+	vxlan, err := h.LinkByName(conf.Device)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", conf.Device, err)
+	}
+
+	wanted := map[string]*netlink.Neigh{}
+	for _, c := range containers {
+		if c.HostUUID == self.UUID || c.PrimaryMacAddress == "" {
+			continue
+		}
+		vtep, ok := vteps[c.HostUUID]
+		if !ok {
+			continue
+		}
+		mac, err := net.ParseMAC(c.PrimaryMacAddress)
+		if err != nil {
+			logrus.Debugf("rancher-cni-bridge: skipping container %v with bad MAC %q", c.UUID, c.PrimaryMacAddress)
+			continue
+		}
+		wanted[mac.String()] = &netlink.Neigh{
+			LinkIndex:    vxlan.Attrs().Index,
+			Family:       syscall.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+			Flags:        netlink.NTF_SELF,
+			HardwareAddr: mac,
+			IP:           vtep,
+		}
+	}
+
+	existing, err := h.NeighList(vxlan.Attrs().Index, syscall.AF_BRIDGE)
+	if err != nil {
+		return fmt.Errorf("failed to list fdb entries of %q: %v", conf.Device, err)
+	}
+	installed := loadFDBState(n)
+	for i := range existing {
+		e := &existing[i]
+		mac := e.HardwareAddr.String()
+		if e.State&netlink.NUD_PERMANENT == 0 || e.IP == nil || !installed[mac] || bytes.Equal(e.HardwareAddr, zeroMAC) {
+			continue
+		}
+		if _, ok := wanted[mac]; ok {
+			// NeighSet below points it at the right VTEP
+			continue
+		}
+		if err := h.NeighDel(e); err != nil && err != syscall.ENOENT {
+			return fmt.Errorf("failed to remove fdb entry %v: %v", e, err)
+		}
+	}
+
+	for _, neigh := range wanted {
+		if err := h.NeighSet(neigh); err != nil {
+			return fmt.Errorf("failed to add fdb entry %v: %v", neigh, err)
+		}
+	}
+
+	if err := saveFDBState(n, wanted); err != nil {
+		return err
+	}
+
+	logrus.Debugf("rancher-cni-bridge: synced %v fdb entries on %v", len(wanted), conf.Device)
+	return nil
+}
+
+// runSyncFDB implements the sync-fdb subcommand, which reads a network
+// config file and syncs the fdb of its VXLAN device once. It is meant to
+// be run periodically or from a metadata change hook.
+func runSyncFDB(argv []string) error {
+	flags := flag.NewFlagSet("sync-fdb", flag.ContinueOnError)
+	config := flags.String("config", "", "path of the network config file")
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+	if *config == "" {
+		return fmt.Errorf("--config is required")
+	}
+
+	bytes, err := ioutil.ReadFile(*config)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", *config, err)
+	}
+	n, err := loadNetConf(bytes)
+	if err != nil {
+		return err
+	}
+	if n.VXLAN == nil {
+		return fmt.Errorf("%v has no vxlan section", *config)
+	}
+	return syncFDB(n)
+}
@@ -0,0 +1,133 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/utils"
+	"github.com/rancher/rancher-cni-bridge/internal/firewall"
+)
+
+// labels of the container the firewall policy is read from. Ports are
+// "port[/proto]" and services "[stack/]service", both comma separated.
+// A service without a stack is looked up in the container's own stack.
+const (
+	firewallLabelDefault       = "io.rancher.firewall.default"
+	firewallLabelAllowPorts    = "io.rancher.firewall.allow.ports"
+	firewallLabelAllowServices = "io.rancher.firewall.allow.services"
+	firewallLabelDenyPorts     = "io.rancher.firewall.deny.ports"
+	firewallLabelDenyServices  = "io.rancher.firewall.deny.services"
+)
+
+// FirewallConf turns on the per container firewall built from the
+// container's labels in rancher-metadata
+type FirewallConf struct {
+	MetadataURL string `json:"metadataURL"`
+}
+
+// serviceIPs returns the addresses of the containers of the services
+// listed in label, relative to stack
+func serviceIPs(label, stack string, containers []metadataContainer) []net.IP {
+	wanted := map[string]bool{}
+	for _, s := range strings.Split(label, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			s = stack + "/" + s
+		}
+		wanted[strings.ToLower(s)] = true
+	}
+
+	var ips []net.IP
+	for _, c := range containers {
+		if !wanted[strings.ToLower(c.StackName+"/"+c.ServiceName)] {
+			continue
+		}
+		if ip := net.ParseIP(c.PrimaryIP); ip != nil && ip.To4() != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// resolveFirewallPolicy looks the container up in rancher-metadata and
+// builds its policy from the labels. nil means the container has no
+// firewall labels.
+func resolveFirewallPolicy(conf *FirewallConf, containerUUID string) (*firewall.Policy, error) {
+	self, containers, err := metadataContainers(conf.MetadataURL, containerUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := self.Labels
+	if labels[firewallLabelDefault] == "" && labels[firewallLabelAllowPorts] == "" && labels[firewallLabelAllowServices] == "" &&
+		labels[firewallLabelDenyPorts] == "" && labels[firewallLabelDenyServices] == "" {
+		return nil, nil
+	}
+
+	p := &firewall.Policy{}
+	switch labels[firewallLabelDefault] {
+	case "", "allow":
+	case "deny":
+		p.DefaultDeny = true
+	default:
+		return nil, fmt.Errorf("invalid %v %q, must be allow or deny", firewallLabelDefault, labels[firewallLabelDefault])
+	}
+
+	if p.AllowPorts, err = firewall.ParsePorts(labels[firewallLabelAllowPorts]); err != nil {
+		return nil, err
+	}
+	if p.DenyPorts, err = firewall.ParsePorts(labels[firewallLabelDenyPorts]); err != nil {
+		return nil, err
+	}
+	p.AllowFrom = serviceIPs(labels[firewallLabelAllowServices], self.StackName, containers)
+	p.DenyFrom = serviceIPs(labels[firewallLabelDenyServices], self.StackName, containers)
+	return p, nil
+}
+
+// firewallChain returns the per container chain holding its policy
+func firewallChain(n *NetConf, containerID string) string {
+	return utils.FormatChainName(n.Name+"-fw", containerID)
+}
+
+// setupFirewall installs the policy from the labels of the container
+// with the given rancher UUID. Peer services are resolved to the
+// addresses their containers have now.
+func setupFirewall(n *NetConf, containerID, containerUUID string, containerIP net.IP) error {
+	if containerUUID == "" {
+		logrus.Debugf("rancher-cni-bridge: no container UUID for %v, no firewall", containerID)
+		return nil
+	}
+	policy, err := resolveFirewallPolicy(n.Firewall, containerUUID)
+	if err != nil {
+		return fmt.Errorf("failed to resolve firewall policy: %v", err)
+	}
+	if policy == nil {
+		return nil
+	}
+
+	ipt, err := ops.IPTables()
+	if err != nil {
+		return err
+	}
+	if err := firewall.Install(ipt, firewallChain(n, containerID), policy, containerIP, utils.FormatComment(n.Name, containerID)); err != nil {
+		return fmt.Errorf("failed to install firewall of %v: %v", containerID, err)
+	}
+	logrus.Debugf("rancher-cni-bridge: installed firewall of %v (%v rules)", containerID, len(policy.Rules()))
+	return nil
+}
+
+// teardownFirewall removes whatever setupFirewall installed for the
+// container. It is a no-op if there was no policy.
+func teardownFirewall(n *NetConf, containerID string, containerIP net.IP) error {
+	ipt, err := ops.IPTables()
+	if err != nil {
+		logrus.Debugf("rancher-cni-bridge: skipping firewall teardown: %v", err)
+		return nil
+	}
+
+	return firewall.Remove(ipt, firewallChain(n, containerID), containerIP, utils.FormatComment(n.Name, containerID))
+}
@@ -0,0 +1,108 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+)
+
+const (
+	ethPARP = 0x0806
+
+	defaultGARPCount    = 3
+	defaultGARPInterval = 1000
+	maxGARPCount        = 10
+	maxGARPInterval     = 5000
+)
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// GARPConf has ADD announce the container address with gratuitous ARPs
+// from the container interface, repeated for switches that miss or
+// ignore a single one. Interval is in milliseconds.
+type GARPConf struct {
+	Count    int `json:"count"`
+	Interval int `json:"interval"`
+}
+
+// validate fills in the defaults and checks the caps, which bound how
+// long ADD waits on the announcements
+func (c *GARPConf) validate() error {
+	if c.Count == 0 {
+		c.Count = defaultGARPCount
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultGARPInterval
+	}
+	if c.Count < 0 || c.Count > maxGARPCount {
+		return fmt.Errorf("invalid garp count %v, must be between 1 and %v", c.Count, maxGARPCount)
+	}
+	if c.Interval < 0 || c.Interval > maxGARPInterval {
+		return fmt.Errorf("invalid garp interval %v, must be between 1 and %v ms", c.Interval, maxGARPInterval)
+	}
+	return nil
+}
+
+// garpFrame builds a gratuitous ARP request for addr from mac
+func garpFrame(mac net.HardwareAddr, addr net.IP) []byte {
+	frame := append([]byte{}, broadcastMAC...)
+	frame = append(frame, mac...)
+	frame = append(frame, byte(ethPARP>>8), byte(ethPARP&0xff))
+
+	// ethernet/IPv4, request
+	frame = append(frame, 0, 1, 0x08, 0x00, 6, 4, 0, 1)
+	frame = append(frame, mac...)
+	frame = append(frame, addr.To4()...)
+	frame = append(frame, make([]byte, 6)...)
+	return append(frame, addr.To4()...)
+}
+
+// sendGARPs sends c.Count gratuitous ARPs for addr from ifName,
+// c.Interval apart. It must run in the netns of ifName.
+func sendGARPs(ifName string, addr net.IP, c *GARPConf) error {
+	link, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPARP)))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	to := &syscall.SockaddrLinklayer{
+		Protocol: htons(ethPARP),
+		Ifindex:  link.Index,
+		Halen:    6,
+	}
+	copy(to.Addr[:], broadcastMAC)
+	frame := garpFrame(link.HardwareAddr, addr)
+	for i := 0; i < c.Count; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(c.Interval) * time.Millisecond)
+		}
+		if err = syscall.Sendto(fd, frame, 0, to); err != nil {
+			return fmt.Errorf("failed to send gratuitous ARP on %v: %v", ifName, err)
+		}
+	}
+	return nil
+}
+
+// announceGARP announces the IPv4 address of the container interface,
+// without ever failing the ADD over it
+func announceGARP(n *NetConf, netns ns.NetNS, ifName string, addr net.IP) {
+	if n.GARP == nil || addr.To4() == nil {
+		return
+	}
+	// packet sockets belong to the netns of the thread creating them
+	if err := netns.Do(func(_ ns.NetNS) error {
+		return sendGARPs(ifName, addr, n.GARP)
+	}); err != nil {
+		logrus.Errorf("rancher-cni-bridge: %v", err)
+	}
+}
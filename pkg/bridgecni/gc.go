@@ -0,0 +1,323 @@
+package bridgecni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/utils"
+)
+
+// GCAttachment identifies an attachment the runtime still uses
+type GCAttachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+}
+
+// cmdGC tears down every recorded attachment of the network the runtime
+// no longer lists as valid, the same way DEL would. Then it collects
+// what no attachment accounts for: host veths left on the bridge, NAT
+// and port rules of unknown containers with their addresses, and
+// embedded IPAM reservations nobody owns any more.
+func cmdGC(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	// without the list every attachment would look stale
+	if n.ValidAttachments == nil {
+		return fmt.Errorf("GC needs cni.dev/valid-attachments")
+	}
+
+	valid := map[string]bool{}
+	validIDs := map[string]bool{}
+	for _, v := range *n.ValidAttachments {
+		valid[ipamOwner(v.ContainerID, v.IfName)] = true
+		validIDs[v.ContainerID] = true
+	}
+
+	as, err := listAttachments(n)
+	if err != nil {
+		return err
+	}
+
+	bridges := map[string]bool{}
+	if br := bridgeName(n); br != "" && br != bridgeFromMetadata {
+		bridges[br] = true
+	}
+
+	var stale, failed int
+	for _, a := range as {
+		if a.Bridge != "" {
+			bridges[a.Bridge] = true
+		}
+		if valid[ipamOwner(a.ContainerID, a.IfName)] {
+			continue
+		}
+		stale++
+
+		logrus.Infof("rancher-cni-bridge: collecting stale attachment of %v as %v", a.ContainerID, a.IfName)
+		delArgs := &skel.CmdArgs{
+			ContainerID: a.ContainerID,
+			Netns:       a.Netns,
+			IfName:      a.IfName,
+			Path:        args.Path,
+			StdinData:   args.StdinData,
+		}
+		if err := setCNIEnv("DEL", delArgs); err != nil {
+			return err
+		}
+		// DEL may resolve the bridge of the attachment into its config
+		nc, err := n.clone()
+		if err != nil {
+			return err
+		}
+		if err := delNetwork(delArgs, nc); err != nil {
+			logrus.Errorf("rancher-cni-bridge: failed to collect %v: %v", a.ContainerID, err)
+			failed++
+		}
+	}
+
+	// what failed to be collected stays recorded, and is left alone
+	if as, err = listAttachments(n); err != nil {
+		return err
+	}
+	for _, a := range as {
+		validIDs[a.ContainerID] = true
+	}
+	if err := collectOrphanRules(args, n, validIDs); err != nil {
+		return err
+	}
+	if err := collectOrphanVeths(n, bridges); err != nil {
+		return err
+	}
+
+	// the store is there if the embedded allocator ever stood in, even
+	// if the IPAM plugin is installed by now
+	if _, err := os.Stat(ipamStoreDir(n)); err == nil {
+		if err := embeddedIPAMGC(n, valid); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to collect %d of %d stale attachments", failed, stale)
+	}
+	return nil
+}
+
+// iffLowerUp is the carrier flag of a link, missing from syscall
+const iffLowerUp = 0x10000
+
+// orphan is a container known only from the rules or the cached result
+// it left behind
+type orphan struct {
+	ifName    string
+	ip        net.IP
+	masqNet   *net.IPNet
+	allocator string
+}
+
+// sourceRE picks the source address out of a listed rule
+var sourceRE = regexp.MustCompile(`-s (\S+)`)
+
+// findOrphans returns the containers of the network with NAT or port
+// rules or a cached result, that aren't in keep
+func findOrphans(n *NetConf, keep map[string]bool) (map[string]*orphan, error) {
+	orphans := map[string]*orphan{}
+	get := func(containerID string) *orphan {
+		o := orphans[containerID]
+		if o == nil {
+			o = &orphan{ifName: "eth0"}
+			orphans[containerID] = o
+		}
+		return o
+	}
+
+	paths, err := filepath.Glob(filepath.Join(resultCacheDir(n), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		i := strings.LastIndex(name, "-")
+		if i < 0 || keep[name[:i]] {
+			continue
+		}
+		o := get(name[:i])
+		o.ifName = name[i+1:]
+		c := &cachedResult{}
+		if b, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(b, c) == nil {
+			o.allocator = c.IPAM
+			if c.Result != nil && c.Result.IP4 != nil {
+				o.ip = c.Result.IP4.IP.IP
+			}
+		}
+	}
+
+	ipt, err := ops.IPTables()
+	if err != nil {
+		// without iptables there can't be any rules left
+		logrus.Debugf("rancher-cni-bridge: skipping orphaned rules: %v", err)
+		return orphans, nil
+	}
+	chains, err := ipt.ListChains("nat")
+	if err != nil {
+		return nil, err
+	}
+	// listed comments come quoted, with their quotes escaped
+	idRE := regexp.MustCompile(`name: \\?"` + regexp.QuoteMeta(n.Name) + `\\?" id: \\?"([^"\\]+)`)
+	for _, chain := range []string{"POSTROUTING", hostPortDNATChain, hostPortSNATChain} {
+		if !containsString(chains, chain) {
+			continue
+		}
+		rules, err := ipt.List("nat", chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			m := idRE.FindStringSubmatch(rule)
+			if m == nil || keep[m[1]] {
+				continue
+			}
+			o := get(m[1])
+			s := sourceRE.FindStringSubmatch(rule)
+			if s == nil {
+				continue
+			}
+			switch chain {
+			case "POSTROUTING":
+				if _, ipn, err := net.ParseCIDR(s[1]); err == nil {
+					o.masqNet = ipn
+				}
+			case hostPortSNATChain:
+				if addr := net.ParseIP(strings.Split(s[1], "/")[0]); addr != nil {
+					o.ip = addr
+				}
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// collectOrphanRules removes the NAT and port rules of containers that
+// have no attachment and aren't valid, and gives their addresses back
+// to IPAM, as DEL would have had it known about them
+func collectOrphanRules(args *skel.CmdArgs, n *NetConf, keep map[string]bool) error {
+	orphans, err := findOrphans(n, keep)
+	if err != nil {
+		return err
+	}
+	for containerID, o := range orphans {
+		logrus.Infof("rancher-cni-bridge: collecting orphaned rules and addresses of %v", containerID)
+		if err := teardownPortMappings(n, containerID, o.ip); err != nil {
+			return err
+		}
+		if o.masqNet != nil {
+			chain := utils.FormatChainName(n.Name, containerID)
+			comment := utils.FormatComment(n.Name, containerID)
+			if err := ops.TeardownIPMasq(o.masqNet, chain, comment); err != nil {
+				return err
+			}
+		}
+		if ipamDisabled(n) {
+			continue
+		}
+		delArgs := &skel.CmdArgs{
+			ContainerID: containerID,
+			IfName:      o.ifName,
+			Path:        args.Path,
+			StdinData:   args.StdinData,
+		}
+		if err := setCNIEnv("DEL", delArgs); err != nil {
+			return err
+		}
+		if err := execIPAMDel(n, delArgs, o.allocator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordedHostVeths returns the host veths of every network's recorded
+// attachments, since networks may share a bridge
+func recordedHostVeths(n *NetConf) (map[string]bool, error) {
+	paths, err := filepath.Glob(filepath.Join(dataDir(n), "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	veths := map[string]bool{}
+	for _, path := range paths {
+		a := &attachment{}
+		b, err := ioutil.ReadFile(path)
+		if err != nil || json.Unmarshal(b, a) != nil {
+			continue
+		}
+		if a.HostVeth != "" {
+			veths[a.HostVeth] = true
+		}
+	}
+	return veths, nil
+}
+
+// collectOrphanVeths deletes the veths plugged into the bridges that no
+// attachment accounts for, which takes their peers along. Only veths
+// named the way the plugin names host veths are candidates, and only
+// without carrier: a veth has carrier while its peer is up, so one
+// whose container is gone has none. Adopted bridges are left alone.
+func collectOrphanVeths(n *NetConf, bridges map[string]bool) error {
+	if len(bridges) == 0 || n.AdoptExisting {
+		return nil
+	}
+	// an ADD records its veth only once it's plugged in
+	unlock, err := lockNetwork(n)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	recorded, err := recordedHostVeths(n)
+	if err != nil {
+		return err
+	}
+	recorded[uplinkName(n)] = true
+	if n.Standby != nil {
+		recorded[n.Standby.Uplink] = true
+		recorded[n.Standby.primaryUplink] = true
+	}
+	prefix := "veth"
+	if n.HostVethPrefix != "" {
+		prefix = n.HostVethPrefix
+	}
+
+	h := ops.Host()
+	masters := map[int]bool{}
+	for name := range bridges {
+		if br, err := h.LinkByName(name); err == nil {
+			masters[br.Attrs().Index] = true
+		}
+	}
+	links, err := h.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if link.Type() != "veth" || !masters[attrs.MasterIndex] || recorded[attrs.Name] ||
+			!strings.HasPrefix(attrs.Name, prefix) || attrs.RawFlags&iffLowerUp != 0 {
+			continue
+		}
+		logrus.Infof("rancher-cni-bridge: deleting orphaned veth %v", attrs.Name)
+		if err := h.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete %v: %v", attrs.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package bridgecni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+const defaultHookTimeout = 10
+
+// HooksConf lists executables run around ADD and DEL. Each gets a
+// hookPayload as JSON on stdin. A failing pre-ADD hook fails the ADD,
+// the others only log, so a broken hook can't leak an attachment.
+type HooksConf struct {
+	PreAdd  []string `json:"preAdd"`
+	PostAdd []string `json:"postAdd"`
+	PreDel  []string `json:"preDel"`
+	PostDel []string `json:"postDel"`
+
+	// Timeout in seconds for each hook, 10 if unset
+	Timeout int `json:"timeout"`
+}
+
+// hookPayload is what a hook reads on stdin
+type hookPayload struct {
+	Hook        string      `json:"hook"`
+	Network     string      `json:"network"`
+	ContainerID string      `json:"containerID"`
+	Netns       string      `json:"netns"`
+	IfName      string      `json:"ifName"`
+	Args        string      `json:"args,omitempty"`
+	Attachment  *attachment `json:"attachment,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+func (h *HooksConf) validate() error {
+	if h.Timeout < 0 {
+		return fmt.Errorf("invalid hooks timeout %d", h.Timeout)
+	}
+	for _, path := range append(append(append(h.PreAdd, h.PostAdd...), h.PreDel...), h.PostDel...) {
+		if path == "" {
+			return fmt.Errorf("hooks need an executable path")
+		}
+	}
+	return nil
+}
+
+// runHooks runs the hooks configured for hook ("preAdd", "postAdd",
+// "preDel" or "postDel") one after the other, stopping at the first
+// failure
+func runHooks(n *NetConf, hook string, args *skel.CmdArgs, a *attachment, opErr error) error {
+	if n.Hooks == nil {
+		return nil
+	}
+
+	var paths []string
+	switch hook {
+	case "preAdd":
+		paths = n.Hooks.PreAdd
+	case "postAdd":
+		paths = n.Hooks.PostAdd
+	case "preDel":
+		paths = n.Hooks.PreDel
+	case "postDel":
+		paths = n.Hooks.PostDel
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	payload := &hookPayload{
+		Hook:        hook,
+		Network:     n.Name,
+		ContainerID: args.ContainerID,
+		Netns:       args.Netns,
+		IfName:      args.IfName,
+		Args:        args.Args,
+		Attachment:  a,
+	}
+	if opErr != nil {
+		payload.Error = opErr.Error()
+	}
+	stdin, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %v hook payload: %v", hook, err)
+	}
+
+	timeout := n.Hooks.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	for _, path := range paths {
+		if err := runHook(path, stdin, time.Duration(timeout)*time.Second); err != nil {
+			return fmt.Errorf("%v hook %v failed: %v", hook, path, err)
+		}
+	}
+	return nil
+}
+
+// runHook runs one hook, killing it once timeout has passed
+func runHook(path string, stdin []byte, timeout time.Duration) error {
+	var out bytes.Buffer
+	cmd := exec.Command(path)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// its own process group, so the timeout also gets whatever the hook
+	// forked, which would otherwise keep the output pipe and Wait going
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	timer := time.AfterFunc(timeout, func() { syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) })
+	err := cmd.Wait()
+	if !timer.Stop() {
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out.Bytes()))
+	}
+	return nil
+}
+
+// logHookError logs a hook failure that shouldn't fail the operation
+func logHookError(err error) {
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: %v", err)
+	}
+}
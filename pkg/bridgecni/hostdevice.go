@@ -0,0 +1,94 @@
+package bridgecni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+)
+
+// modeHostDevice moves an existing host NIC into the container instead
+// of creating a veth
+const modeHostDevice = "host-device"
+
+const sysBusPCI = "/sys/bus/pci/devices"
+
+// hostDeviceName resolves the configured device, by name or PCI address
+func hostDeviceName(n *NetConf) (string, error) {
+	if n.Device != "" {
+		return n.Device, nil
+	}
+
+	dir := filepath.Join(sysBusPCI, n.PCIAddress, "net")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the netdev of PCI device %v: %v", n.PCIAddress, err)
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("PCI device %v has no netdev", n.PCIAddress)
+	}
+	return files[0].Name(), nil
+}
+
+// moveHostDevice moves the configured device into netns as ifName. It
+// returns the host name of the device, to restore it on DEL.
+func moveHostDevice(ch nlHandle, netns ns.NetNS, ifName string, n *NetConf) (string, error) {
+	name, err := hostDeviceName(n)
+	if err != nil {
+		return "", err
+	}
+
+	return name, moveLinkToNS(ch, netns, name, ifName)
+}
+
+// moveLinkToNS moves the host link name into netns as ifName
+func moveLinkToNS(ch nlHandle, netns ns.NetNS, name, ifName string) error {
+	h := ops.Host()
+	dev, err := h.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	if err = h.LinkSetNsFd(dev, int(netns.Fd())); err != nil {
+		return fmt.Errorf("failed to move %q to container netns: %v", name, err)
+	}
+
+	if dev, err = ch.LinkByName(name); err != nil {
+		return fmt.Errorf("failed to lookup %q in %q: %v", name, netns.Path(), err)
+	}
+	if name != ifName {
+		if err = ch.LinkSetName(dev, ifName); err != nil {
+			return fmt.Errorf("failed to rename %q to %q: %v", name, ifName, err)
+		}
+	}
+	return nil
+}
+
+// restoreHostDevice hands the device back to the host under its original
+// name. A device that is gone already, with its netns, is left alone.
+func restoreHostDevice(ch nlHandle, ifName, hostName string) error {
+	dev, err := ch.LinkByName(ifName)
+	if err != nil {
+		logrus.Infof("rancher-cni-bridge: %q already gone: %v", ifName, err)
+		return nil
+	}
+
+	if hostName != "" && hostName != ifName {
+		if err = ch.LinkSetName(dev, hostName); err != nil {
+			return fmt.Errorf("failed to rename %q back to %q: %v", ifName, hostName, err)
+		}
+	}
+
+	hostNS, err := ops.OpenNS("/proc/self/ns/net")
+	if err != nil {
+		return fmt.Errorf("failed to open host netns: %v", err)
+	}
+	defer hostNS.Close()
+
+	// moving the device out flushes its addresses
+	if err = ch.LinkSetNsFd(dev, int(hostNS.Fd())); err != nil {
+		return fmt.Errorf("failed to move %q back to the host: %v", ifName, err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// HostRouteConf has the host route every container address explicitly,
+// as needed by L3 only fabrics that have no shared L2 with the host.
+// The /32 goes into Table (the main table when 0), and with Rules, ip
+// rules send traffic from and to the container through that table.
+type HostRouteConf struct {
+	Table        int  `json:"table"`
+	Rules        bool `json:"rules"`
+	RulePriority int  `json:"rulePriority"`
+}
+
+func (c *HostRouteConf) validate() error {
+	if c.Table < 0 || c.RulePriority < 0 {
+		return fmt.Errorf("hostRoutes table and rulePriority must not be negative")
+	}
+	if c.Rules && c.Table == 0 {
+		return fmt.Errorf("hostRoutes rules need a table")
+	}
+	return nil
+}
+
+func hostRoute(linkIndex int, addr net.IP, c *HostRouteConf) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: linkIndex,
+		Dst:       &net.IPNet{IP: addr, Mask: net.CIDRMask(32, 32)},
+		Scope:     netlink.SCOPE_LINK,
+		Table:     c.Table,
+	}
+}
+
+func hostRules(addr net.IP, c *HostRouteConf) []*netlink.Rule {
+	ipn := &net.IPNet{IP: addr, Mask: net.CIDRMask(32, 32)}
+
+	from := netlink.NewRule()
+	from.Src = ipn
+	to := netlink.NewRule()
+	to.Dst = ipn
+
+	rules := []*netlink.Rule{from, to}
+	for _, r := range rules {
+		r.Table = c.Table
+		if c.RulePriority > 0 {
+			r.Priority = c.RulePriority
+		}
+	}
+	return rules
+}
+
+// setupHostRoute routes addr to the bridge and installs the rules
+func setupHostRoute(brName string, addr net.IP, c *HostRouteConf) error {
+	h := ops.Host()
+	br, err := h.LinkByName(brName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", brName, err)
+	}
+
+	if err = h.RouteAdd(hostRoute(br.Attrs().Index, addr, c)); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to add host route to %v: %v", addr, err)
+	}
+
+	if !c.Rules {
+		return nil
+	}
+	for _, r := range hostRules(addr, c) {
+		if err = h.RuleAdd(r); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to add rule for %v: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// teardownHostRoute removes what setupHostRoute installed, the route may
+// already be gone along with the bridge
+func teardownHostRoute(brName string, addr net.IP, c *HostRouteConf) {
+	h := ops.Host()
+	if br, err := h.LinkByName(brName); err == nil {
+		if err := h.RouteDel(hostRoute(br.Attrs().Index, addr, c)); err != nil {
+			logrus.Debugf("rancher-cni-bridge: failed to remove host route to %v: %v", addr, err)
+		}
+	}
+
+	if !c.Rules {
+		return
+	}
+	for _, r := range hostRules(addr, c) {
+		if err := h.RuleDel(r); err != nil {
+			logrus.Debugf("rancher-cni-bridge: failed to remove rule for %v: %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package bridgecni
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/rancher/rancher-cni-bridge/internal/veth"
+)
+
+// maxHostVethPrefixLen leaves at least 8 hex digits of the hash in the
+// host veth names
+const maxHostVethPrefixLen = veth.MaxNameLen - 8
+
+// containerIfName returns the name the container interface gets for the
+// CNI_IFNAME name: name itself, or with repairIfName a name shortened to
+// fit IFNAMSIZ. Anything else the kernel would refuse is an error.
+func containerIfName(n *NetConf, name string) (string, error) {
+	if n.RepairIfName && len(name) > veth.MaxNameLen {
+		short := veth.ShortName(name)
+		logrus.Debugf("rancher-cni-bridge: using %v for interface name %v", short, name)
+		name = short
+	}
+	if err := veth.ValidateName(name); err != nil {
+		return "", fmt.Errorf("invalid CNI_IFNAME: %v", err)
+	}
+	return name, nil
+}
+
+// fixIfName replaces args.IfName with the containerIfName of it, so
+// the interface and the recorded state go by the same name
+func fixIfName(n *NetConf, args *skel.CmdArgs) error {
+	name, err := containerIfName(n, args.IfName)
+	if err != nil {
+		return err
+	}
+	args.IfName = name
+	return nil
+}
+
+// validateHostVethPrefix checks the prefix leaves room for the hash
+func validateHostVethPrefix(prefix string) error {
+	if len(prefix) > maxHostVethPrefixLen {
+		return fmt.Errorf("hostVethPrefix %q is longer than %v characters", prefix, maxHostVethPrefixLen)
+	}
+	return veth.ValidateName(prefix)
+}
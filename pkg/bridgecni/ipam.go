@@ -0,0 +1,373 @@
+package bridgecni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ipam"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// ipamNone turns addressing off altogether
+const ipamNone = "none"
+
+// ipamDisabled reports whether the network is L2 only, leaving addressing
+// to the container (DHCP clients, routers)
+func ipamDisabled(n *NetConf) bool {
+	return n.IPAM.Type == ipamNone
+}
+
+// ipamEmbedded is the allocator recorded for addresses from the
+// embedded store, the IPAM plugin type is recorded otherwise
+const ipamEmbedded = "embedded"
+
+// ipamAllocator is the allocator ADD uses now
+func ipamAllocator(n *NetConf) string {
+	if useEmbeddedIPAM(n) {
+		return ipamEmbedded
+	}
+	return n.IPAM.Type
+}
+
+// useEmbeddedIPAM reports whether addresses come from the built-in
+// allocator: when no IPAM plugin is configured, or the configured one
+// isn't installed but there is a bridgeSubnet to allocate from
+func useEmbeddedIPAM(n *NetConf) bool {
+	if n.IPAM.Type == "" {
+		return true
+	}
+	if ipamDisabled(n) || n.BrSubnet == "" {
+		return false
+	}
+	if _, err := invoke.FindInPath(n.IPAM.Type, filepath.SplitList(os.Getenv("CNI_PATH"))); err != nil {
+		logrus.Warnf("rancher-cni-bridge: IPAM plugin %q unavailable (%v), using the embedded allocator", n.IPAM.Type, err)
+		return true
+	}
+	return false
+}
+
+// execIPAMAdd allocates the container addresses: IPv4 from IPAM, and an
+// IPv6 prefix through DHCPv6-PD if configured. With resultCacheTTL a
+// re-ADD before DEL gets the earlier allocation without asking again.
+// The allocator used is returned too, for DEL to release from it
+// whatever plugin is installed by then.
+func execIPAMAdd(n *NetConf, args *skel.CmdArgs, nArgs *NetArgs) (*types.Result, string, error) {
+	if c := loadCachedResult(n, args.ContainerID, args.IfName); c != nil {
+		logrus.Debugf("rancher-cni-bridge: using cached IPAM result of %v", args.ContainerID)
+		return c.Result, c.IPAM, nil
+	}
+
+	allocator := ipamAllocator(n)
+	result, err := execIPAMAddV4(n, args, nArgs, allocator)
+	if err != nil {
+		return nil, "", err
+	}
+	if n.DHCPv6PD != nil {
+		if err = requestDelegatedPrefix(n, args.ContainerID, args.IfName, result); err != nil {
+			releaseIPAM(n, args, allocator)
+			return nil, "", err
+		}
+	}
+
+	cacheResult(n, args.ContainerID, args.IfName, result, allocator)
+	return result, allocator, nil
+}
+
+// execIPAMAddV4 runs the IPAM plugin. The per-container hints from
+// CNI_ARGS are handed on, so the IPAM plugin can honour reservations
+// without looking the container up again.
+func execIPAMAddV4(n *NetConf, args *skel.CmdArgs, nArgs *NetArgs, allocator string) (*types.Result, error) {
+	var requested net.IP
+	if nArgs.IP != "" {
+		if requested = net.ParseIP(string(nArgs.IP)); requested == nil {
+			return nil, fmt.Errorf("invalid IP %q in CNI_ARGS", nArgs.IP)
+		}
+	}
+
+	if allocator == ipamEmbedded {
+		return embeddedIPAMAdd(n, args.ContainerID, args.IfName, requested)
+	}
+
+	stdinData, err := ipamStdin(args.StdinData, nArgs)
+	if err != nil {
+		return nil, err
+	}
+	return ipam.ExecAdd(n.IPAM.Type, stdinData)
+}
+
+// ipamStdin adds the container hints to the netconf under "args", the
+// conventional place for runtime supplied values:
+//
+//	"args": {"cni": {"ips": [...], "mac": ...}, "rancher": {"containerUUID": ...}}
+func ipamStdin(stdinData []byte, nArgs *NetArgs) ([]byte, error) {
+	// the IPAM section gets the same per host values as the rest
+	stdinData, err := prepareConfig(stdinData)
+	if err != nil {
+		return nil, err
+	}
+
+	if nArgs.IP == "" && nArgs.MACAddress == "" && nArgs.RancherContainerUUID == "" {
+		return stdinData, nil
+	}
+
+	conf := map[string]interface{}{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	confArgs, _ := conf["args"].(map[string]interface{})
+	if confArgs == nil {
+		confArgs = map[string]interface{}{}
+	}
+	cni, _ := confArgs["cni"].(map[string]interface{})
+	if cni == nil {
+		cni = map[string]interface{}{}
+	}
+	if nArgs.IP != "" {
+		cni["ips"] = []string{string(nArgs.IP)}
+	}
+	if nArgs.MACAddress != "" {
+		cni["mac"] = string(nArgs.MACAddress)
+	}
+	if len(cni) > 0 {
+		confArgs["cni"] = cni
+	}
+	if nArgs.RancherContainerUUID != "" {
+		confArgs["rancher"] = map[string]interface{}{
+			"containerUUID": string(nArgs.RancherContainerUUID),
+		}
+	}
+	conf["args"] = confArgs
+
+	return json.Marshal(conf)
+}
+
+// execIPAMDel releases the container addresses from allocator, the one
+// recorded at ADD. Without a record it's the one ADD would use now.
+func execIPAMDel(n *NetConf, args *skel.CmdArgs, allocator string) error {
+	invalidateResult(n, args.ContainerID, args.IfName)
+
+	if n.DHCPv6PD != nil {
+		if err := releaseDelegatedPrefix(n, args.ContainerID, args.IfName); err != nil {
+			return err
+		}
+	}
+
+	if allocator == "" {
+		allocator = ipamAllocator(n)
+	}
+	if allocator == ipamEmbedded {
+		return embeddedIPAMDel(n, args.ContainerID, args.IfName)
+	}
+	stdinData, err := prepareConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return ipam.ExecDel(allocator, stdinData)
+}
+
+// ipamStore keeps one file per reserved address, named after the
+// address and holding the owner, under an exclusive lock on the directory
+type ipamStore struct {
+	dir  string
+	lock *os.File
+}
+
+func ipamStoreDir(n *NetConf) string {
+	return filepath.Join(dataDir(n), n.Name, "ipam")
+}
+
+func openIPAMStore(n *NetConf) (*ipamStore, error) {
+	dir := ipamStoreDir(n)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create IPAM store: %v", err)
+	}
+
+	lock, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open IPAM store: %v", err)
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock IPAM store: %v", err)
+	}
+	return &ipamStore{dir: dir, lock: lock}, nil
+}
+
+func (s *ipamStore) close() {
+	// closing the descriptor drops the lock
+	s.lock.Close()
+}
+
+// find returns the addresses reserved for owner
+func (s *ipamStore) find(owner string) ([]net.IP, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IPAM store: %v", err)
+	}
+
+	var ips []net.IP
+	for _, f := range files {
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(b)) == owner {
+			if addr := net.ParseIP(f.Name()); addr != nil {
+				ips = append(ips, addr)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// reserve claims addr for owner, returning false if it is taken
+func (s *ipamStore) reserve(addr net.IP, owner string) (bool, error) {
+	f, err := os.OpenFile(filepath.Join(s.dir, addr.String()), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve %v: %v", addr, err)
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString(owner); err != nil {
+		os.Remove(f.Name())
+		return false, fmt.Errorf("failed to reserve %v: %v", addr, err)
+	}
+	return true, nil
+}
+
+func ipamOwner(containerID, ifName string) string {
+	return containerID + "-" + ifName
+}
+
+// embeddedIPAMAdd hands out the requested address, or else the first free
+// one of bridgeSubnet, skipping the network, broadcast and bridge
+// addresses. A repeated ADD gets back the address it already holds.
+func embeddedIPAMAdd(n *NetConf, containerID, ifName string, requested net.IP) (*types.Result, error) {
+	_, subnet, err := net.ParseCIDR(n.BrSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bridgeSubnet %q: %v", n.BrSubnet, err)
+	}
+	gw, err := calculateBridgeIP(n)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := openIPAMStore(n)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	owner := ipamOwner(containerID, ifName)
+	held, err := s.find(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	var allocated net.IP
+	if len(held) > 0 {
+		allocated = held[0]
+	} else if requested != nil {
+		if !hostAddr(subnet, requested) || requested.Equal(gw.IP) {
+			return nil, fmt.Errorf("requested IP %v is not available in %v", requested, subnet)
+		}
+		ok, err := s.reserve(requested, owner)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("requested IP %v is already in use", requested)
+		}
+		allocated = requested
+	} else {
+		for addr := ip.NextIP(subnet.IP); subnet.Contains(addr); addr = ip.NextIP(addr) {
+			if addr.Equal(gw.IP) || !hostAddr(subnet, addr) {
+				continue
+			}
+			ok, err := s.reserve(addr, owner)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				allocated = addr
+				break
+			}
+		}
+	}
+	if allocated == nil {
+		return nil, fmt.Errorf("no addresses left in %v", subnet)
+	}
+
+	return &types.Result{
+		IP4: &types.IPConfig{
+			IP:      net.IPNet{IP: allocated, Mask: subnet.Mask},
+			Gateway: gw.IP,
+		},
+	}, nil
+}
+
+// hostAddr reports whether addr is a host address of subnet, neither its
+// network nor its broadcast address
+func hostAddr(subnet *net.IPNet, addr net.IP) bool {
+	return subnet.Contains(addr) && !addr.Equal(subnet.IP) && subnet.Contains(ip.NextIP(addr))
+}
+
+// embeddedIPAMDel releases whatever is reserved for the container
+func embeddedIPAMDel(n *NetConf, containerID, ifName string) error {
+	s, err := openIPAMStore(n)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	held, err := s.find(ipamOwner(containerID, ifName))
+	if err != nil {
+		return err
+	}
+	for _, addr := range held {
+		if err := os.Remove(filepath.Join(s.dir, addr.String())); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to release %v: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// embeddedIPAMGC releases the reservations of owners that aren't valid
+func embeddedIPAMGC(n *NetConf, valid map[string]bool) error {
+	s, err := openIPAMStore(n)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read IPAM store: %v", err)
+	}
+	for _, f := range files {
+		path := filepath.Join(s.dir, f.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil || valid[strings.TrimSpace(string(b))] {
+			continue
+		}
+		logrus.Infof("rancher-cni-bridge: releasing %v leaked by %s", f.Name(), b)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to release %v: %v", f.Name(), err)
+		}
+	}
+	return nil
+}
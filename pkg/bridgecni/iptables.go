@@ -0,0 +1,142 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/rancher/rancher-cni-bridge/internal/firewall"
+)
+
+// setupDSCP marks all traffic sent by the container with the given
+// DSCP code point
+func setupDSCP(ipn *net.IPNet, dscp int, comment string) error {
+	ipt, err := ops.IPTables()
+	if err != nil {
+		return err
+	}
+	if err := firewall.Append(ipt, []firewall.Rule{firewall.DSCPRule(ipn, dscp, comment)}); err != nil {
+		return fmt.Errorf("failed to add DSCP rule for %v: %v", ipn.IP, err)
+	}
+	return nil
+}
+
+// teardownDSCP removes the rule added by setupDSCP
+func teardownDSCP(ipn *net.IPNet, dscp int, comment string) error {
+	ipt, err := ops.IPTables()
+	if err != nil {
+		return err
+	}
+	if err := firewall.Delete(ipt, []firewall.Rule{firewall.DSCPRule(ipn, dscp, comment)}); err != nil {
+		return fmt.Errorf("failed to remove DSCP rule for %v: %v", ipn.IP, err)
+	}
+	return nil
+}
+
+// setupMark marks all traffic sent by the container
+func setupMark(ipn *net.IPNet, mark string, comment string) error {
+	ipt, err := ops.IPTables()
+	if err != nil {
+		return err
+	}
+	if err := firewall.Append(ipt, []firewall.Rule{firewall.MarkRule(ipn, mark, comment)}); err != nil {
+		return fmt.Errorf("failed to add mark rule for %v: %v", ipn.IP, err)
+	}
+	return nil
+}
+
+// teardownMark removes the rule added by setupMark
+func teardownMark(ipn *net.IPNet, mark string, comment string) error {
+	ipt, err := ops.IPTables()
+	if err != nil {
+		return err
+	}
+	if err := firewall.Delete(ipt, []firewall.Rule{firewall.MarkRule(ipn, mark, comment)}); err != nil {
+		return fmt.Errorf("failed to remove mark rule for %v: %v", ipn.IP, err)
+	}
+	return nil
+}
+
+// setupConnLimit caps the connections of the container, ahead of any
+// rule accepting forwarded traffic
+func setupConnLimit(ip net.IP, limit int, comment string) error {
+	ipt, err := ops.IPTables()
+	if err != nil {
+		return err
+	}
+	if err := firewall.Insert(ipt, firewall.ConnLimitRules(ip, limit, comment)); err != nil {
+		return fmt.Errorf("failed to add connection limit for %v: %v", ip, err)
+	}
+	return nil
+}
+
+// teardownConnLimit removes the rules added by setupConnLimit
+func teardownConnLimit(ip net.IP, limit int, comment string) error {
+	ipt, err := ops.IPTables()
+	if err != nil {
+		return err
+	}
+	if err := firewall.Delete(ipt, firewall.ConnLimitRules(ip, limit, comment)); err != nil {
+		return fmt.Errorf("failed to remove connection limit for %v: %v", ip, err)
+	}
+	return nil
+}
+
+// mssClamp is what clampMSS/clampMSSTo clamp the MSS of forwarded
+// connections to, as firewall.MSSClampRules takes it, "" for nothing
+func mssClamp(n *NetConf) string {
+	switch {
+	case n.ClampMSS:
+		return firewall.MSSClampPMTU
+	case n.ClampMSSTo != 0:
+		return strconv.Itoa(n.ClampMSSTo)
+	}
+	return ""
+}
+
+// setupMSSClamp installs the MSS clamping rules of the bridge
+func setupMSSClamp(brName, clamp string) error {
+	ipt, err := ops.IPTables()
+	if err != nil {
+		return err
+	}
+	if err := firewall.Append(ipt, firewall.MSSClampRules(brName, clamp)); err != nil {
+		return fmt.Errorf("failed to add MSS clamping rule for %v: %v", brName, err)
+	}
+	return nil
+}
+
+// setupConntrackZone installs the conntrack zone rules of the bridge
+func setupConntrackZone(brName string, zone int) error {
+	ipt, err := ops.IPTables()
+	if err != nil {
+		return err
+	}
+	if err := firewall.Append(ipt, firewall.ConntrackZoneRules(brName, zone)); err != nil {
+		return fmt.Errorf("failed to set conntrack zone of %v: %v", brName, err)
+	}
+	return nil
+}
+
+// teardownBridgeRules removes the rules set up for the bridge as a whole
+func teardownBridgeRules(n *NetConf) error {
+	var rules []firewall.Rule
+	if clamp := mssClamp(n); clamp != "" {
+		rules = append(rules, firewall.MSSClampRules(n.BrName, clamp)...)
+	}
+	if n.ConntrackZone != 0 {
+		rules = append(rules, firewall.ConntrackZoneRules(n.BrName, n.ConntrackZone)...)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	ipt, err := ops.IPTables()
+	if err != nil {
+		return err
+	}
+	if err := firewall.Delete(ipt, rules); err != nil {
+		return fmt.Errorf("failed to remove rule of %v: %v", n.BrName, err)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package bridgecni
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// IPv6SysctlConf pins the per interface IPv6 sysctls, so behaviour doesn't
+// depend on the host wide defaults. Unset ones are left alone.
+type IPv6SysctlConf struct {
+	// AcceptRA is 0, 1 or 2 as in net.ipv6.conf.<if>.accept_ra
+	AcceptRA   *int  `json:"acceptRA"`
+	Autoconf   *bool `json:"autoconf"`
+	Forwarding *bool `json:"forwarding"`
+}
+
+func (c *IPv6SysctlConf) validate() error {
+	if c.AcceptRA != nil && (*c.AcceptRA < 0 || *c.AcceptRA > 2) {
+		return fmt.Errorf("invalid acceptRA %v, must be 0, 1 or 2", *c.AcceptRA)
+	}
+	return nil
+}
+
+// setIPv6Sysctls applies c to ifName in the netns of the calling thread
+func setIPv6Sysctls(ifName string, c *IPv6SysctlConf) error {
+	values := map[string]string{}
+	if c.AcceptRA != nil {
+		values["accept_ra"] = strconv.Itoa(*c.AcceptRA)
+	}
+	if c.Autoconf != nil {
+		values["autoconf"] = boolSysctl(*c.Autoconf)
+	}
+	if c.Forwarding != nil {
+		values["forwarding"] = boolSysctl(*c.Forwarding)
+	}
+
+	for name, value := range values {
+		path := filepath.Join(procSys, "net/ipv6/conf", ifName, name)
+		if err := writeSysfs(path, value); err != nil {
+			return fmt.Errorf("failed to set %v of %q: %v", name, ifName, err)
+		}
+	}
+	return nil
+}
+
+// defaultDADTransmits is the number of neighbour solicitations DAD sends,
+// the kernel default
+const defaultDADTransmits = 1
+
+// setDAD turns duplicate address detection on ifName on or off, in the
+// netns of the calling thread. It has to happen while the link is down
+// to cover its link-local address too.
+func setDAD(ifName string, enable bool) error {
+	transmits := 0
+	if enable {
+		transmits = defaultDADTransmits
+	}
+	values := []struct {
+		name, value string
+	}{
+		{"accept_dad", boolSysctl(enable)},
+		{"dad_transmits", strconv.Itoa(transmits)},
+	}
+	for _, v := range values {
+		path := filepath.Join(procSys, "net/ipv6/conf", ifName, v.name)
+		if err := writeSysfs(path, v.value); err != nil {
+			return fmt.Errorf("failed to set %v of %q: %v", v.name, ifName, err)
+		}
+	}
+	return nil
+}
+
+// IPv6 address generation modes of the container interface
+const (
+	ipv6AddrGenEUI64         = "eui64"
+	ipv6AddrGenStablePrivacy = "stable-privacy"
+	ipv6AddrGenToken         = "token"
+)
+
+// addrGenModes are the addr_gen_mode values of the modes. A token
+// replaces the EUI-64 interface identifier of autoconfigured addresses.
+var addrGenModes = map[string]string{
+	ipv6AddrGenEUI64:         "0",
+	ipv6AddrGenStablePrivacy: "2",
+	ipv6AddrGenToken:         "0",
+}
+
+// IFLA_INET6_TOKEN, missing from the vendored netlink
+const iflaInet6Token = 7
+
+// validateIPv6AddrGen checks mode and, for token mode, token: the
+// interface identifier in the lower 64 bits, e.g. "::1:2:3:4"
+func validateIPv6AddrGen(mode, token string) error {
+	if _, ok := addrGenModes[mode]; !ok {
+		return fmt.Errorf("unsupported ipv6AddrGen %q, must be eui64, stable-privacy or token", mode)
+	}
+	if token == "" {
+		return nil
+	}
+	if mode != ipv6AddrGenToken {
+		return fmt.Errorf("ipv6Token needs ipv6AddrGen token")
+	}
+	ip := net.ParseIP(token)
+	if ip == nil || ip.To4() != nil || ip.IsUnspecified() || !ip.Mask(net.CIDRMask(64, 128)).IsUnspecified() {
+		return fmt.Errorf("invalid ipv6Token %q, must be an IPv6 address with only the lower 64 bits set", token)
+	}
+	return nil
+}
+
+// containerIPv6Token is token, or an interface identifier derived from
+// the container ID so the container keeps its addresses across restarts
+func containerIPv6Token(containerID, token string) net.IP {
+	if token != "" {
+		return net.ParseIP(token)
+	}
+	sum := sha1.Sum([]byte(containerID))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip[8:], sum[:8])
+	return ip
+}
+
+// setIPv6AddrGen sets the address generation mode of ifName in the netns
+// of the calling thread. Like setDAD it has to happen while the link is
+// down to cover its link-local address.
+func setIPv6AddrGen(ifName, containerID, mode, token string) error {
+	dir := filepath.Join(procSys, "net/ipv6/conf", ifName)
+	if mode == ipv6AddrGenStablePrivacy {
+		// container interfaces share name and prefix, so a shared secret
+		// would give them all the same addresses
+		sum := sha1.Sum([]byte("stable-secret/" + containerID))
+		secret := net.IP(sum[:net.IPv6len])
+		if err := writeSysfs(filepath.Join(dir, "stable_secret"), secret.String()); err != nil {
+			return fmt.Errorf("failed to set stable_secret of %q: %v", ifName, err)
+		}
+	}
+	if err := writeSysfs(filepath.Join(dir, "addr_gen_mode"), addrGenModes[mode]); err != nil {
+		return fmt.Errorf("failed to set addr_gen_mode of %q: %v", ifName, err)
+	}
+	if mode == ipv6AddrGenToken {
+		return setIPv6Token(ifName, containerIPv6Token(containerID, token))
+	}
+	return nil
+}
+
+// setIPv6Token sets the token of ifName, as "ip token set" does
+func setIPv6Token(ifName string, token net.IP) error {
+	link, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	req := nl.NewNetlinkRequest(syscall.RTM_SETLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_INET6)
+	msg.Index = int32(link.Index)
+	req.AddData(msg)
+	afSpec := nl.NewRtAttr(nl.IFLA_AF_SPEC, nil)
+	inet6 := nl.NewRtAttrChild(afSpec, syscall.AF_INET6, nil)
+	nl.NewRtAttrChild(inet6, iflaInet6Token, token.To16())
+	req.AddData(afSpec)
+	if _, err := req.Execute(syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to set IPv6 token %v of %q: %v", token, ifName, err)
+	}
+	return nil
+}
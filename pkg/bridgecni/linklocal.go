@@ -0,0 +1,31 @@
+package bridgecni
+
+import (
+	"hash/fnv"
+	"net"
+
+	"github.com/rancher/rancher-cni-bridge/internal/ipconfig"
+)
+
+// linkLocalAddr derives a stable 169.254/16 address for the container
+// interface from its ID. Only 169.254.1.0 - 169.254.254.255 are usable
+// (RFC 3927), and the addresses the plugin routes to itself are skipped.
+func linkLocalAddr(containerID, ifName string) *net.IPNet {
+	h := fnv.New32a()
+	h.Write([]byte(containerID + "-" + ifName))
+	i := h.Sum32() % (254 * 256)
+
+	for {
+		ip := net.IPv4(169, 254, byte(1+i/256), byte(i%256))
+		if !ip.Equal(routedGateway) && ip.String()+"/32" != metadataAddress {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(16, 32)}
+		}
+		i = (i + 1) % (254 * 256)
+	}
+}
+
+// addLinkLocalAddr assigns the link-local address of the container as a
+// secondary address of ifName
+func addLinkLocalAddr(h nlHandle, ifName, containerID string) error {
+	return ipconfig.AddLinkLocalAddr(h, ifName, linkLocalAddr(containerID, ifName))
+}
@@ -0,0 +1,155 @@
+package bridgecni
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	ethPLLDP = 0x88cc
+
+	defaultLLDPTTL = 120
+
+	lldpTLVEnd         = 0
+	lldpTLVChassisID   = 1
+	lldpTLVPortID      = 2
+	lldpTLVTTL         = 3
+	lldpTLVPortDesc    = 4
+	lldpTLVSystemName  = 5
+	lldpTLVOrgSpecific = 127
+
+	lldpSubtypeLocal = 7
+)
+
+// nearest bridge group address, not forwarded by 802.1D bridges
+var lldpMulticast = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+// 802.1 organizationally specific TLVs
+var lldpOUI8021 = []byte{0x00, 0x80, 0xc2}
+
+// LLDPConf makes the plugin announce the container ports on the uplink
+// so network inventory tools see them. TTL is in seconds.
+type LLDPConf struct {
+	TTL int `json:"ttl"`
+}
+
+// lldpTLV encodes one TLV, 7 bits type and 9 bits length
+func lldpTLV(typ int, value []byte) []byte {
+	b := make([]byte, 2, 2+len(value))
+	binary.BigEndian.PutUint16(b, uint16(typ)<<9|uint16(len(value)))
+	return append(b, value...)
+}
+
+// lldpFrame builds the LLDPDU describing a container port. The chassis is
+// the host, the port the host veth, so every container shows up as a
+// neighbour of its own on the switch port of the uplink.
+func lldpFrame(src net.HardwareAddr, host string, a *attachment, vlan, ttl int) []byte {
+	frame := append([]byte{}, lldpMulticast...)
+	frame = append(frame, src...)
+	frame = append(frame, byte(ethPLLDP>>8), byte(ethPLLDP&0xff))
+
+	ttlb := make([]byte, 2)
+	binary.BigEndian.PutUint16(ttlb, uint16(ttl))
+
+	frame = append(frame, lldpTLV(lldpTLVChassisID, append([]byte{lldpSubtypeLocal}, host...))...)
+	frame = append(frame, lldpTLV(lldpTLVPortID, append([]byte{lldpSubtypeLocal}, a.HostVeth...))...)
+	frame = append(frame, lldpTLV(lldpTLVTTL, ttlb)...)
+	desc := fmt.Sprintf("container %.12s %v", a.ContainerID, a.IfName)
+	if a.MAC != "" {
+		desc += " " + a.MAC
+	}
+	frame = append(frame, lldpTLV(lldpTLVPortDesc, []byte(desc))...)
+	frame = append(frame, lldpTLV(lldpTLVSystemName, []byte(host))...)
+	if vlan > 0 {
+		// port VLAN ID
+		v := append(append([]byte{}, lldpOUI8021...), 1, byte(vlan>>8), byte(vlan&0xff))
+		frame = append(frame, lldpTLV(lldpTLVOrgSpecific, v)...)
+	}
+	return append(frame, lldpTLV(lldpTLVEnd, nil)...)
+}
+
+// htons converts to network byte order for the packet socket protocol
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// sendLLDP announces the container port of a on the uplink of n. A ttl
+// of 0 tells the neighbours to forget it right away.
+func sendLLDP(n *NetConf, a *attachment, ttl int) error {
+	uplinkName := uplinkName(n)
+	if uplinkName == "" || a.HostVeth == "" {
+		return nil
+	}
+	uplink, err := ops.Host().LinkByName(uplinkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup uplink %q: %v", uplinkName, err)
+	}
+	host, _ := os.Hostname()
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPLLDP)))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	to := &syscall.SockaddrLinklayer{
+		Protocol: htons(ethPLLDP),
+		Ifindex:  uplink.Attrs().Index,
+		Halen:    6,
+	}
+	copy(to.Addr[:], lldpMulticast)
+	frame := lldpFrame(uplink.Attrs().HardwareAddr, host, a, n.VLAN, ttl)
+	if err = syscall.Sendto(fd, frame, 0, to); err != nil {
+		return fmt.Errorf("failed to send LLDP on %v: %v", uplinkName, err)
+	}
+	return nil
+}
+
+// announceLLDP announces or withdraws the container port of a, without
+// ever failing the operation over it
+func announceLLDP(n *NetConf, a *attachment, withdraw bool) {
+	if n.LLDP == nil || a == nil {
+		return
+	}
+	ttl := n.LLDP.TTL
+	if withdraw {
+		ttl = 0
+	}
+	if err := sendLLDP(n, a, ttl); err != nil {
+		logrus.Errorf("rancher-cni-bridge: %v", err)
+	}
+}
+
+// reannounceLLDP repeats the announcements of all container ports of the
+// remembered networks with LLDP, so they don't age out on the switches
+func (w *bridgeWatcher) reannounceLLDP() {
+	for {
+		interval := defaultLLDPTTL
+		w.mu.Lock()
+		for _, n := range w.lldp {
+			if n.LLDP.TTL < interval {
+				interval = n.LLDP.TTL
+			}
+			as, err := listAttachments(n)
+			if err != nil {
+				logrus.Errorf("rancher-cni-bridge: %v", err)
+				continue
+			}
+			for _, a := range as {
+				if a.Bridge == n.BrName {
+					announceLLDP(n, a, false)
+				}
+			}
+		}
+		w.mu.Unlock()
+
+		// well within the TTL, as LLDP agents do
+		time.Sleep(time.Duration(interval) * time.Second / 4)
+	}
+}
@@ -0,0 +1,169 @@
+package bridgecni
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	logIdentifier  = "rancher-cni-bridge"
+	journaldSocket = "/run/systemd/journal/socket"
+)
+
+// setupLogging applies the log level, file and hooks of n for one
+// request. It returns what restores the level and output from before,
+// so in the daemon later requests don't inherit them.
+func setupLogging(n *NetConf) func() {
+	logger := logrus.StandardLogger()
+	level, out := logrus.GetLevel(), logger.Out
+
+	if n.IsDebugLevel == "true" {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	var f *os.File
+	if n.LogToFile != "" {
+		var err error
+		if f, err = os.OpenFile(n.LogToFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666); err == nil {
+			logrus.SetOutput(f)
+		}
+	}
+
+	setupLogHooks(n)
+
+	return func() {
+		logrus.SetLevel(level)
+		if f != nil {
+			logrus.SetOutput(out)
+			f.Close()
+		}
+	}
+}
+
+// installed log hooks by target, so the daemon doesn't stack up one
+// hook per request
+var logHooks = map[string]bool{}
+
+// setupLogHooks sends log entries to syslog and/or journald in addition
+// to the regular output, as configured
+func setupLogHooks(n *NetConf) {
+	if n.LogToSyslog && !logHooks["syslog"] {
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, logIdentifier)
+		if err != nil {
+			logrus.Errorf("rancher-cni-bridge: failed to connect to syslog: %v", err)
+		} else {
+			logrus.AddHook(&syslogHook{w: w})
+			logHooks["syslog"] = true
+		}
+	}
+
+	if n.LogToJournald && !logHooks["journald"] {
+		conn, err := net.Dial("unixgram", journaldSocket)
+		if err != nil {
+			logrus.Errorf("rancher-cni-bridge: failed to connect to journald: %v", err)
+		} else {
+			logrus.AddHook(&journaldHook{conn: conn})
+			logHooks["journald"] = true
+		}
+	}
+}
+
+// syslogHook forwards log entries to the local syslog daemon
+type syslogHook struct {
+	w *syslog.Writer
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	msg := entry.Message
+	switch entry.Level {
+	case logrus.PanicLevel:
+		return h.w.Crit(msg)
+	case logrus.FatalLevel:
+		return h.w.Crit(msg)
+	case logrus.ErrorLevel:
+		return h.w.Err(msg)
+	case logrus.WarnLevel:
+		return h.w.Warning(msg)
+	case logrus.InfoLevel:
+		return h.w.Info(msg)
+	default:
+		return h.w.Debug(msg)
+	}
+}
+
+// journaldHook writes log entries to journald using its native protocol,
+// which keeps the priority and allows multi-line messages
+type journaldHook struct {
+	conn net.Conn
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	var priority syslog.Priority
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		priority = syslog.LOG_CRIT
+	case logrus.ErrorLevel:
+		priority = syslog.LOG_ERR
+	case logrus.WarnLevel:
+		priority = syslog.LOG_WARNING
+	case logrus.InfoLevel:
+		priority = syslog.LOG_INFO
+	default:
+		priority = syslog.LOG_DEBUG
+	}
+
+	buf := &bytes.Buffer{}
+	writeJournalField(buf, "PRIORITY", fmt.Sprintf("%d", priority))
+	writeJournalField(buf, "SYSLOG_IDENTIFIER", logIdentifier)
+	writeJournalField(buf, "MESSAGE", entry.Message)
+	for k, v := range entry.Data {
+		writeJournalField(buf, journalFieldName(k), fmt.Sprint(v))
+	}
+
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+// writeJournalField encodes one field; values containing a newline use
+// the length prefixed binary form
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	buf.WriteString(key)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName turns a logrus field name into a valid journal field
+// name, which may only hold upper case letters, digits and underscores
+func journalFieldName(k string) string {
+	return "CNI_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, k)
+}
@@ -0,0 +1,113 @@
+package bridgecni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const (
+	defaultMetadataURL = "http://rancher-metadata/2015-12-19"
+	metadataTimeout    = 5 * time.Second
+
+	// where rancher-metadata and Rancher DNS answer on every host
+	metadataAddress = "169.254.169.250/32"
+)
+
+// metadataContainer is the part of a rancher-metadata container record
+// the plugin cares about
+type metadataContainer struct {
+	UUID              string            `json:"uuid"`
+	Name              string            `json:"name"`
+	HostUUID          string            `json:"host_uuid"`
+	EnvironmentUUID   string            `json:"environment_uuid"`
+	PrimaryIP         string            `json:"primary_ip"`
+	PrimaryMacAddress string            `json:"primary_mac_address"`
+	ServiceName       string            `json:"service_name"`
+	StackName         string            `json:"stack_name"`
+	Labels            map[string]string `json:"labels"`
+	DNS               []string          `json:"dns"`
+	DNSSearch         []string          `json:"dns_search"`
+}
+
+// metadataHost is the part of a rancher-metadata host record the plugin
+// cares about
+type metadataHost struct {
+	UUID    string `json:"uuid"`
+	AgentIP string `json:"agent_ip"`
+}
+
+// getMetadata fetches path from rancher-metadata and decodes the JSON
+// answer into v
+func getMetadata(baseURL, path string, v interface{}) error {
+	if baseURL == "" {
+		baseURL = defaultMetadataURL
+	}
+	url := strings.TrimRight(baseURL, "/") + "/" + strings.TrimLeft(path, "/")
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{Timeout: metadataTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query metadata %v: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("metadata %v returned %v", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode metadata %v: %v", url, err)
+	}
+	return nil
+}
+
+// metadataContainers returns all containers known to rancher-metadata
+// and the one with the given UUID among them
+func metadataContainers(baseURL, containerUUID string) (*metadataContainer, []metadataContainer, error) {
+	var containers []metadataContainer
+	if err := getMetadata(baseURL, "containers", &containers); err != nil {
+		return nil, nil, err
+	}
+	for i := range containers {
+		if containers[i].UUID == containerUUID {
+			return &containers[i], containers, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("container %v not found in metadata", containerUUID)
+}
+
+// addMetadataRoute adds the route to the metadata address via the bridge
+// to ipc, unless IPAM routes it already
+func addMetadataRoute(n *NetConf, ipc *types.IPConfig) error {
+	_, dst, _ := net.ParseCIDR(metadataAddress)
+	for _, r := range ipc.Routes {
+		if r.Dst.String() == dst.String() {
+			return nil
+		}
+	}
+
+	gw := ipc.Gateway
+	if gw == nil {
+		if n.BrSubnet == "" {
+			return fmt.Errorf("metadataRoute needs a gateway, a bridgeSubnet or isGateway")
+		}
+		brIP, err := calculateBridgeIP(n)
+		if err != nil {
+			return err
+		}
+		gw = brIP.IP
+	}
+	ipc.Routes = append(ipc.Routes, types.Route{Dst: *dst, GW: gw})
+	return nil
+}
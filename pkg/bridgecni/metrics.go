@@ -0,0 +1,71 @@
+package bridgecni
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const defaultMetricsPrefix = "rancher_cni_bridge"
+
+// emitMetrics sends a counter and a timer for the operation to the
+// configured StatsD endpoint. This is fire and forget over UDP, so it
+// never slows down or fails the operation. OpenTelemetry collectors can
+// ingest these through their statsd receiver.
+func emitMetrics(n *NetConf, command string, opErr error, start time.Time) {
+	if n.StatsdAddress == "" {
+		return
+	}
+
+	prefix := n.MetricsPrefix
+	if prefix == "" {
+		prefix = defaultMetricsPrefix
+	}
+	op := strings.ToLower(command)
+	status := "success"
+	if opErr != nil {
+		status = "failure"
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s.%s.%s:1|c\n", prefix, op, status)
+	fmt.Fprintf(buf, "%s.%s.duration:%d|ms\n", prefix, op, time.Since(start)/time.Millisecond)
+	sendStatsd(n, buf.Bytes())
+}
+
+// emitStats adds the lifetime traffic of a deleted interface to the
+// per network traffic counters
+func emitStats(n *NetConf, s *ifStats) {
+	if n.StatsdAddress == "" || s == nil {
+		return
+	}
+
+	prefix := n.MetricsPrefix
+	if prefix == "" {
+		prefix = defaultMetricsPrefix
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s.traffic.%s.rx_bytes:%d|c\n", prefix, n.Name, s.RxBytes)
+	fmt.Fprintf(buf, "%s.traffic.%s.tx_bytes:%d|c\n", prefix, n.Name, s.TxBytes)
+	fmt.Fprintf(buf, "%s.traffic.%s.rx_packets:%d|c\n", prefix, n.Name, s.RxPackets)
+	fmt.Fprintf(buf, "%s.traffic.%s.tx_packets:%d|c\n", prefix, n.Name, s.TxPackets)
+	sendStatsd(n, buf.Bytes())
+}
+
+func sendStatsd(n *NetConf, b []byte) {
+	conn, err := net.Dial("udp", n.StatsdAddress)
+	if err != nil {
+		logrus.Debugf("rancher-cni-bridge: failed to reach statsd at %v: %v", n.StatsdAddress, err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(b); err != nil {
+		logrus.Debugf("rancher-cni-bridge: failed to send metrics: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package bridgecni
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// uplinkName is the device container traffic leaves the host through,
+// if known
+func uplinkName(n *NetConf) string {
+	switch {
+	case n.Bond != nil:
+		return n.Bond.Name
+	case n.Uplink != "":
+		return n.Uplink
+	case n.VXLAN != nil:
+		return n.VXLAN.Device
+	case n.Mode == modeSRIOV:
+		return n.PF
+	}
+	return ""
+}
+
+// validateMTU makes sure the configured MTU fits through the uplink, as
+// a container with a bigger MTU silently loses its large packets. With
+// clampMTU it is lowered to the uplink MTU instead of failing.
+func validateMTU(n *NetConf) error {
+	uplink := uplinkName(n)
+	if n.MTU == 0 || uplink == "" {
+		return nil
+	}
+
+	link, err := ops.Host().LinkByName(uplink)
+	if err != nil && n.Bond != nil {
+		// the bond gets created with the mtu, its slaves follow it
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lookup uplink %q: %v", uplink, err)
+	}
+	max := link.Attrs().MTU
+	if n.MTU <= max {
+		return nil
+	}
+
+	if !n.ClampMTU {
+		return fmt.Errorf("mtu %v exceeds the MTU %v of uplink %q, larger packets would be dropped", n.MTU, max, uplink)
+	}
+	logrus.Warnf("rancher-cni-bridge: clamping mtu %v to the MTU %v of uplink %q", n.MTU, max, uplink)
+	n.MTU = max
+	return nil
+}
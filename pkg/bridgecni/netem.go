@@ -0,0 +1,82 @@
+package bridgecni
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// NetemConf injects faults into the traffic towards a container for
+// chaos testing. Latency and jitter are in milliseconds, loss in percent.
+type NetemConf struct {
+	Latency int     `json:"latency"`
+	Jitter  int     `json:"jitter"`
+	Loss    float64 `json:"loss"`
+}
+
+func (c *NetemConf) validate() error {
+	if c.Latency < 0 || c.Jitter < 0 {
+		return fmt.Errorf("netem latency and jitter must not be negative")
+	}
+	if c.Jitter > 0 && c.Latency == 0 {
+		return fmt.Errorf("netem jitter needs a latency")
+	}
+	if c.Loss < 0 || c.Loss > 100 {
+		return fmt.Errorf("invalid netem loss %v, must be between 0 and 100", c.Loss)
+	}
+	return nil
+}
+
+// netemConf returns the netem settings of the container: the
+// NetemLatency, NetemJitter and NetemLoss CNI_ARGS override those of
+// runtimeConfig. nil means no fault injection.
+func netemConf(n *NetConf, nArgs *NetArgs) (*NetemConf, error) {
+	c := &NetemConf{}
+	if n.RuntimeConfig.Netem != nil {
+		*c = *n.RuntimeConfig.Netem
+	}
+
+	var err error
+	if nArgs.NetemLatency != "" {
+		if c.Latency, err = strconv.Atoi(string(nArgs.NetemLatency)); err != nil {
+			return nil, fmt.Errorf("invalid NetemLatency %q", nArgs.NetemLatency)
+		}
+	}
+	if nArgs.NetemJitter != "" {
+		if c.Jitter, err = strconv.Atoi(string(nArgs.NetemJitter)); err != nil {
+			return nil, fmt.Errorf("invalid NetemJitter %q", nArgs.NetemJitter)
+		}
+	}
+	if nArgs.NetemLoss != "" {
+		if c.Loss, err = strconv.ParseFloat(string(nArgs.NetemLoss), 64); err != nil {
+			return nil, fmt.Errorf("invalid NetemLoss %q", nArgs.NetemLoss)
+		}
+	}
+
+	if *c == (NetemConf{}) {
+		return nil, nil
+	}
+	return c, c.validate()
+}
+
+// setupNetem makes netem the root qdisc of the host veth, delaying and
+// dropping what the container receives
+func setupNetem(hostVethName string, c *NetemConf) error {
+	args := []string{"qdisc", "replace", "dev", hostVethName, "root", "netem"}
+	if c.Latency > 0 {
+		args = append(args, "delay", fmt.Sprintf("%dms", c.Latency))
+		if c.Jitter > 0 {
+			args = append(args, fmt.Sprintf("%dms", c.Jitter))
+		}
+	}
+	if c.Loss > 0 {
+		args = append(args, "loss", strconv.FormatFloat(c.Loss, 'f', -1, 64)+"%")
+	}
+	if err := runTC(args...); err != nil {
+		return fmt.Errorf("failed to set netem qdisc on %v: %v", hostVethName, err)
+	}
+
+	logrus.Infof("rancher-cni-bridge: injecting %vms±%vms latency and %v%% loss on %v", c.Latency, c.Jitter, c.Loss, hostVethName)
+	return nil
+}
@@ -0,0 +1,73 @@
+package bridgecni
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/ns"
+)
+
+// NS_GET_NSTYPE from linux/nsfs.h, Linux 4.11 and later
+const nsGetNSType = 0xb703
+
+// resolveNetnsPath turns the netns references runtimes hand over into a
+// path: a bare PID means /proc/<pid>/ns/net, paths (bind mounts,
+// /proc/<pid>/ns/net, /proc/self/fd/<n>, /dev/fd/<n>) are used as is
+func resolveNetnsPath(ref string) string {
+	if pid, err := strconv.Atoi(ref); err == nil && pid > 0 {
+		return fmt.Sprintf("/proc/%d/ns/net", pid)
+	}
+	return ref
+}
+
+// netnsForPid rewrites an fd reference of this process, /proc/self/fd/<n>
+// or /dev/fd/<n>, into /proc/<pid>/fd/<n>, which still points at our fd
+// when opened by another process like the daemon
+func netnsForPid(ref string, pid int) string {
+	for _, prefix := range []string{"/proc/self/fd/", "/dev/fd/"} {
+		if !strings.HasPrefix(ref, prefix) {
+			continue
+		}
+		if fd, err := strconv.Atoi(strings.TrimPrefix(ref, prefix)); err == nil && fd >= 0 {
+			return fmt.Sprintf("/proc/%d/fd/%d", pid, fd)
+		}
+	}
+	return ref
+}
+
+// openNetNS opens the netns referenced by ref, making sure it really is
+// a network namespace and not some other kind
+func openNetNS(ref string) (ns.NetNS, error) {
+	netns, err := ns.GetNS(resolveNetnsPath(ref))
+	if err != nil {
+		return nil, err
+	}
+
+	nstype, _, errno := syscall.Syscall(syscall.SYS_IOCTL, netns.Fd(), nsGetNSType, 0)
+	// older kernels can't tell, trust the path then
+	if errno == 0 && nstype != syscall.CLONE_NEWNET {
+		netns.Close()
+		return nil, fmt.Errorf("%q is not a network namespace", ref)
+	}
+	return netns, nil
+}
+
+// sameNetns tells whether two netns references point at the same
+// namespace, e.g. a bind mount and /proc/<pid>/ns/net of one container
+func sameNetns(a, b string) bool {
+	if a == b {
+		return true
+	}
+	sa, err := os.Stat(resolveNetnsPath(a))
+	if err != nil {
+		return false
+	}
+	sb, err := os.Stat(resolveNetnsPath(b))
+	if err != nil {
+		return false
+	}
+	return os.SameFile(sa, sb)
+}
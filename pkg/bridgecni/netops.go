@@ -0,0 +1,201 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/rancher/rancher-cni-bridge/internal/firewall"
+	"github.com/vishvananda/netlink"
+	vnetns "github.com/vishvananda/netns"
+)
+
+// nlHandle is the subset of netlink operations used by the plugin, plus
+// the few the vendored netlink library can't express
+type nlHandle interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetDown(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	LinkSetName(link netlink.Link, name string) error
+	LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error
+	LinkSetMaster(link netlink.Link, master *netlink.Bridge) error
+	LinkSetMasterByIndex(link netlink.Link, masterIndex int) error
+	LinkSetHairpin(link netlink.Link, mode bool) error
+	LinkSetNsFd(link netlink.Link, fd int) error
+	LinkSetVfHardwareAddr(link netlink.Link, vf int, hwaddr net.HardwareAddr) error
+	LinkSetVfVlan(link netlink.Link, vf, vlan int) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	NeighList(linkIndex, family int) ([]netlink.Neigh, error)
+	NeighSet(neigh *netlink.Neigh) error
+	NeighDel(neigh *netlink.Neigh) error
+	Delete()
+
+	// LinkSetPromiscOn puts the link into promiscuous mode
+	LinkSetPromiscOn(link netlink.Link) error
+	// LinkAddVRF creates a VRF device routing with the given table
+	LinkAddVRF(name string, table int) error
+	// VethAddMultiQueue creates a veth pair with txQueues and rxQueues
+	// on both ends
+	VethAddMultiQueue(name, peerName string, mtu, txQueues, rxQueues int) error
+	// RouteReplace adds or replaces the route given as ip route
+	// arguments, which can carry metrics netlink.Route can't
+	RouteReplace(spec []string) error
+	// TC runs tc with the given arguments
+	TC(args ...string) error
+}
+
+// netOps abstracts the netlink, namespace and iptables operations the
+// plugin performs, so the bridge/veth/route logic can run against an
+// in-memory backend.
+type netOps interface {
+	// Host returns a netlink handle for the host netns
+	Host() nlHandle
+	// OpenNS opens the netns at the given path
+	OpenNS(path string) (ns.NetNS, error)
+	// NSHandle returns a netlink handle bound to the given netns
+	NSHandle(netns ns.NetNS) (nlHandle, error)
+	// IPTables returns a handle for manipulating IPv4 iptables rules
+	IPTables() (firewall.IPTables, error)
+	EnableIP4Forward() error
+	SetupIPMasq(ipn *net.IPNet, chain, comment string) error
+	TeardownIPMasq(ipn *net.IPNet, chain, comment string) error
+}
+
+// ops is the backend used by the plugin, swapped out for a fake in tests
+var ops netOps = &linuxOps{}
+
+// linuxOps is the real backend talking to the kernel
+type linuxOps struct{}
+
+func (*linuxOps) Host() nlHandle {
+	// a handle without sockets falls back to the package level
+	// netlink calls in the current netns
+	return &linuxHandle{Handle: &netlink.Handle{}}
+}
+
+func (*linuxOps) OpenNS(path string) (ns.NetNS, error) {
+	return openNetNS(path)
+}
+
+func (*linuxOps) NSHandle(netns ns.NetNS) (nlHandle, error) {
+	h, err := netlink.NewHandleAt(vnetns.NsHandle(netns.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get netlink handle for netns %q: %v", netns.Path(), err)
+	}
+	return &linuxHandle{Handle: h, netns: netns}, nil
+}
+
+func (*linuxOps) IPTables() (firewall.IPTables, error) {
+	ipt, err := iptables.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	return ipt, nil
+}
+
+func (*linuxOps) EnableIP4Forward() error {
+	return ip.EnableIP4Forward()
+}
+
+func (*linuxOps) SetupIPMasq(ipn *net.IPNet, chain, comment string) error {
+	return ip.SetupIPMasq(ipn, chain, comment)
+}
+
+// TeardownIPMasq undoes ip.SetupIPMasq. Unlike ip.TeardownIPMasq it
+// skips what is gone already, so a DEL that failed half way can be
+// repeated.
+func (o *linuxOps) TeardownIPMasq(ipn *net.IPNet, chain, comment string) error {
+	ipt, err := o.IPTables()
+	if err != nil {
+		return err
+	}
+	jump := firewall.Rule{Table: "nat", Chain: "POSTROUTING", Spec: []string{"-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment}}
+	return firewall.RemoveChain(ipt, "nat", chain, []firewall.Rule{jump})
+}
+
+// linuxHandle is the nlHandle of linuxOps. What the vendored netlink
+// library can't do goes through iproute2, run in the netns of the
+// handle.
+type linuxHandle struct {
+	*netlink.Handle
+	// netns is nil for the current netns
+	netns ns.NetNS
+}
+
+// run runs the iproute2 command name in the netns of h. A link or route
+// that exists already is reported as syscall.EEXIST.
+func (h *linuxHandle) run(name string, args ...string) error {
+	var out []byte
+	run := func(ns.NetNS) error {
+		var err error
+		out, err = exec.Command(name, args...).CombinedOutput()
+		return err
+	}
+
+	var err error
+	if h.netns == nil {
+		err = run(nil)
+	} else {
+		err = h.netns.Do(run)
+	}
+	if err != nil {
+		if strings.Contains(string(out), "File exists") {
+			return syscall.EEXIST
+		}
+		return fmt.Errorf("%v %v failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// LinkSetPromiscOn goes through ip, the vendored SetPromiscOn clears
+// the flag instead of setting it
+func (h *linuxHandle) LinkSetPromiscOn(link netlink.Link) error {
+	return h.run("ip", "link", "set", "dev", link.Attrs().Name, "promisc", "on")
+}
+
+func (h *linuxHandle) LinkAddVRF(name string, table int) error {
+	return h.run("ip", "link", "add", name, "type", "vrf", "table", strconv.Itoa(table))
+}
+
+func (h *linuxHandle) VethAddMultiQueue(name, peerName string, mtu, txQueues, rxQueues int) error {
+	var queues []string
+	if txQueues > 0 {
+		queues = append(queues, "numtxqueues", strconv.Itoa(txQueues))
+	}
+	if rxQueues > 0 {
+		queues = append(queues, "numrxqueues", strconv.Itoa(rxQueues))
+	}
+
+	args := []string{"link", "add", name}
+	if mtu > 0 {
+		args = append(args, "mtu", strconv.Itoa(mtu))
+	}
+	args = append(args, queues...)
+	args = append(args, "type", "veth", "peer", "name", peerName)
+	args = append(args, queues...)
+	return h.run("ip", args...)
+}
+
+func (h *linuxHandle) RouteReplace(spec []string) error {
+	return h.run("ip", append([]string{"route", "replace"}, spec...)...)
+}
+
+func (h *linuxHandle) TC(args ...string) error {
+	return h.run("tc", args...)
+}
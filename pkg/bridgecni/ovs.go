@@ -0,0 +1,85 @@
+package bridgecni
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	datapathLinux = "linux"
+	datapathOVS   = "ovs"
+)
+
+// ovsVsctl runs ovs-vsctl against the local ovsdb-server
+func ovsVsctl(args ...string) (string, error) {
+	out, err := exec.Command("ovs-vsctl", append([]string{"--timeout=10"}, args...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ovs-vsctl %v failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ensureOVSBridge creates the OVS bridge if necessary and returns the
+// link of its internal port
+func ensureOVSBridge(brName string, mtu int) (netlink.Link, error) {
+	if _, err := ovsVsctl("--may-exist", "add-br", brName); err != nil {
+		return nil, err
+	}
+
+	h := ops.Host()
+	br, err := h.LinkByName(brName)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup %q: %v", brName, err)
+	}
+
+	if mtu > 0 && br.Attrs().MTU != mtu {
+		if err := h.LinkSetMTU(br, mtu); err != nil {
+			return nil, fmt.Errorf("failed to set MTU of %q: %v", brName, err)
+		}
+	}
+
+	if err := h.LinkSetUp(br); err != nil {
+		return nil, err
+	}
+
+	return br, nil
+}
+
+// attachOVSPort adds the host veth as a port of the OVS bridge, tagging
+// the interface record so DEL can find it again once the veth is gone
+func attachOVSPort(brName, hostVethName, containerID, ifName string) error {
+	_, err := ovsVsctl(
+		"--may-exist", "add-port", brName, hostVethName,
+		"--", "set", "Interface", hostVethName,
+		fmt.Sprintf("external_ids:container_id=%s", containerID),
+		fmt.Sprintf("external_ids:if_name=%s", ifName),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add %q to OVS bridge %q: %v", hostVethName, brName, err)
+	}
+	return nil
+}
+
+// delOVSPort removes the OVS port created for the container interface
+func delOVSPort(brName, containerID, ifName string) error {
+	out, err := ovsVsctl(
+		"--bare", "--columns=name", "find", "Interface",
+		fmt.Sprintf("external_ids:container_id=%s", containerID),
+		fmt.Sprintf("external_ids:if_name=%s", ifName),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, port := range strings.Fields(out) {
+		logrus.Debugf("rancher-cni-bridge: removing port %v from OVS bridge %v", port, brName)
+		if _, err := ovsVsctl("--if-exists", "del-port", brName, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package bridgecni
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// errCodePanic is the CNI error code reported when the plugin panics,
+// in the range the spec leaves to plugins
+const errCodePanic = 100
+
+// recoverError turns a recovered panic value into a CNI error carrying
+// the stack trace, so the runtime gets a proper error instead of a
+// crashed plugin with garbage on stdout
+func recoverError(command string, r interface{}) *types.Error {
+	stack := string(debug.Stack())
+	logrus.Errorf("rancher-cni-bridge: %v panicked: %v\n%s", command, r, stack)
+	return &types.Error{
+		Code:    errCodePanic,
+		Msg:     fmt.Sprintf("%v panicked: %v", command, r),
+		Details: stack,
+	}
+}
+
+// withRecover wraps a skel command so a panic is reported as a CNI error
+func withRecover(command string, cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = recoverError(command, r)
+			}
+		}()
+		return cmd(args)
+	}
+}
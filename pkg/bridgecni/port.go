@@ -0,0 +1,142 @@
+package bridgecni
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/rancher-cni-bridge/internal/bridge"
+)
+
+// configureHostPort applies the per port settings to the host end of the
+// container veth once it has been attached to the bridge
+func configureHostPort(n *NetConf, nArgs *NetArgs, hostVethName string) error {
+	if err := setBrportOptions(n, nArgs, hostVethName); err != nil {
+		return err
+	}
+
+	if err := setQueueCPUs(hostVethName, n.RPSCPUs, n.XPSCPUs); err != nil {
+		return err
+	}
+
+	if n.Offloads != nil {
+		if err := setOffloads(hostVethName, n.Offloads); err != nil {
+			return err
+		}
+	}
+
+	if n.HostIPv6 != nil {
+		if err := setIPv6Sysctls(hostVethName, n.HostIPv6); err != nil {
+			return err
+		}
+	}
+
+	if n.HostARP != nil {
+		if err := setARPSysctls(hostVethName, n.HostARP); err != nil {
+			return err
+		}
+	}
+
+	if n.IgnoreRoutesWithLinkdown != nil {
+		if err := setIgnoreRoutesWithLinkdown(hostVethName, *n.IgnoreRoutesWithLinkdown); err != nil {
+			return err
+		}
+	}
+
+	if n.FqCodel {
+		if err := setupFqCodel(hostVethName); err != nil {
+			return err
+		}
+	}
+
+	// replaces fq_codel, both are root qdiscs
+	netem, err := netemConf(n, nArgs)
+	if err != nil {
+		return err
+	}
+	if netem != nil {
+		if err := setupNetem(hostVethName, netem); err != nil {
+			return err
+		}
+	}
+
+	mirrorTo := n.MirrorTo
+	if nArgs.MirrorTo != "" {
+		mirrorTo = string(nArgs.MirrorTo)
+	}
+	if mirrorTo != "" {
+		if err := setupMirror(hostVethName, mirrorTo); err != nil {
+			return err
+		}
+	}
+
+	if n.StormControlPPS > 0 {
+		if err := setupStormControl(hostVethName, n.StormControlPPS); err != nil {
+			return err
+		}
+	}
+
+	if n.ARPRateLimitPPS > 0 {
+		if err := setupARPLimit(hostVethName, n.ARPRateLimitPPS); err != nil {
+			return err
+		}
+	}
+
+	rate, burst := n.IngressRate, n.IngressBurst
+	if n.RuntimeConfig.IngressRate != 0 {
+		rate, burst = n.RuntimeConfig.IngressRate, n.RuntimeConfig.IngressBurst
+	} else if bw := n.RuntimeConfig.Bandwidth; bw != nil && bw.EgressRate != 0 {
+		// the capability counts bursts in bits
+		rate, burst = bw.EgressRate, bw.EgressBurst/8
+	}
+	if rate > 0 {
+		if err := setupIngressPolicing(hostVethName, rate, burst); err != nil {
+			return err
+		}
+	}
+
+	if n.BPF != nil {
+		if err := attachBPF(hostVethName, n.BPF); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setBrportOptions sets the bridge port flags of the host veth
+func setBrportOptions(n *NetConf, nArgs *NetArgs, hostVethName string) error {
+	isolated, err := boolArg("Isolated", nArgs.Isolated, n.Isolated)
+	if err != nil {
+		return err
+	}
+
+	// brport knobs to set, in order
+	brportOptions := []struct {
+		name    string
+		enabled bool
+		value   string
+	}{
+		{"isolated", isolated, "1"},
+		{"learning", n.StaticFDB, "0"},
+		{"unicast_flood", n.DisableUnicastFlood || n.StaticFDB, "0"},
+		{"multicast_flood", n.DisableMulticastFlood, "0"},
+	}
+
+	for _, o := range brportOptions {
+		if !o.enabled {
+			continue
+		}
+		if n.Datapath == datapathOVS || n.Mode == modeRouted {
+			if o.name == "isolated" {
+				return fmt.Errorf("isolated needs a linux bridge")
+			}
+			logrus.Warnf("rancher-cni-bridge: brport option %v needs a linux bridge, ignoring", o.name)
+			continue
+		}
+		if err := bridge.SetPortOption(hostVethName, o.name, o.value); err != nil {
+			return fmt.Errorf("failed to configure port %v: %v", hostVethName, err)
+		}
+		logrus.Debugf("rancher-cni-bridge: set %v=%v on port %v", o.name, o.value, hostVethName)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/utils"
+	"github.com/rancher/rancher-cni-bridge/internal/firewall"
+)
+
+const (
+	hostPortDNATChain = "CNI-HOSTPORT-DNAT"
+	hostPortSNATChain = "CNI-HOSTPORT-SNAT"
+)
+
+// PortMapping publishes a container port on the host
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP"`
+}
+
+func (p *PortMapping) validate() error {
+	if p.HostPort <= 0 || p.HostPort > 65535 || p.ContainerPort <= 0 || p.ContainerPort > 65535 {
+		return fmt.Errorf("invalid port mapping %v:%v", p.HostPort, p.ContainerPort)
+	}
+
+	p.Protocol = strings.ToLower(p.Protocol)
+	switch p.Protocol {
+	case "":
+		p.Protocol = "tcp"
+	case "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("unsupported port mapping protocol %q", p.Protocol)
+	}
+
+	if p.HostIP != "" && net.ParseIP(p.HostIP) == nil {
+		return fmt.Errorf("invalid port mapping hostIP %q", p.HostIP)
+	}
+	return nil
+}
+
+// hostPortChain returns the per container chain holding its DNAT rules
+func hostPortChain(n *NetConf, containerID string) string {
+	return utils.FormatChainName(n.Name+"-hostport", containerID)
+}
+
+// hairpinRule masquerades traffic a container sends to its own published
+// port, otherwise the reply would bypass the DNAT and be dropped
+func hairpinRule(ip net.IP, comment string) []string {
+	return []string{
+		"-s", ip.String(), "-d", ip.String(),
+		"-m", "comment", "--comment", comment,
+		"-j", "MASQUERADE",
+	}
+}
+
+// ensureHostPortChains creates the top level chains and hooks them into
+// the nat table
+func ensureHostPortChains(ipt firewall.IPTables) error {
+	chains, err := ipt.ListChains("nat")
+	if err != nil {
+		return err
+	}
+	for _, chain := range []string{hostPortDNATChain, hostPortSNATChain} {
+		if !containsString(chains, chain) {
+			if err := ipt.NewChain("nat", chain); err != nil {
+				return err
+			}
+		}
+	}
+
+	jumps := []struct {
+		chain string
+		rule  []string
+	}{
+		{"PREROUTING", []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", hostPortDNATChain}},
+		{"OUTPUT", []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", hostPortDNATChain}},
+		{"POSTROUTING", []string{"-j", hostPortSNATChain}},
+	}
+	for _, j := range jumps {
+		if err := ipt.AppendUnique("nat", j.chain, j.rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupPortMappings publishes the container ports from runtimeConfig,
+// DNATing hostIP:hostPort (any local address without hostIP) to the
+// container
+func setupPortMappings(n *NetConf, containerID string, containerIP net.IP) error {
+	ipt, err := ops.IPTables()
+	if err != nil {
+		return err
+	}
+	if err := ensureHostPortChains(ipt); err != nil {
+		return fmt.Errorf("failed to set up hostport chains: %v", err)
+	}
+
+	chain := hostPortChain(n, containerID)
+	comment := utils.FormatComment(n.Name, containerID)
+
+	chains, err := ipt.ListChains("nat")
+	if err != nil {
+		return err
+	}
+	if containsString(chains, chain) {
+		err = ipt.ClearChain("nat", chain)
+	} else {
+		err = ipt.NewChain("nat", chain)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create chain %v: %v", chain, err)
+	}
+
+	for _, p := range n.RuntimeConfig.PortMappings {
+		rule := []string{"-p", p.Protocol}
+		if p.HostIP != "" {
+			rule = append(rule, "-d", p.HostIP)
+		}
+		rule = append(rule,
+			"--dport", strconv.Itoa(p.HostPort),
+			"-j", "DNAT", "--to-destination", net.JoinHostPort(containerIP.String(), strconv.Itoa(p.ContainerPort)),
+		)
+		if err := ipt.AppendUnique("nat", chain, rule...); err != nil {
+			return fmt.Errorf("failed to publish port %v: %v", p.HostPort, err)
+		}
+		logrus.Debugf("rancher-cni-bridge: published %v/%v on %v to %v", p.HostPort, p.Protocol, p.HostIP, p.ContainerPort)
+	}
+
+	if err := ipt.AppendUnique("nat", hostPortDNATChain, "-m", "comment", "--comment", comment, "-j", chain); err != nil {
+		return err
+	}
+	return ipt.AppendUnique("nat", hostPortSNATChain, hairpinRule(containerIP, comment)...)
+}
+
+// teardownPortMappings removes whatever setupPortMappings installed for
+// the container. It is a no-op if nothing was published.
+func teardownPortMappings(n *NetConf, containerID string, containerIP net.IP) error {
+	ipt, err := ops.IPTables()
+	if err != nil {
+		// without iptables there can't be anything to clean up
+		logrus.Debugf("rancher-cni-bridge: skipping hostport teardown: %v", err)
+		return nil
+	}
+
+	chain := hostPortChain(n, containerID)
+	chains, err := ipt.ListChains("nat")
+	if err != nil {
+		return err
+	}
+	if !containsString(chains, chain) {
+		return nil
+	}
+
+	comment := utils.FormatComment(n.Name, containerID)
+	rules := []struct {
+		chain string
+		rule  []string
+	}{
+		{hostPortDNATChain, []string{"-m", "comment", "--comment", comment, "-j", chain}},
+		{hostPortSNATChain, hairpinRule(containerIP, comment)},
+	}
+	for _, r := range rules {
+		if ok, err := ipt.Exists("nat", r.chain, r.rule...); err == nil && ok {
+			if err := ipt.Delete("nat", r.chain, r.rule...); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := ipt.ClearChain("nat", chain); err != nil {
+		return err
+	}
+	return ipt.DeleteChain("nat", chain)
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
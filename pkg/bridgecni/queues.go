@@ -0,0 +1,33 @@
+package bridgecni
+
+import (
+	"path/filepath"
+)
+
+// setQueueCPUs writes the RPS and XPS CPU masks to every rx/tx queue of
+// the host veth
+func setQueueCPUs(ifName, rpsCPUs, xpsCPUs string) error {
+	masks := []struct {
+		glob  string
+		value string
+	}{
+		{"rx-*/rps_cpus", rpsCPUs},
+		{"tx-*/xps_cpus", xpsCPUs},
+	}
+
+	for _, m := range masks {
+		if m.value == "" {
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(sysClassNet, ifName, "queues", m.glob))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := writeSysfs(f, m.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package bridgecni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// updateReadiness writes the readiness file once the network is known
+// to work, and removes it when it doesn't, for node readiness checks
+// watching the file. Failing to do so never fails the operation.
+func updateReadiness(n *NetConf, ready bool) {
+	if n.ReadinessFile == "" {
+		return
+	}
+
+	var err error
+	if ready {
+		err = writeReadiness(n.ReadinessFile)
+	} else if err = os.Remove(n.ReadinessFile); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to update readiness file %v: %v", n.ReadinessFile, err)
+	}
+}
+
+func writeReadiness(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	content := fmt.Sprintf("ready since %v\n", time.Now().UTC().Format(time.RFC3339))
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,207 @@
+package bridgecni
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/utils"
+	"github.com/rancher/rancher-cni-bridge/internal/ipconfig"
+)
+
+// runReattach plugs a container restored from a checkpoint back into the
+// network using the result recorded by its original ADD, so it comes
+// back with the same address and MAC
+func runReattach(argv []string) error {
+	flags := flag.NewFlagSet("reattach", flag.ContinueOnError)
+	config := flags.String("config", "", "path of the network config file")
+	containerID := flags.String("container-id", "", "ID of the restored container")
+	ifName := flags.String("ifname", "eth0", "name of the container interface")
+	netnsPath := flags.String("netns", "", "netns of the restored container, defaults to the recorded one")
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+	if *config == "" || *containerID == "" {
+		return fmt.Errorf("--config and --container-id are required")
+	}
+
+	bytes, err := ioutil.ReadFile(*config)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", *config, err)
+	}
+	n, err := loadNetConf(bytes)
+	if err != nil {
+		return err
+	}
+	setupLogHooks(n)
+	if *ifName, err = containerIfName(n, *ifName); err != nil {
+		return err
+	}
+
+	a, err := loadAttachment(n, *containerID, *ifName)
+	if err != nil {
+		return err
+	}
+	if a == nil || a.Result == nil {
+		return fmt.Errorf("no recorded attachment of %v as %v", *containerID, *ifName)
+	}
+	if *netnsPath != "" {
+		a.Netns = *netnsPath
+	}
+	if n.BrName == bridgeFromMetadata || n.Standby != nil {
+		useBridge(n, a.Bridge)
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: a.ContainerID,
+		Netns:       a.Netns,
+		IfName:      a.IfName,
+		Args:        a.Args,
+		Path:        os.Getenv("CNI_PATH"),
+		StdinData:   bytes,
+	}
+	if err := reattach(args, n, a); err != nil {
+		return err
+	}
+	fmt.Printf("reattached %v as %v with %v\n", a.ContainerID, a.IfName, a.HostVeth)
+	return nil
+}
+
+// reattach recreates the veth pair if its host end is gone, which is what
+// a restored netns looks like, then reinstates the addresses, routes,
+// bridge port and iptables rules of a
+func reattach(args *skel.CmdArgs, n *NetConf, a *attachment) error {
+	if a.HostVeth == "" {
+		return fmt.Errorf("%v was not attached through a veth, can't reattach it", a.ContainerID)
+	}
+
+	nArgs, err := loadNetArgs(args.Args)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ops.OpenNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	ch, err := ops.NSHandle(netns)
+	if err != nil {
+		return err
+	}
+	defer ch.Delete()
+
+	if _, err := ops.Host().LinkByName(a.HostVeth); err != nil {
+		// a restored veth end has no peer, replace it
+		if link, err := ch.LinkByName(args.IfName); err == nil {
+			if err = ch.LinkDel(link); err != nil {
+				return fmt.Errorf("failed to delete %q: %v", args.IfName, err)
+			}
+		}
+		if a.HostVeth, err = setupContainerVeth(ch, netns, args.ContainerID, args.IfName, n); err != nil {
+			return err
+		}
+		logrus.Infof("rancher-cni-bridge: recreated %v of %v with host end %v", args.IfName, args.ContainerID, a.HostVeth)
+
+		if a.MAC != "" && nArgs.MACAddress == "" {
+			if err = ipconfig.SetMAC(ch, args.IfName, a.MAC); err != nil {
+				return fmt.Errorf("couldn't set the MAC Address of the interface: %v", err)
+			}
+		}
+		if err = plugHostVeth(args, n, a); err != nil {
+			return err
+		}
+		if err = configureHostPort(n, nArgs, a.HostVeth); err != nil {
+			return err
+		}
+		if err = restoreStaticFDB(n, a); err != nil {
+			return err
+		}
+	}
+
+	// addresses and routes of the container end, the rest is in place
+	if _, err = reconcileAttachment(args, n, a); err != nil {
+		return err
+	}
+	if n.Mode == modeRouted {
+		// the host route and the neighbour follow the host end
+		if err = setupRoutedPort(ch, args.IfName, a.HostVeth, a.Result.IP4.IP.IP); err != nil {
+			return err
+		}
+	}
+
+	if err = restoreHostRules(n, a); err != nil {
+		return err
+	}
+	return saveAttachment(n, a)
+}
+
+// plugHostVeth puts a freshly created host veth where ADD put it
+func plugHostVeth(args *skel.CmdArgs, n *NetConf, a *attachment) error {
+	if n.Mode == modeRouted {
+		return nil
+	}
+	br, err := setupBridge(n)
+	if err != nil {
+		return err
+	}
+	return attachPort(n, br, a.HostVeth, args)
+}
+
+// restoreHostRules reinstates the host routes and iptables rules recorded
+// in a, all of which are no-ops when already in place
+func restoreHostRules(n *NetConf, a *attachment) error {
+	if a.Result.IP4 == nil {
+		return nil
+	}
+	ipn := &a.Result.IP4.IP
+	comment := utils.FormatComment(n.Name, a.ContainerID)
+
+	if a.HostRoutes != nil {
+		if err := setupHostRoute(n.BrName, ipn.IP, a.HostRoutes); err != nil {
+			return err
+		}
+	}
+	if a.IPMasq {
+		chain := utils.FormatChainName(n.Name, a.ContainerID)
+		if err := ops.SetupIPMasq(ip.Network(ipn), chain, comment); err != nil {
+			return err
+		}
+	}
+	if len(a.PortMappings) > 0 {
+		n.RuntimeConfig.PortMappings = a.PortMappings
+		if err := setupPortMappings(n, a.ContainerID, ipn.IP); err != nil {
+			return err
+		}
+	}
+	if n.Firewall != nil {
+		nArgs, err := loadNetArgs(a.Args)
+		if err != nil {
+			return err
+		}
+		if err := setupFirewall(n, a.ContainerID, string(nArgs.RancherContainerUUID), ipn.IP); err != nil {
+			return err
+		}
+	}
+	if a.DSCP != 0 {
+		if err := setupDSCP(ipn, a.DSCP, comment); err != nil {
+			return err
+		}
+	}
+	if a.ConnLimit != 0 {
+		if err := setupConnLimit(ipn.IP, a.ConnLimit, comment); err != nil {
+			return err
+		}
+	}
+	if a.Mark != "" {
+		if err := setupMark(ipn, a.Mark, comment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
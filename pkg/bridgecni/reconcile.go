@@ -0,0 +1,106 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/rancher/rancher-cni-bridge/internal/ipconfig"
+)
+
+// reconcileAttachment brings an earlier attachment that is still in
+// place back in line with its recorded result: address, MAC, routes and
+// bridge membership are repaired as needed, so a retried ADD after a
+// partial failure converges instead of bailing out
+func reconcileAttachment(args *skel.CmdArgs, n *NetConf, a *attachment) (*types.Result, error) {
+	nArgs, err := loadNetArgs(args.Args)
+	if err != nil {
+		return nil, err
+	}
+	applyRuntimeMAC(n, nArgs)
+
+	netns, err := ops.OpenNS(args.Netns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	ch, err := ops.NSHandle(netns)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Delete()
+
+	if nArgs.MACAddress != "" && n.Mode != modeSRIOV {
+		link, err := ch.LinkByName(args.IfName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+		}
+		if link.Attrs().HardwareAddr.String() != string(nArgs.MACAddress) {
+			logrus.Infof("rancher-cni-bridge: restoring MAC address %v of %v", nArgs.MACAddress, args.IfName)
+			if err = ipconfig.SetMAC(ch, args.IfName, string(nArgs.MACAddress)); err != nil {
+				return nil, fmt.Errorf("couldn't set the MAC Address of the interface: %v", err)
+			}
+		}
+	}
+
+	// adding what is there already is a no-op
+	if err = ipconfig.ConfigureInterface(ch, args.IfName, a.Result, n.RouteSrc); err != nil {
+		return nil, err
+	}
+	if len(n.DefaultGateways) > 0 && a.Result.IP4 != nil {
+		if err = ipconfig.AddECMPDefaultRoute(ch, args.IfName, a.Result.IP4, n.DefaultGateways, ipconfig.RouteSrcIP(n.RouteSrc, a.Result.IP4)); err != nil {
+			return nil, err
+		}
+	}
+	if n.LinkLocalIPv4 {
+		if err = addLinkLocalAddr(ch, args.IfName, args.ContainerID); err != nil {
+			return nil, err
+		}
+	}
+	if err = ipconfig.AddBlackholeRoutes(ch, n.BlackholeRoutes); err != nil {
+		return nil, err
+	}
+
+	if err = repairHostPort(args, n, nArgs, a); err != nil {
+		return nil, err
+	}
+	return a.Result, nil
+}
+
+// repairHostPort plugs the host veth back into its bridge, recreating
+// the bridge if it went away
+func repairHostPort(args *skel.CmdArgs, n *NetConf, nArgs *NetArgs, a *attachment) error {
+	drift := checkHostPort(n, a)
+	if drift == nil {
+		return nil
+	}
+	logrus.Infof("rancher-cni-bridge: repairing port of %v: %v", args.ContainerID, drift)
+
+	br, err := setupBridge(n)
+	if err != nil {
+		return err
+	}
+
+	h := ops.Host()
+	hostVeth, err := h.LinkByName(a.HostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", a.HostVeth, err)
+	}
+	if hostVeth.Attrs().Flags&net.FlagUp == 0 {
+		if err = h.LinkSetUp(hostVeth); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", a.HostVeth, err)
+		}
+	}
+
+	if err = attachPort(n, br, a.HostVeth, args); err != nil {
+		return err
+	}
+	// a port leaving the bridge loses its brport flags and fdb entries
+	if err = setBrportOptions(n, nArgs, a.HostVeth); err != nil {
+		return err
+	}
+	return restoreStaticFDB(n, a)
+}
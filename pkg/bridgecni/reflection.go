@@ -0,0 +1,38 @@
+package bridgecni
+
+import (
+	"fmt"
+)
+
+// ways of reflecting a container's traffic back to itself, needed when
+// it reaches itself through a published port or a service address
+const (
+	reflectHairpin = "hairpin"
+	reflectPromisc = "promisc"
+)
+
+// l2Reflection works out how the bridge reflects traffic: hairpin on the
+// container ports, or the bridge in promiscuous mode. Published ports
+// need one of them, hairpin is picked if neither is configured.
+func l2Reflection(n *NetConf) (string, error) {
+	if !n.HairpinMode && !n.PromiscMode {
+		if len(n.RuntimeConfig.PortMappings) > 0 && bridgeName(n) != "" {
+			return reflectHairpin, nil
+		}
+		return "", nil
+	}
+
+	switch {
+	case n.HairpinMode && n.PromiscMode:
+		return "", fmt.Errorf("hairpinMode and promiscMode are mutually exclusive")
+	case bridgeName(n) == "":
+		return "", fmt.Errorf("hairpinMode and promiscMode need a bridge, %v mode has none", n.Mode)
+	case n.PromiscMode && n.Datapath == datapathOVS:
+		return "", fmt.Errorf("promiscMode is not supported with the ovs datapath")
+	case n.PromiscMode && uplinkName(n) != "":
+		return "", fmt.Errorf("promiscMode would pull all traffic of uplink %v into the bridge, use hairpinMode", uplinkName(n))
+	case n.PromiscMode:
+		return reflectPromisc, nil
+	}
+	return reflectHairpin, nil
+}
@@ -0,0 +1,90 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+// attachment modes
+const (
+	modeBridge = "bridge"
+	modeRouted = "routed"
+)
+
+// routedGateway is the next hop of containers in routed mode. Nothing
+// owns it: the host veth answers ARP for it through proxy ARP, and the
+// container gets a permanent neighbour entry for it on top.
+var routedGateway = net.IPv4(169, 254, 1, 1)
+
+// routedResult turns the IPAM result into a point-to-point config: a /32
+// and a default route through routedGateway
+func routedResult(result *types.Result) {
+	result.IP4.IP.Mask = net.CIDRMask(32, 32)
+	result.IP4.Gateway = routedGateway
+
+	for _, r := range result.IP4.Routes {
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			return
+		}
+	}
+	result.IP4.Routes = append(result.IP4.Routes, types.Route{
+		Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+	})
+}
+
+// setupRoutedPort makes the host end of the veth the router of the
+// container: it answers ARP for everything and addr is routed to it
+func setupRoutedPort(ch nlHandle, ifName, hostVethName string, addr net.IP) error {
+	h := ops.Host()
+	hostVeth, err := h.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+
+	if err = setSysctl("net.ipv4.conf."+hostVethName+".proxy_arp", "1"); err != nil {
+		return fmt.Errorf("failed to enable proxy ARP on %q: %v", hostVethName, err)
+	}
+
+	route := &netlink.Route{
+		LinkIndex: hostVeth.Attrs().Index,
+		Dst:       &net.IPNet{IP: addr, Mask: net.CIDRMask(32, 32)},
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if err = h.RouteAdd(route); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to add route to %v via %q: %v", addr, hostVethName, err)
+	}
+
+	if err = ops.EnableIP4Forward(); err != nil {
+		return fmt.Errorf("failed to enable forwarding: %v", err)
+	}
+
+	link, err := ch.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	neigh := &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_INET,
+		State:        netlink.NUD_PERMANENT,
+		IP:           routedGateway,
+		HardwareAddr: hostVeth.Attrs().HardwareAddr,
+	}
+	if err = ch.NeighSet(neigh); err != nil {
+		return fmt.Errorf("failed to add neighbour %v to %q: %v", routedGateway, ifName, err)
+	}
+	return nil
+}
+
+// bridgeName is the bridge containers are plugged into, if any
+func bridgeName(n *NetConf) string {
+	switch n.Mode {
+	case modeRouted, modeHostDevice, modeSRIOV:
+		return ""
+	}
+	return n.BrName
+}
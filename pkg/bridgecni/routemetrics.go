@@ -0,0 +1,94 @@
+package bridgecni
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/rancher/rancher-cni-bridge/internal/ipconfig"
+)
+
+// RouteMetricsConf is applied to every route the plugin installs in the
+// container, to force sane segment sizes on paths with broken PMTUD
+type RouteMetricsConf struct {
+	MTU     int  `json:"mtu"`
+	LockMTU bool `json:"lockMTU"`
+	AdvMSS  int  `json:"advmss"`
+}
+
+func (m *RouteMetricsConf) validate() error {
+	if m.MTU < 0 || m.AdvMSS < 0 {
+		return fmt.Errorf("invalid routeMetrics, mtu and advmss must not be negative")
+	}
+	if m.LockMTU && m.MTU == 0 {
+		return fmt.Errorf("routeMetrics lockMTU needs an mtu")
+	}
+	if m.MTU == 0 && m.AdvMSS == 0 {
+		return fmt.Errorf("routeMetrics needs an mtu or advmss")
+	}
+	return nil
+}
+
+// args returns the metrics as ip route arguments
+func (m *RouteMetricsConf) args() []string {
+	var args []string
+	if m.MTU != 0 {
+		args = append(args, "mtu")
+		if m.LockMTU {
+			args = append(args, "lock")
+		}
+		args = append(args, strconv.Itoa(m.MTU))
+	}
+	if m.AdvMSS != 0 {
+		args = append(args, "advmss", strconv.Itoa(m.AdvMSS))
+	}
+	return args
+}
+
+// setRouteMetrics replaces the routes of result (and the ECMP default
+// route, if any) on ifName with copies carrying the metrics, through ch,
+// bound to the container netns
+func setRouteMetrics(ch nlHandle, ifName string, result *types.Result, defaultGateways []string, routeSrc string, m *RouteMetricsConf) error {
+	var specs [][]string
+	for _, ipc := range []*types.IPConfig{result.IP4, result.IP6} {
+		if ipc == nil {
+			continue
+		}
+		for _, r := range ipc.Routes {
+			spec := []string{r.Dst.String()}
+			gw, onlink := ipconfig.RouteNextHop(ipc, r)
+			if gw != nil {
+				spec = append(spec, "via", gw.String())
+			}
+			spec = append(spec, "dev", ifName)
+			if r.GW != nil && r.GW.IsUnspecified() {
+				spec = append(spec, "scope", "link")
+			}
+			if onlink {
+				spec = append(spec, "onlink")
+			}
+			if src := ipconfig.RouteSrcIP(routeSrc, ipc); src != nil {
+				spec = append(spec, "src", src.String())
+			}
+			specs = append(specs, spec)
+		}
+	}
+	if len(defaultGateways) > 0 {
+		spec := []string{"0.0.0.0/0"}
+		if src := ipconfig.RouteSrcIP(routeSrc, result.IP4); src != nil {
+			spec = append(spec, "src", src.String())
+		}
+		for _, gw := range defaultGateways {
+			spec = append(spec, "nexthop", "via", gw, "dev", ifName)
+		}
+		specs = append(specs, spec)
+	}
+
+	for _, spec := range specs {
+		if err := ch.RouteReplace(append(spec, m.args()...)); err != nil {
+			return fmt.Errorf("failed to set metrics of route %v: %v", strings.Join(spec, " "), err)
+		}
+	}
+	return nil
+}
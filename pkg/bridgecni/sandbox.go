@@ -0,0 +1,77 @@
+package bridgecni
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// sameSandbox tells whether the recorded attachment a is of the pod
+// sandbox args are for: the kubelet gave both the same infra container,
+// or they share the netns
+func sameSandbox(a *attachment, args *skel.CmdArgs, nArgs *NetArgs) bool {
+	if a.ContainerID == args.ContainerID || a.IfName != args.IfName {
+		return false
+	}
+	if nArgs.K8S_POD_INFRA_CONTAINER_ID != "" {
+		if recorded, err := loadNetArgs(a.Args); err == nil && recorded.K8S_POD_INFRA_CONTAINER_ID == nArgs.K8S_POD_INFRA_CONTAINER_ID &&
+			recorded.K8S_POD_NAMESPACE == nArgs.K8S_POD_NAMESPACE && recorded.K8S_POD_NAME == nArgs.K8S_POD_NAME {
+			return true
+		}
+	}
+	return sameNetns(a.Netns, args.Netns)
+}
+
+// checkDuplicateSandbox looks for an attachment of the same pod sandbox
+// under another container ID, as left by a retrying kubelet. If its
+// interface is still in place it is reconciled and its result returned,
+// so the sandbox doesn't get a second address from IPAM. nil, nil means
+// there is none.
+func checkDuplicateSandbox(args *skel.CmdArgs, n *NetConf) (*types.Result, error) {
+	nArgs, err := loadNetArgs(args.Args)
+	if err != nil {
+		return nil, err
+	}
+	as, err := listAttachments(n)
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: not checking for duplicate sandboxes: %v", err)
+		return nil, nil
+	}
+
+	for _, a := range as {
+		if a.Result == nil || !sameSandbox(a, args, nArgs) {
+			continue
+		}
+		if !containerLinkExists(args.Netns, args.IfName) {
+			continue
+		}
+		logrus.Infof("rancher-cni-bridge: %v is the sandbox of %v attached as %v, reconciling", args.ContainerID, a.ContainerID, args.IfName)
+		recorded := *args
+		recorded.ContainerID = a.ContainerID
+		return reconcileAttachment(&recorded, n, a)
+	}
+	return nil, nil
+}
+
+// sandboxOwner returns the container ID the interface of args is
+// recorded under when DEL comes for a duplicate of its sandbox, which
+// must leave the interface alone. Empty means args own whatever there is.
+func sandboxOwner(args *skel.CmdArgs, n *NetConf) string {
+	if a, err := loadAttachment(n, args.ContainerID, args.IfName); err != nil || a != nil {
+		return ""
+	}
+	nArgs, err := loadNetArgs(args.Args)
+	if err != nil {
+		return ""
+	}
+	as, err := listAttachments(n)
+	if err != nil {
+		return ""
+	}
+	for _, a := range as {
+		if sameSandbox(a, args, nArgs) && containerLinkExists(args.Netns, args.IfName) {
+			return a.ContainerID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package bridgecni
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// runSelftest runs ADD, CHECK and DEL of the given network against a
+// scratch netns and reports how long each took, for node burn-in and
+// support bundles
+func runSelftest(argv []string) error {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	config := flags.String("config", "", "path of the network config file")
+	ifName := flags.String("ifname", "eth0", "name of the container interface")
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+	if *config == "" {
+		return fmt.Errorf("--config is required")
+	}
+
+	bytes, err := ioutil.ReadFile(*config)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", *config, err)
+	}
+	n, err := loadNetConf(bytes)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.NewNS()
+	if err != nil {
+		return fmt.Errorf("failed to create scratch netns: %v", err)
+	}
+	defer netns.Close()
+
+	args := &skel.CmdArgs{
+		ContainerID: fmt.Sprintf("selftest-%d", os.Getpid()),
+		Netns:       netns.Path(),
+		IfName:      *ifName,
+		Path:        os.Getenv("CNI_PATH"),
+		StdinData:   bytes,
+	}
+
+	steps := []struct {
+		command string
+		run     func() error
+	}{
+		{"ADD", func() error {
+			result, err := addNetwork(args, n)
+			if err == nil && result.IP4 != nil {
+				fmt.Printf("  got %v\n", result.IP4.IP.String())
+			}
+			return err
+		}},
+		{"CHECK", func() error { return cmdCheck(args) }},
+		{"DEL", func() error { return delNetwork(args, n) }},
+	}
+
+	start := time.Now()
+	for _, step := range steps {
+		if err := setCNIEnv(step.command, args); err != nil {
+			return err
+		}
+		stepStart := time.Now()
+		err := step.run()
+		fmt.Printf("%-5s %v (%v)\n", step.command, stepStatus(err), time.Since(stepStart))
+		if err != nil {
+			if step.command != "DEL" {
+				// don't leave the attempt behind
+				setCNIEnv("DEL", args)
+				delNetwork(args, n)
+			}
+			return fmt.Errorf("selftest failed at %v: %v", step.command, err)
+		}
+	}
+	fmt.Printf("selftest of %v passed in %v\n", n.Name, time.Since(start))
+	return nil
+}
+
+func stepStatus(err error) string {
+	if err != nil {
+		return "FAIL"
+	}
+	return "ok"
+}
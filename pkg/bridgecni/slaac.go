@@ -0,0 +1,144 @@
+package bridgecni
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/vishvananda/netlink"
+)
+
+const radvdConfTemplate = `interface %s {
+	AdvSendAdvert on;
+	MinRtrAdvInterval 3;
+	MaxRtrAdvInterval 10;
+	prefix %s {
+		AdvOnLink on;
+		AdvAutonomous on;
+	};
+};
+`
+
+// slaacContainerIPv6 is what containers need to pick up the advertised
+// prefix, unless containerIPv6 says otherwise
+var slaacContainerIPv6 = func() *IPv6SysctlConf {
+	acceptRA, autoconf := 1, true
+	return &IPv6SysctlConf{AcceptRA: &acceptRA, Autoconf: &autoconf}
+}()
+
+// setupSLAAC makes the bridge the IPv6 router of bridgeSubnetV6: it gets
+// the first address of the prefix, and radvd advertises the prefix on it
+// so containers configure themselves
+func setupSLAAC(n *NetConf, br netlink.Link) error {
+	_, prefix, err := net.ParseCIDR(n.BrSubnetV6)
+	if err != nil {
+		return fmt.Errorf("invalid bridgeSubnetV6 %q: %v", n.BrSubnetV6, err)
+	}
+
+	brAddr := &net.IPNet{IP: ip.NextIP(prefix.IP), Mask: prefix.Mask}
+	if err = ensureBridgeAddrV6(br, brAddr); err != nil {
+		return err
+	}
+
+	// radvd refuses to advertise a default router without forwarding
+	if err = setSysctl("net.ipv6.conf.all.forwarding", "1"); err != nil {
+		return err
+	}
+
+	return ensureRadvd(n, prefix)
+}
+
+// bridgeGatewayV6 is the link local address containers route IPv6
+// through, fixed so it doesn't move with the MAC of the bridge
+var bridgeGatewayV6 = net.ParseIP("fe80::1")
+
+// ensureBridgeGatewayV6 gives the bridge the IPv6 gateway address
+func ensureBridgeGatewayV6(brName string) (net.IP, error) {
+	br, err := ops.Host().LinkByName(brName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", brName, err)
+	}
+	gw := &net.IPNet{IP: bridgeGatewayV6, Mask: net.CIDRMask(64, 128)}
+	if err = ensureBridgeAddrV6(br, gw); err != nil {
+		return nil, err
+	}
+	return bridgeGatewayV6, nil
+}
+
+func ensureBridgeAddrV6(br netlink.Link, ipn *net.IPNet) error {
+	h := ops.Host()
+	addrs, err := h.AddrList(br, syscall.AF_INET6)
+	if err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("could not get list of IPv6 addresses: %v", err)
+	}
+	for _, a := range addrs {
+		if a.IPNet.String() == ipn.String() {
+			return nil
+		}
+	}
+
+	if err := h.AddrAdd(br, &netlink.Addr{IPNet: ipn}); err != nil {
+		return fmt.Errorf("could not add IP address to %q: %v", br.Attrs().Name, err)
+	}
+	return nil
+}
+
+// ensureRadvd writes the radvd config of the bridge and starts radvd, or
+// has the running one reload it when it changed
+func ensureRadvd(n *NetConf, prefix *net.IPNet) error {
+	dir := filepath.Join(dataDir(n), n.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %v: %v", dir, err)
+	}
+	confPath := filepath.Join(dir, "radvd-"+n.BrName+".conf")
+	pidPath := filepath.Join(dir, "radvd-"+n.BrName+".pid")
+
+	conf := []byte(fmt.Sprintf(radvdConfTemplate, n.BrName, prefix))
+	old, _ := ioutil.ReadFile(confPath)
+	changed := !bytes.Equal(old, conf)
+	if changed {
+		if err := ioutil.WriteFile(confPath, conf, 0600); err != nil {
+			return fmt.Errorf("failed to write radvd config: %v", err)
+		}
+	}
+
+	if pid := runningPid(pidPath); pid > 0 {
+		if changed {
+			logrus.Infof("rancher-cni-bridge: reloading radvd of %v", n.BrName)
+			return syscall.Kill(pid, syscall.SIGHUP)
+		}
+		return nil
+	}
+
+	logrus.Infof("rancher-cni-bridge: starting radvd on %v for %v", n.BrName, prefix)
+	if out, err := exec.Command("radvd", "-C", confPath, "-p", pidPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to start radvd: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runningPid returns the pid recorded in pidPath if that process is
+// still alive, 0 otherwise
+func runningPid(pidPath string) int {
+	b, err := ioutil.ReadFile(pidPath)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		return 0
+	}
+	return pid
+}
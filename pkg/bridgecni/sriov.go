@@ -0,0 +1,87 @@
+package bridgecni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+)
+
+// modeSRIOV gives every container a VF of the PF, bypassing the bridge
+const modeSRIOV = "sriov"
+
+// allocateVF picks a VF of pf whose netdev is still in the host netns,
+// the others are in use by containers. It returns the VF index and the
+// name of its netdev.
+func allocateVF(pf string) (int, string, error) {
+	vfDirs, err := filepath.Glob(filepath.Join(sysClassNet, pf, "device", "virtfn*"))
+	if err != nil {
+		return 0, "", err
+	}
+	if len(vfDirs) == 0 {
+		return 0, "", fmt.Errorf("%q has no VFs, are they enabled in sriov_numvfs?", pf)
+	}
+
+	for _, dir := range vfDirs {
+		vf, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "virtfn"))
+		if err != nil {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, "net"))
+		if err != nil || len(files) == 0 {
+			continue
+		}
+		return vf, files[0].Name(), nil
+	}
+	return 0, "", fmt.Errorf("no free VF left on %q", pf)
+}
+
+// attachVF configures a free VF of the PF and moves it into netns as
+// ifName. The MAC and VLAN are set through the PF, so the container
+// can't change them. It returns the VF index and its host name.
+func attachVF(ch nlHandle, netns ns.NetNS, ifName string, n *NetConf, mac string) (int, string, error) {
+	vf, name, err := allocateVF(n.PF)
+	if err != nil {
+		return 0, "", err
+	}
+	logrus.Debugf("rancher-cni-bridge: using VF %v (%v) of %v", vf, name, n.PF)
+
+	h := ops.Host()
+	pf, err := h.LinkByName(n.PF)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to lookup %q: %v", n.PF, err)
+	}
+
+	if mac != "" {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to parse MAC address %q: %v", mac, err)
+		}
+		if err = h.LinkSetVfHardwareAddr(pf, vf, hw); err != nil {
+			return 0, "", fmt.Errorf("failed to set MAC of VF %v: %v", vf, err)
+		}
+	}
+	if err = h.LinkSetVfVlan(pf, vf, n.VLAN); err != nil {
+		return 0, "", fmt.Errorf("failed to set VLAN of VF %v: %v", vf, err)
+	}
+
+	return vf, name, moveLinkToNS(ch, netns, name, ifName)
+}
+
+// releaseVF resets the VLAN of a VF handed back to the host
+func releaseVF(pfName string, vf int) error {
+	h := ops.Host()
+	pf, err := h.LinkByName(pfName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", pfName, err)
+	}
+	if err = h.LinkSetVfVlan(pf, vf, 0); err != nil {
+		return fmt.Errorf("failed to reset VLAN of VF %v: %v", vf, err)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package bridgecni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/vishvananda/netlink"
+)
+
+// defaultProbeInterval is how often the daemon checks the uplinks of
+// networks with a standby bridge, in seconds
+const defaultProbeInterval = 2
+
+// StandbyConf is a second bridge with its own uplink that takes over the
+// containers when the uplink of the active bridge loses carrier. The
+// bridge and uplink of the network config are the primary pair.
+type StandbyConf struct {
+	Bridge string `json:"bridge"`
+	Uplink string `json:"uplink"`
+
+	primaryBridge, primaryUplink string
+}
+
+// validateStandby checks the standby pair and remembers the primary one
+func validateStandby(n *NetConf) error {
+	s := n.Standby
+	if s.Bridge == "" || s.Uplink == "" || n.Uplink == "" {
+		return fmt.Errorf("standby needs an uplink, and a bridge and uplink of its own")
+	}
+	if s.Bridge == n.BrName || s.Uplink == n.Uplink {
+		return fmt.Errorf("standby bridge and uplink must differ from the primary ones")
+	}
+	if bridgeName(n) == "" || n.BrName == bridgeFromMetadata || n.Datapath == datapathOVS || n.AdoptExisting ||
+		n.IsGW || n.BrSubnet != "" || n.BrSubnetV6 != "" || n.VXLAN != nil || n.VRF != nil {
+		return fmt.Errorf("standby needs linux bridges created by the plugin and doesn't support a metadata bridge, isGateway, bridgeSubnet, bridgeSubnetV6, vxlan or vrf")
+	}
+	// the embedded allocator hands out bridgeSubnet
+	if n.IPAM.Type == "" {
+		return fmt.Errorf("standby needs an IPAM plugin")
+	}
+	s.primaryBridge, s.primaryUplink = n.BrName, n.Uplink
+	return nil
+}
+
+// useBridge points n at the bridge br, and the uplink that goes with it
+func useBridge(n *NetConf, br string) {
+	n.BrName = br
+	if s := n.Standby; s != nil {
+		if br == s.Bridge {
+			n.Uplink = s.Uplink
+		} else {
+			n.Uplink = s.primaryUplink
+		}
+	}
+}
+
+// plugUplink makes uplink a port of br, so the bridge reaches beyond
+// the host through it
+func plugUplink(uplink string, br netlink.Link) error {
+	h := ops.Host()
+	link, err := h.LinkByName(uplink)
+	if err != nil {
+		return fmt.Errorf("failed to lookup uplink %q: %v", uplink, err)
+	}
+	if link.Attrs().MasterIndex != br.Attrs().Index {
+		if err = h.LinkSetMasterByIndex(link, br.Attrs().Index); err != nil {
+			return fmt.Errorf("failed to add uplink %q to bridge: %v", uplink, err)
+		}
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err = h.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", uplink, err)
+		}
+	}
+	return nil
+}
+
+// otherBridge is the bridge of the pair that isn't br
+func otherBridge(s *StandbyConf, br string) string {
+	if br == s.Bridge {
+		return s.primaryBridge
+	}
+	return s.Bridge
+}
+
+func activeBridgePath(n *NetConf) string {
+	return filepath.Join(dataDir(n), n.Name, "active-bridge")
+}
+
+// activeBridge returns the bridge containers are attached to right now,
+// the primary one until a failover happened
+func activeBridge(n *NetConf) string {
+	b, err := ioutil.ReadFile(activeBridgePath(n))
+	if err == nil {
+		if br := strings.TrimSpace(string(b)); br == n.Standby.Bridge || br == n.Standby.primaryBridge {
+			return br
+		}
+	}
+	return n.Standby.primaryBridge
+}
+
+func setActiveBridge(n *NetConf, br string) error {
+	path := activeBridgePath(n)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state dir: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(br+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to record active bridge: %v", err)
+	}
+	return nil
+}
+
+// uplinkHealthy tells whether the uplink has carrier
+func uplinkHealthy(uplink string) bool {
+	link, err := ops.Host().LinkByName(uplink)
+	return err == nil && link.Attrs().RawFlags&iffLowerUp != 0
+}
+
+// selectActiveBridge points n at the active bridge for ADD. If its uplink
+// is down while the other one is up, new containers go to the other one;
+// the daemon moves the existing ones over.
+func selectActiveBridge(n *NetConf) {
+	if n.Standby == nil {
+		return
+	}
+	br := activeBridge(n)
+	useBridge(n, br)
+	if uplinkHealthy(n.Uplink) {
+		return
+	}
+	other := otherBridge(n.Standby, br)
+	useBridge(n, other)
+	if uplinkHealthy(n.Uplink) {
+		logrus.Warnf("rancher-cni-bridge: uplink of %v is down, attaching to %v", br, other)
+		return
+	}
+	// both down, stay where the others are
+	useBridge(n, br)
+}
+
+// failover moves every container of the network onto the other bridge
+// if the uplink of the active one is down and the other one's is up
+func failover(n *NetConf) {
+	from := activeBridge(n)
+	to := otherBridge(n.Standby, from)
+
+	cur := *n
+	useBridge(&cur, from)
+	if uplinkHealthy(cur.Uplink) {
+		return
+	}
+	next := *n
+	useBridge(&next, to)
+	if !uplinkHealthy(next.Uplink) {
+		return
+	}
+
+	logrus.Warnf("rancher-cni-bridge: uplink %v of %v is down, failing over to %v", cur.Uplink, from, to)
+	br, err := setupBridge(&next)
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: failover to %v failed: %v", to, err)
+		return
+	}
+	if err = setActiveBridge(n, to); err != nil {
+		logrus.Errorf("rancher-cni-bridge: %v", err)
+	}
+
+	as, err := listAttachments(n)
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: failover to %v failed: %v", to, err)
+		return
+	}
+	for _, a := range as {
+		if a.HostVeth == "" || a.Bridge != from {
+			continue
+		}
+		args := &skel.CmdArgs{
+			ContainerID: a.ContainerID,
+			Netns:       a.Netns,
+			IfName:      a.IfName,
+			Args:        a.Args,
+		}
+		nArgs, err := loadNetArgs(a.Args)
+		if err == nil {
+			err = attachPort(&next, br, a.HostVeth, args)
+		}
+		if err == nil {
+			// a port changing bridges loses its brport flags and fdb
+			// entries
+			err = setBrportOptions(&next, nArgs, a.HostVeth)
+		}
+		if err == nil {
+			err = restoreStaticFDB(&next, a)
+		}
+		if err != nil {
+			logrus.Errorf("rancher-cni-bridge: failed to move %v to %v: %v", a.ContainerID, to, err)
+			continue
+		}
+		a.Bridge = to
+		if err = saveAttachment(n, a); err != nil {
+			logrus.Errorf("rancher-cni-bridge: %v", err)
+		}
+	}
+}
+
+// probeUplinks runs failover for the remembered networks with a standby
+// bridge every interval, forever
+func (w *bridgeWatcher) probeUplinks(interval time.Duration) {
+	for range time.Tick(interval) {
+		w.mu.Lock()
+		for _, n := range w.standby {
+			failover(n)
+		}
+		w.mu.Unlock()
+	}
+}
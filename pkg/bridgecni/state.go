@@ -0,0 +1,200 @@
+package bridgecni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const defaultDataDir = "/var/lib/cni/rancher-cni-bridge"
+
+// attachment is the state kept on disk for every container interface
+// the plugin has set up
+type attachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	Netns       string `json:"netns"`
+	Bridge      string `json:"bridge"`
+	HostVeth    string `json:"hostVeth,omitempty"`
+	HostDevice  string `json:"hostDevice,omitempty"`
+	VF          *int   `json:"vf,omitempty"`
+	MAC         string `json:"mac,omitempty"`
+	Args        string `json:"args,omitempty"`
+
+	// what was configured outside of the container, for DEL
+	IPMasq       bool           `json:"ipMasq,omitempty"`
+	DSCP         int            `json:"dscp,omitempty"`
+	Mark         string         `json:"mark,omitempty"`
+	ConnLimit    int            `json:"connLimit,omitempty"`
+	PortMappings []PortMapping  `json:"portMappings,omitempty"`
+	HostRoutes   *HostRouteConf `json:"hostRoutes,omitempty"`
+	// IPAM is the allocator the addresses came from, see execIPAMDel
+	IPAM string `json:"ipam,omitempty"`
+
+	Result *types.Result `json:"result"`
+}
+
+// dataDir is where the plugin keeps its state
+func dataDir(n *NetConf) string {
+	if n.DataDir == "" {
+		return defaultDataDir
+	}
+	return n.DataDir
+}
+
+func attachmentPath(n *NetConf, containerID, ifName string) string {
+	return filepath.Join(dataDir(n), n.Name, containerID+"-"+ifName+".json")
+}
+
+// loadAttachment returns the recorded attachment, or nil if there is none
+func loadAttachment(n *NetConf, containerID, ifName string) (*attachment, error) {
+	b, err := ioutil.ReadFile(attachmentPath(n, containerID, ifName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state: %v", err)
+	}
+
+	a := &attachment{}
+	if err := json.Unmarshal(b, a); err != nil {
+		return nil, fmt.Errorf("failed to decode state: %v", err)
+	}
+	return a, nil
+}
+
+// saveAttachment records a, replacing the file atomically so a crash
+// never leaves a truncated record behind
+func saveAttachment(n *NetConf, a *attachment) error {
+	path := attachmentPath(n, a.ContainerID, a.IfName)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state dir: %v", err)
+	}
+
+	b, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	return nil
+}
+
+// removeAttachment forgets the attachment, it's fine if there is none
+func removeAttachment(n *NetConf, containerID, ifName string) error {
+	err := os.Remove(attachmentPath(n, containerID, ifName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove state: %v", err)
+	}
+	return nil
+}
+
+// lockNetwork serialises ADD with what must not see it half done, like
+// GC and removing an empty bridge, on the state dir of the network.
+// The returned func drops the lock.
+func lockNetwork(n *NetConf) (func(), error) {
+	dir := filepath.Join(dataDir(n), n.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state dir: %v", err)
+	}
+	lock, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state dir: %v", err)
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock state dir: %v", err)
+	}
+	// closing the descriptor drops the lock
+	return func() { lock.Close() }, nil
+}
+
+// listAttachments returns all attachments recorded for the network
+func listAttachments(n *NetConf) ([]*attachment, error) {
+	paths, err := filepath.Glob(filepath.Join(dataDir(n), n.Name, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var as []*attachment
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read state: %v", err)
+		}
+		a := &attachment{}
+		if err := json.Unmarshal(b, a); err != nil {
+			logrus.Errorf("rancher-cni-bridge: ignoring undecodable state %v: %v", path, err)
+			continue
+		}
+		as = append(as, a)
+	}
+	return as, nil
+}
+
+// checkDuplicateAdd looks for an earlier ADD of the same containerID and
+// ifName. If it is still in place it is reconciled and the recorded
+// result is returned so the ADD is idempotent; if it was done for another
+// netns that's an error. Without one, an attachment of the same pod
+// sandbox under another ID is looked for (checkDuplicateSandbox). nil,
+// nil means there is nothing attached yet.
+func checkDuplicateAdd(args *skel.CmdArgs, n *NetConf) (*types.Result, error) {
+	a, err := loadAttachment(n, args.ContainerID, args.IfName)
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: ignoring unreadable state of %v: %v", args.ContainerID, err)
+		return nil, nil
+	}
+	if a == nil {
+		return checkDuplicateSandbox(args, n)
+	}
+
+	if !sameNetns(a.Netns, args.Netns) {
+		return nil, fmt.Errorf("container %v is already attached as %v in netns %v", args.ContainerID, args.IfName, a.Netns)
+	}
+
+	// only trust the record while the interface is actually there. What
+	// else it recorded, rules, host veth and address, goes the DEL way
+	// so the ADD starts over clean.
+	if !containerLinkExists(args.Netns, args.IfName) {
+		logrus.Infof("rancher-cni-bridge: tearing down stale state of %v, %v is gone", args.ContainerID, args.IfName)
+		return nil, delAttachment(args, n)
+	}
+
+	logrus.Infof("rancher-cni-bridge: %v already attached as %v, reconciling", args.ContainerID, args.IfName)
+	if a.Result == nil {
+		return nil, fmt.Errorf("recorded attachment of %v has no result", args.ContainerID)
+	}
+	return reconcileAttachment(args, n, a)
+}
+
+// containerLinkExists tells whether ifName exists in the netns at path
+func containerLinkExists(path, ifName string) bool {
+	netns, err := ops.OpenNS(path)
+	if err != nil {
+		return false
+	}
+	defer netns.Close()
+
+	ch, err := ops.NSHandle(netns)
+	if err != nil {
+		return false
+	}
+	defer ch.Delete()
+
+	_, err = ch.LinkByName(ifName)
+	return err == nil
+}
@@ -0,0 +1,14 @@
+package bridgecni
+
+import (
+	"github.com/rancher/rancher-cni-bridge/internal/bridge"
+)
+
+// restoreStaticFDB programs the fdb entry of a recorded attachment again,
+// after its port was plugged back into a bridge
+func restoreStaticFDB(n *NetConf, a *attachment) error {
+	if !n.StaticFDB || a.HostVeth == "" || a.MAC == "" {
+		return nil
+	}
+	return bridge.AddStaticFDB(ops.Host(), a.HostVeth, a.MAC)
+}
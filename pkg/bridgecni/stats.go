@@ -0,0 +1,49 @@
+package bridgecni
+
+import (
+	"path/filepath"
+	"strconv"
+)
+
+// ifStats are the traffic counters of a container interface over its
+// lifetime, from the container's point of view
+type ifStats struct {
+	RxBytes   uint64 `json:"rxBytes"`
+	TxBytes   uint64 `json:"txBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	TxPackets uint64 `json:"txPackets"`
+}
+
+// readVethStats reads the counters of the host end of a container veth.
+// What the host end receives the container sent, so they are swapped.
+func readVethStats(hostVeth string) (*ifStats, error) {
+	s := &ifStats{}
+	for name, v := range map[string]*uint64{
+		"tx_bytes":   &s.RxBytes,
+		"rx_bytes":   &s.TxBytes,
+		"tx_packets": &s.RxPackets,
+		"rx_packets": &s.TxPackets,
+	} {
+		val, err := readSysfs(filepath.Join(sysClassNet, hostVeth, "statistics", name))
+		if err != nil {
+			return nil, err
+		}
+		if *v, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// snapshotStats returns the counters of the attachment's veth before DEL
+// removes it, nil if there's no veth or it's gone already
+func snapshotStats(a *attachment) *ifStats {
+	if a == nil || a.HostVeth == "" {
+		return nil
+	}
+	s, err := readVethStats(a.HostVeth)
+	if err != nil {
+		return nil
+	}
+	return s
+}
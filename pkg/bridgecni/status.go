@@ -0,0 +1,79 @@
+package bridgecni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// errCodeNotAvailable is the CNI error code for a plugin that can't
+// serve ADD right now
+const errCodeNotAvailable = 50
+
+// cmdStatus tells the runtime whether ADD can be expected to succeed
+func cmdStatus(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	err = checkReady(n)
+	updateReadiness(n, err == nil)
+	if err != nil {
+		return &types.Error{Code: errCodeNotAvailable, Msg: "plugin not available", Details: err.Error()}
+	}
+	return nil
+}
+
+// checkReady verifies the prerequisites of the network: the devices it
+// builds on exist, the IPAM plugin is installed and state can be written
+func checkReady(n *NetConf) error {
+	h := ops.Host()
+
+	// the bridge is created on the first ADD, unless it's adopted
+	if n.AdoptExisting && bridgeName(n) != "" && n.BrName != bridgeFromMetadata {
+		if _, err := h.LinkByName(n.BrName); err != nil {
+			return fmt.Errorf("bridge %v not found: %v", n.BrName, err)
+		}
+	}
+	devs := []string{uplinkName(n), n.Device}
+	if n.Bond != nil {
+		// the bond itself is created on the first ADD
+		devs = append([]string{n.Device}, n.Bond.Slaves...)
+	}
+	for _, dev := range devs {
+		if dev == "" {
+			continue
+		}
+		if _, err := h.LinkByName(dev); err != nil {
+			return fmt.Errorf("device %v not found: %v", dev, err)
+		}
+	}
+	if n.PCIAddress != "" {
+		if _, err := hostDeviceName(n); err != nil {
+			return err
+		}
+	}
+
+	if !ipamDisabled(n) && n.IPAM.Type != "" {
+		if _, err := invoke.FindInPath(n.IPAM.Type, filepath.SplitList(os.Getenv("CNI_PATH"))); err != nil && n.BrSubnet == "" {
+			return fmt.Errorf("IPAM plugin %q not found: %v", n.IPAM.Type, err)
+		}
+	}
+
+	dir := filepath.Join(dataDir(n), n.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("data dir %v not writable: %v", dir, err)
+	}
+	f, err := ioutil.TempFile(dir, ".status")
+	if err != nil {
+		return fmt.Errorf("data dir %v not writable: %v", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
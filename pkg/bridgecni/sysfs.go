@@ -0,0 +1,203 @@
+package bridgecni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/rancher-cni-bridge/internal/bridge"
+)
+
+const (
+	sysClassNet = "/sys/class/net"
+	procSys     = "/proc/sys"
+
+	// restrictedGroupFwdMask covers the groups the kernel refuses to
+	// forward: STP, MAC pause and 802.3ad
+	restrictedGroupFwdMask = 0x7
+)
+
+// writeSysfs writes value to the given sysfs/procfs file
+func writeSysfs(path, value string) error {
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %q to %v: %v", value, path, err)
+	}
+	return nil
+}
+
+// readSysfs returns the trimmed contents of the given sysfs/procfs file
+func readSysfs(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %v: %v", path, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// setSysctl sets the sysctl name (in dotted notation) to value, leaving
+// it alone when it already has that value
+func setSysctl(name, value string) error {
+	path := filepath.Join(procSys, strings.Replace(name, ".", "/", -1))
+	if cur, err := readSysfs(path); err == nil && cur == value {
+		return nil
+	}
+	return writeSysfs(path, value)
+}
+
+// boolSysctl is the sysctl spelling of b
+func boolSysctl(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// stpOption is an STP setting of the bridge with the range the kernel
+// accepts, timers in seconds
+type stpOption struct {
+	name, sysfs string
+	value       *int
+	min, max    int
+	scale       int
+}
+
+func stpOptions(n *NetConf) []stpOption {
+	return []stpOption{
+		{"bridgePriority", "priority", n.BrPriority, 0, 65535, 1},
+		{"bridgeHelloTime", "hello_time", n.BrHelloTime, 1, 10, 100},
+		{"bridgeMaxAge", "max_age", n.BrMaxAge, 6, 40, 100},
+		{"bridgeForwardDelay", "forward_delay", n.BrForwardDelay, 2, 30, 100},
+	}
+}
+
+// validateBridgeSTP range checks the STP settings
+func validateBridgeSTP(n *NetConf) error {
+	for _, o := range stpOptions(n) {
+		if o.value != nil && (*o.value < o.min || *o.value > o.max) {
+			return fmt.Errorf("invalid %v %v, must be between %v and %v", o.name, *o.value, o.min, o.max)
+		}
+	}
+	return nil
+}
+
+// setBridgeSTP applies the configured STP priority and timers, then
+// turns STP on or off. The kernel expects the timers in hundredths of a
+// second.
+func setBridgeSTP(n *NetConf) error {
+	for _, o := range stpOptions(n) {
+		if o.value == nil {
+			continue
+		}
+		if err := bridge.SetOption(n.BrName, o.sysfs, strconv.Itoa(*o.value*o.scale)); err != nil {
+			return err
+		}
+	}
+	if n.BrSTP != nil {
+		return bridge.SetOption(n.BrName, "stp_state", boolSysctl(*n.BrSTP))
+	}
+	return nil
+}
+
+// setBridgeGroupFwdMask sets which link local multicast groups the
+// bridge passes through, so e.g. LLDP can reach containers
+func setBridgeGroupFwdMask(n *NetConf) error {
+	if n.BrGroupFwdMask == 0 {
+		return nil
+	}
+	return bridge.SetOption(n.BrName, "group_fwd_mask", fmt.Sprintf("%#x", n.BrGroupFwdMask))
+}
+
+// setBridgeNFCall ensures or disables passing bridged traffic through
+// iptables/ip6tables as configured, loading br_netfilter when needed
+func setBridgeNFCall(n *NetConf) error {
+	sysctls := []struct {
+		name  string
+		value *bool
+	}{
+		{"net.bridge.bridge-nf-call-iptables", n.BridgeNFCallIPTables},
+		{"net.bridge.bridge-nf-call-ip6tables", n.BridgeNFCallIP6Tables},
+	}
+
+	for _, s := range sysctls {
+		if s.value == nil {
+			continue
+		}
+		if !*s.value && !brNetfilterLoaded() {
+			// without the module bridged traffic skips iptables anyway
+			continue
+		}
+		if err := ensureBrNetfilter(); err != nil {
+			return err
+		}
+
+		if err := setSysctl(s.name, boolSysctl(*s.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setIgnoreRoutesWithLinkdown sets ignore_routes_with_linkdown of
+// ifName for IPv4 and, unless it is disabled there, IPv6
+func setIgnoreRoutesWithLinkdown(ifName string, ignore bool) error {
+	for _, family := range []string{"ipv4", "ipv6"} {
+		path := filepath.Join(procSys, "net", family, "conf", ifName, "ignore_routes_with_linkdown")
+		if _, err := os.Stat(path); os.IsNotExist(err) && family == "ipv6" {
+			continue
+		}
+		if err := writeSysfs(path, boolSysctl(ignore)); err != nil {
+			return fmt.Errorf("failed to set ignore_routes_with_linkdown of %q: %v", ifName, err)
+		}
+	}
+	return nil
+}
+
+// raiseARPGCThresh bumps the host neighbour table limits up to the
+// configured minimums
+func raiseARPGCThresh(n *NetConf) error {
+	thresholds := []struct {
+		name string
+		min  int
+	}{
+		{"net.ipv4.neigh.default.gc_thresh1", n.ARPGCThresh1},
+		{"net.ipv4.neigh.default.gc_thresh2", n.ARPGCThresh2},
+		{"net.ipv4.neigh.default.gc_thresh3", n.ARPGCThresh3},
+	}
+
+	for _, t := range thresholds {
+		if t.min == 0 {
+			continue
+		}
+		path := filepath.Join(procSys, strings.Replace(t.name, ".", "/", -1))
+		if cur, err := readSysfs(path); err == nil {
+			if v, err := strconv.Atoi(cur); err == nil && v >= t.min {
+				continue
+			}
+		}
+		if err := setSysctl(t.name, strconv.Itoa(t.min)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// brNetfilterLoaded reports whether br_netfilter and its sysctls are there
+func brNetfilterLoaded() bool {
+	_, err := os.Stat(filepath.Join(procSys, "net/bridge"))
+	return err == nil
+}
+
+// ensureBrNetfilter loads br_netfilter if its sysctls aren't there yet
+func ensureBrNetfilter() error {
+	if brNetfilterLoaded() {
+		return nil
+	}
+	if out, err := exec.Command("modprobe", "br_netfilter").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to load br_netfilter: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package bridgecni
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// defaultPolicingBurst is used when no burst is configured, in bytes
+	defaultPolicingBurst = 64 * 1024
+
+	// priorities of the filters on the host veth clsact hooks. Mirroring
+	// comes first so monitors see what gets dropped too, policing
+	// filters pass conforming traffic on, so the bpf programs always
+	// see whatever survives them.
+	tcPrioMirror       = 1
+	tcPrioStormControl = 2
+	tcPrioARPLimit     = 3
+	tcPrioPolicing     = 4
+	tcPrioBPF          = 5
+)
+
+// runTC runs tc in the host netns, for the traffic control features the
+// vendored netlink library can't express
+func runTC(args ...string) error {
+	return ops.Host().TC(args...)
+}
+
+// ensureClsact adds the clsact qdisc, which provides the ingress and
+// egress hooks the policing and bpf filters attach to
+func ensureClsact(hostVethName string) error {
+	if err := runTC("qdisc", "replace", "dev", hostVethName, "clsact"); err != nil {
+		return fmt.Errorf("failed to add clsact qdisc to %v: %v", hostVethName, err)
+	}
+	return nil
+}
+
+// setupIngressPolicing drops traffic the container sends above rate
+// (bits per second) by policing on the ingress of its host veth
+func setupIngressPolicing(hostVethName string, rate, burst int) error {
+	if burst <= 0 {
+		burst = defaultPolicingBurst
+	}
+
+	if err := ensureClsact(hostVethName); err != nil {
+		return err
+	}
+
+	err := runTC("filter", "add", "dev", hostVethName, "ingress",
+		"protocol", "all", "prio", strconv.Itoa(tcPrioPolicing),
+		"u32", "match", "u32", "0", "0",
+		"police", "rate", fmt.Sprintf("%dbit", rate), "burst", strconv.Itoa(burst),
+		"conform-exceed", "drop/continue", "flowid", ":1")
+	if err != nil {
+		return fmt.Errorf("failed to add policing filter to %v: %v", hostVethName, err)
+	}
+
+	logrus.Debugf("rancher-cni-bridge: policing ingress of %v to %vbit/s burst %v", hostVethName, rate, burst)
+	return nil
+}
+
+// setupFqCodel replaces the root qdisc of the host veth with fq_codel to
+// keep queueing latency between containers low
+func setupFqCodel(hostVethName string) error {
+	if err := runTC("qdisc", "replace", "dev", hostVethName, "root", "fq_codel"); err != nil {
+		return fmt.Errorf("failed to set fq_codel qdisc on %v: %v", hostVethName, err)
+	}
+	return nil
+}
+
+// attachBPF attaches the pinned eBPF programs to the clsact hooks of the
+// host veth in direct-action mode
+func attachBPF(hostVethName string, conf *BPFConf) error {
+	if err := ensureClsact(hostVethName); err != nil {
+		return err
+	}
+
+	hooks := []struct {
+		name string
+		path string
+	}{
+		{"ingress", conf.Ingress},
+		{"egress", conf.Egress},
+	}
+	for _, hook := range hooks {
+		if hook.path == "" {
+			continue
+		}
+		err := runTC("filter", "add", "dev", hostVethName, hook.name,
+			"prio", strconv.Itoa(tcPrioBPF), "bpf", "direct-action", "object-pinned", hook.path)
+		if err != nil {
+			return fmt.Errorf("failed to attach %v to %v of %v: %v", hook.path, hook.name, hostVethName, err)
+		}
+		logrus.Debugf("rancher-cni-bridge: attached %v to %v of %v", hook.path, hook.name, hostVethName)
+	}
+	return nil
+}
+
+// setupStormControl limits the broadcast and multicast packets per
+// second the container can send into the bridge
+func setupStormControl(hostVethName string, pps int) error {
+	if err := ensureClsact(hostVethName); err != nil {
+		return err
+	}
+
+	// broadcast is a special case of multicast, both have the group bit
+	// of the destination MAC set
+	err := runTC("filter", "add", "dev", hostVethName, "ingress",
+		"protocol", "all", "prio", strconv.Itoa(tcPrioStormControl),
+		"flower", "dst_mac", "01:00:00:00:00:00/01:00:00:00:00:00",
+		"action", "police", "pkts_rate", strconv.Itoa(pps), "pkts_burst", strconv.Itoa(pps),
+		"conform-exceed", "drop/continue")
+	if err != nil {
+		return fmt.Errorf("failed to add storm control filter to %v: %v", hostVethName, err)
+	}
+
+	logrus.Debugf("rancher-cni-bridge: limiting broadcast/multicast from %v to %v pps", hostVethName, pps)
+	return nil
+}
+
+// setupMirror copies everything the container sends and receives to the
+// monitor interface, for IDS or capturing
+func setupMirror(hostVethName, monitor string) error {
+	if err := ensureClsact(hostVethName); err != nil {
+		return err
+	}
+
+	for _, hook := range []string{"ingress", "egress"} {
+		err := runTC("filter", "add", "dev", hostVethName, hook,
+			"protocol", "all", "prio", strconv.Itoa(tcPrioMirror),
+			"matchall", "action", "mirred", "egress", "mirror", "dev", monitor)
+		if err != nil {
+			return fmt.Errorf("failed to mirror %v of %v to %v: %v", hook, hostVethName, monitor, err)
+		}
+	}
+
+	logrus.Debugf("rancher-cni-bridge: mirroring %v to %v", hostVethName, monitor)
+	return nil
+}
+
+// setupARPLimit limits the ARP packets per second the container can send
+// into the bridge
+func setupARPLimit(hostVethName string, pps int) error {
+	if err := ensureClsact(hostVethName); err != nil {
+		return err
+	}
+
+	err := runTC("filter", "add", "dev", hostVethName, "ingress",
+		"protocol", "arp", "prio", strconv.Itoa(tcPrioARPLimit),
+		"matchall",
+		"action", "police", "pkts_rate", strconv.Itoa(pps), "pkts_burst", strconv.Itoa(pps),
+		"conform-exceed", "drop/continue")
+	if err != nil {
+		return fmt.Errorf("failed to add ARP rate limit to %v: %v", hostVethName, err)
+	}
+
+	logrus.Debugf("rancher-cni-bridge: limiting ARP from %v to %v pps", hostVethName, pps)
+	return nil
+}
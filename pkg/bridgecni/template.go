@@ -0,0 +1,90 @@
+package bridgecni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+)
+
+var templateVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// builtin template variables, everything else comes from the environment
+var templateBuiltins = map[string]func() (string, error){
+	"hostname": os.Hostname,
+	"hostIP":   hostIP,
+}
+
+// expandConfig replaces ${VAR} in every string value of the JSON config
+// with the environment variable VAR, or with the host's name or address
+// for ${hostname} and ${hostIP}, so one config file fits all hosts.
+// Referencing an unset variable is an error.
+func expandConfig(conf []byte) ([]byte, error) {
+	if !bytes.Contains(conf, []byte("${")) {
+		return conf, nil
+	}
+
+	var v interface{}
+	if err := decodeJSON(conf, &v); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	v, err := expandValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func expandValue(v interface{}) (interface{}, error) {
+	var err error
+	switch v := v.(type) {
+	case string:
+		return expandString(v)
+	case map[string]interface{}:
+		for k, e := range v {
+			if v[k], err = expandValue(e); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if v[i], err = expandValue(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+func expandString(s string) (string, error) {
+	var err error
+	out := templateVar.ReplaceAllStringFunc(s, func(m string) string {
+		name := templateVar.FindStringSubmatch(m)[1]
+		if f, ok := templateBuiltins[name]; ok {
+			val, ferr := f()
+			if ferr != nil && err == nil {
+				err = fmt.Errorf("failed to expand ${%v}: %v", name, ferr)
+			}
+			return val
+		}
+		val, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("${%v} is not set", name)
+		}
+		return val
+	})
+	return out, err
+}
+
+// hostIP is the address the host uses to reach the outside world, the
+// source address of its default route. No packet is sent.
+func hostIP() (string, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:53")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
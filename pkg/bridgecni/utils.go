@@ -0,0 +1,316 @@
+package bridgecni
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/rancher/rancher-cni-bridge/internal/bridge"
+	"github.com/rancher/rancher-cni-bridge/internal/veth"
+	"github.com/vishvananda/netlink"
+)
+
+// errCodeTryAgainLater is the CNI error code telling the runtime the
+// failure is transient and ADD may be retried
+const errCodeTryAgainLater = 11
+
+// setupContainerVeth creates the container's veth pair as configured,
+// see veth.Setup. Running out of attempts at unique names is reported
+// as errCodeTryAgainLater.
+func setupContainerVeth(ch nlHandle, netns ns.NetNS, containerID, ifName string, n *NetConf) (string, error) {
+	o := veth.Options{MTU: n.MTU, TxQueues: n.NumTxQueues, RxQueues: n.NumRxQueues}
+	if n.HostVethPrefix != "" {
+		o.HostPrefix, o.HostKey = n.HostVethPrefix, containerID+"-"+ifName
+	}
+	hostVethName, err := veth.Setup(ops.Host(), ch, netns, ifName, o)
+	if e, ok := err.(*veth.CollisionError); ok {
+		return "", &types.Error{Code: errCodeTryAgainLater, Msg: "veth name collision, try again later", Details: e.Error()}
+	}
+	return hostVethName, err
+}
+
+// attachPort plugs the host end of the container veth into the bridge
+// of the configured datapath
+func attachPort(n *NetConf, br netlink.Link, hostVethName string, args *skel.CmdArgs) error {
+	if n.Datapath == datapathOVS {
+		return attachOVSPort(n.BrName, hostVethName, args.ContainerID, args.IfName)
+	}
+	// validated by loadNetConf
+	reflection, _ := l2Reflection(n)
+	return bridge.AttachPort(ops.Host(), br.(*netlink.Bridge), hostVethName, reflection == reflectHairpin)
+}
+
+func calculateBridgeIP(n *NetConf) (*net.IPNet, error) {
+	var (
+		ip          net.IP
+		bridgeIPNet *net.IPNet
+		err         error
+	)
+
+	if n.BrSubnet == "" {
+		return nil, fmt.Errorf("mandatory bridgeSubnet not specified in config")
+	}
+
+	_, brNetworkIPNet, err := net.ParseCIDR(n.BrSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bridgeSubnet specified got error: %v", err)
+	}
+
+	if n.BrIP != "" {
+		ip = net.ParseIP(n.BrIP)
+		if ip == nil {
+			// Check if we can parse as a CIDR
+			ip, _, err = net.ParseCIDR(n.BrIP)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bridgeIP specified in config")
+			}
+		}
+
+		if !brNetworkIPNet.Contains(ip) {
+			return nil, fmt.Errorf("bridgeIP is not in bridgeSubnet")
+		}
+		bridgeIPNet = &net.IPNet{IP: ip, Mask: brNetworkIPNet.Mask}
+	} else {
+		// Use the first IP of the subnet for the bridge
+		brNetworkIPTo4 := brNetworkIPNet.IP.To4()
+
+		ip = net.IPv4(
+			brNetworkIPTo4[0],
+			brNetworkIPTo4[1],
+			brNetworkIPTo4[2],
+			brNetworkIPTo4[3]+1,
+		)
+		bridgeIPNet = &net.IPNet{IP: ip, Mask: brNetworkIPNet.Mask}
+	}
+
+	return bridgeIPNet, nil
+}
+
+func setBridgeIP(n *NetConf) error {
+
+	if n.BrSubnet == "" {
+		return fmt.Errorf("mandatory bridgeSubnet not specified in config")
+	}
+
+	h := ops.Host()
+	link, err := h.LinkByName(n.BrName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", n.BrName, err)
+	}
+
+	bridgeIPNet, err := calculateBridgeIP(n)
+	if err != nil {
+		return fmt.Errorf("failed to calculate bridge IP: %v", err)
+	}
+
+	addrs, err := h.AddrList(link, syscall.AF_INET)
+	if err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("could not get list of IP addresses: %v", err)
+	}
+	if len(addrs) > 0 {
+		bridgeIPStr := bridgeIPNet.String()
+		for _, a := range addrs {
+			if a.IPNet.String() == bridgeIPStr {
+				// Bridge IP already set, nothing to do
+				return nil
+			}
+		}
+	}
+
+	addr := &netlink.Addr{IPNet: bridgeIPNet, Label: ""}
+	if err = h.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("failed to add IP addr to %q: %v", n.BrName, err)
+	}
+
+	return nil
+}
+
+func setupBridge(n *NetConf) (netlink.Link, error) {
+	var (
+		br  netlink.Link
+		err error
+	)
+
+	if err = raiseARPGCThresh(n); err != nil {
+		return nil, fmt.Errorf("failed to raise ARP cache thresholds: %v", err)
+	}
+
+	if n.AdoptExisting {
+		return adoptBridge(n)
+	}
+
+	if err := checkDocker0Conflict(n); err != nil {
+		return nil, err
+	}
+
+	// create bridge if necessary
+	if n.Datapath == datapathOVS {
+		br, err = ensureOVSBridge(n.BrName, n.MTU)
+	} else {
+		br, err = bridge.Ensure(ops.Host(), n.BrName, n.MTU)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+	}
+
+	if n.VRF != nil {
+		if err = ensureVRF(n, br); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.Bond != nil {
+		if err = ensureBond(n.Bond, br, n.MTU); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.Standby != nil {
+		if err = plugUplink(n.Uplink, br); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.Datapath != datapathOVS {
+		if err = setBridgeSTP(n); err != nil {
+			return nil, fmt.Errorf("failed to configure bridge %q: %v", n.BrName, err)
+		}
+		if err = setBridgeGroupFwdMask(n); err != nil {
+			return nil, fmt.Errorf("failed to configure bridge %q: %v", n.BrName, err)
+		}
+		if n.StaticFDB {
+			// entries neither age out nor get learned, see setBrportOptions
+			if err = bridge.SetOption(n.BrName, "ageing_time", "0"); err != nil {
+				return nil, fmt.Errorf("failed to configure bridge %q: %v", n.BrName, err)
+			}
+		}
+		if reflection, _ := l2Reflection(n); reflection == reflectPromisc {
+			if err = ops.Host().LinkSetPromiscOn(br); err != nil {
+				return nil, fmt.Errorf("failed to configure bridge %q: %v", n.BrName, err)
+			}
+		}
+	}
+
+	if err = setBridgeNFCall(n); err != nil {
+		return nil, fmt.Errorf("failed to configure bridge netfilter: %v", err)
+	}
+
+	if n.IgnoreRoutesWithLinkdown != nil {
+		if err = setIgnoreRoutesWithLinkdown(n.BrName, *n.IgnoreRoutesWithLinkdown); err != nil {
+			return nil, err
+		}
+	}
+
+	// Set the bridge IP address. Configs written for the upstream
+	// bridge plugin have no bridgeSubnet, isGateway assigns the address.
+	// The bridges of a standby pair have none.
+	if !n.BridgeNoIP && n.Standby == nil && (n.BrSubnet != "" || !n.IsGW) {
+		if err = setBridgeIP(n); err != nil {
+			return nil, fmt.Errorf("failed to set bridge IP: %v", err)
+		}
+	}
+
+	if n.SLAAC {
+		if err = setupSLAAC(n, br); err != nil {
+			return nil, fmt.Errorf("failed to set up SLAAC on %q: %v", n.BrName, err)
+		}
+	}
+
+	return br, nil
+}
+
+// adoptBridge validates a bridge created outside of the plugin (by Docker
+// or the OS) for use as is. Its addresses are never changed, the plugin
+// only adds ports to it.
+func adoptBridge(n *NetConf) (netlink.Link, error) {
+	if n.Datapath == datapathOVS {
+		return nil, fmt.Errorf("adoptExisting is not supported with the %v datapath", datapathOVS)
+	}
+
+	br, err := bridge.ByName(ops.Host(), n.BrName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to adopt bridge: %v", err)
+	}
+
+	if n.MTU != 0 && br.MTU != n.MTU {
+		return nil, fmt.Errorf("cannot adopt %q: its MTU %v does not match configured mtu %v", n.BrName, br.MTU, n.MTU)
+	}
+
+	if n.BrSubnet != "" {
+		_, subnet, err := net.ParseCIDR(n.BrSubnet)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bridgeSubnet specified got error: %v", err)
+		}
+
+		addrs, err := ops.Host().AddrList(br, syscall.AF_INET)
+		if err != nil && err != syscall.ENOENT {
+			return nil, fmt.Errorf("could not get list of IP addresses: %v", err)
+		}
+		found := false
+		for _, a := range addrs {
+			if subnet.Contains(a.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("cannot adopt %q: it has no address in bridgeSubnet %v", n.BrName, n.BrSubnet)
+		}
+	}
+
+	logrus.Debugf("rancher-cni-bridge: adopted existing bridge %v", n.BrName)
+	return br, nil
+}
+
+// checkDocker0Conflict makes sure the subnet the plugin is about to
+// assign to its own bridge doesn't overlap the one used by docker0
+func checkDocker0Conflict(n *NetConf) error {
+	if n.BrName == dockerBrName || n.BrSubnet == "" {
+		return nil
+	}
+
+	_, subnet, err := net.ParseCIDR(n.BrSubnet)
+	if err != nil {
+		return fmt.Errorf("Invalid bridgeSubnet specified got error: %v", err)
+	}
+
+	h := ops.Host()
+	docker0, err := h.LinkByName(dockerBrName)
+	if err != nil {
+		// no docker0, nothing to conflict with
+		return nil
+	}
+
+	addrs, err := h.AddrList(docker0, syscall.AF_INET)
+	if err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("could not get list of IP addresses of %q: %v", dockerBrName, err)
+	}
+	for _, a := range addrs {
+		if a.IPNet.Contains(subnet.IP) || subnet.Contains(a.IP) {
+			return fmt.Errorf("bridgeSubnet %v conflicts with %v subnet %v", n.BrSubnet, dockerBrName, a.IPNet)
+		}
+	}
+	return nil
+}
+
+// releaseIPAM gives back the address allocated by the IPAM plugin when
+// ADD fails after the allocation was made.
+func releaseIPAM(n *NetConf, args *skel.CmdArgs, allocator string) {
+	if ipamDisabled(n) {
+		return
+	}
+
+	// the delegate checks CNI_COMMAND, so pretend to be a DEL for the call
+	cmd := os.Getenv("CNI_COMMAND")
+	os.Setenv("CNI_COMMAND", "DEL")
+	defer os.Setenv("CNI_COMMAND", cmd)
+
+	if err := execIPAMDel(n, args, allocator); err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to release IPAM allocation: %v", err)
+	}
+}
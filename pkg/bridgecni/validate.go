@@ -0,0 +1,54 @@
+package bridgecni
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+)
+
+// runValidate parses and validates the network config on stdin like
+// ADD would, and prints it back with all defaults filled in, so broken
+// configs show up before a container fails to start
+func runValidate(argv []string) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	cniPath := flags.String("cni-path", os.Getenv("CNI_PATH"), "where to look for the IPAM plugin")
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+
+	bytes, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %v", err)
+	}
+	n, err := loadNetConf(bytes)
+	if err != nil {
+		return err
+	}
+
+	if n.Name == "" {
+		return fmt.Errorf("the network needs a name")
+	}
+	if n.Type == "" {
+		return fmt.Errorf("the network needs a type")
+	}
+	if !ipamDisabled(n) && n.IPAM.Type != "" && *cniPath != "" {
+		if _, err := invoke.FindInPath(n.IPAM.Type, filepath.SplitList(*cniPath)); err != nil {
+			if n.BrSubnet == "" {
+				return fmt.Errorf("IPAM plugin %q not found: %v", n.IPAM.Type, err)
+			}
+			fmt.Fprintf(os.Stderr, "warning: IPAM plugin %q not found, the embedded allocator will be used\n", n.IPAM.Type)
+		}
+	}
+
+	out, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,57 @@
+package bridgecni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// runExtraVerb runs a CNI command the vendored skel package doesn't know
+// about, mirroring how skel reads the environment, checks the config's
+// cniVersion and reports errors. The command needs a config of spec
+// version minVersion or later.
+func runExtraVerb(verb, minVersion string, cmd func(*skel.CmdArgs) error) {
+	stdinData, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		dieErr(&types.Error{Code: 100, Msg: "error reading from stdin: " + err.Error()})
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		Args:        os.Getenv("CNI_ARGS"),
+		Path:        os.Getenv("CNI_PATH"),
+		StdinData:   stdinData,
+	}
+
+	configVersion, err := (&version.ConfigDecoder{}).Decode(stdinData)
+	if err != nil {
+		dieErr(&types.Error{Code: 100, Msg: err.Error()})
+	}
+	if verErr := (&version.Reconciler{}).Check(configVersion, pluginVersions); verErr != nil {
+		dieErr(&types.Error{Code: types.ErrIncompatibleCNIVersion, Msg: "incompatible CNI versions", Details: verErr.Details()})
+	}
+	if !versionAtLeast(configVersion, minVersion) {
+		dieErr(&types.Error{Code: types.ErrIncompatibleCNIVersion, Msg: fmt.Sprintf("config version %v does not allow %v", configVersion, verb), Details: fmt.Sprintf("%v needs %v or later", verb, minVersion)})
+	}
+
+	if err := cmd(args); err != nil {
+		if e, ok := err.(*types.Error); ok {
+			dieErr(e)
+		}
+		dieErr(&types.Error{Code: 100, Msg: err.Error()})
+	}
+}
+
+func dieErr(e *types.Error) {
+	if err := e.Print(); err != nil {
+		logrus.Errorf("rancher-cni-bridge: error writing error JSON to stdout: %v", err)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,66 @@
+package bridgecni
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// set at build time by scripts/build
+var (
+	VERSION   = "dev"
+	GITCOMMIT = "unknown"
+)
+
+// pluginInfo is what VERSION reports: the CNI spec versions understood,
+// plus which build of the plugin is answering
+type pluginInfo struct {
+	version.PluginInfo
+}
+
+// the result is 0.2.0 shaped, which 0.1.0 callers read just as well,
+// and 0.3.x shaped from 0.3.0 on, less the IP versions from 1.0.0 on
+// (see printResult)
+var pluginVersions = &pluginInfo{version.PluginSupports("0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", "1.0.0", "1.1.0")}
+
+func (p *pluginInfo) Encode(w io.Writer) error {
+	return json.NewEncoder(w).Encode(struct {
+		CNIVersion        string   `json:"cniVersion"`
+		SupportedVersions []string `json:"supportedVersions"`
+		PluginVersion     string   `json:"pluginVersion"`
+		GitCommit         string   `json:"gitCommit"`
+	}{
+		CNIVersion:        version.Current(),
+		SupportedVersions: p.SupportedVersions(),
+		PluginVersion:     VERSION,
+		GitCommit:         GITCOMMIT,
+	})
+}
+
+func logVersion() {
+	logrus.Debugf("rancher-cni-bridge: version %v (commit %v), CNI %v", VERSION, GITCOMMIT, version.Current())
+}
+
+// versionAtLeast reports whether spec version v is min or later
+func versionAtLeast(v, min string) bool {
+	a, b := versionParts(v), versionParts(min)
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return true
+}
+
+// versionParts splits major.minor.patch, missing or bad parts are 0
+func versionParts(v string) [3]int {
+	var parts [3]int
+	for i, s := range strings.SplitN(v, ".", 3) {
+		parts[i], _ = strconv.Atoi(s)
+	}
+	return parts
+}
@@ -0,0 +1,46 @@
+package bridgecni
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// VRFConf puts the bridge into a VRF, so container traffic is routed
+// with its own table, apart from the host management traffic
+type VRFConf struct {
+	Name  string `json:"name"`
+	Table int    `json:"table"`
+}
+
+// ensureVRF creates the VRF device if needed and enslaves the bridge to
+// it
+func ensureVRF(n *NetConf, br netlink.Link) error {
+	h := ops.Host()
+	vrf, err := h.LinkByName(n.VRF.Name)
+	if err != nil {
+		logrus.Infof("rancher-cni-bridge: creating VRF %v with table %v", n.VRF.Name, n.VRF.Table)
+		if err := h.LinkAddVRF(n.VRF.Name, n.VRF.Table); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to create VRF %q: %v", n.VRF.Name, err)
+		}
+		if vrf, err = h.LinkByName(n.VRF.Name); err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", n.VRF.Name, err)
+		}
+	} else if vrf.Type() != "vrf" {
+		return fmt.Errorf("%q already exists but is not a VRF", n.VRF.Name)
+	}
+
+	if err = h.LinkSetUp(vrf); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", n.VRF.Name, err)
+	}
+
+	if br.Attrs().MasterIndex == vrf.Attrs().Index {
+		return nil
+	}
+	if err = h.LinkSetMasterByIndex(br, vrf.Attrs().Index); err != nil {
+		return fmt.Errorf("failed to enslave %q to VRF %q: %v", n.BrName, n.VRF.Name, err)
+	}
+	return nil
+}
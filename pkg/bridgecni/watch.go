@@ -0,0 +1,98 @@
+package bridgecni
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/vishvananda/netlink"
+)
+
+// bridgeWatcher recreates bridges the daemon set up when they get
+// deleted underneath it, and plugs the known veths back in. It also
+// fails networks with a standby bridge over when their uplink dies.
+type bridgeWatcher struct {
+	// serializes repairs with the requests served by the daemon
+	mu *sync.Mutex
+
+	nets map[string]*NetConf
+
+	// networks with a standby bridge, by name
+	standby map[string]*NetConf
+
+	// networks announcing their ports with LLDP, by bridge
+	lldp map[string]*NetConf
+}
+
+func newBridgeWatcher(mu *sync.Mutex) *bridgeWatcher {
+	return &bridgeWatcher{mu: mu, nets: map[string]*NetConf{}, standby: map[string]*NetConf{}, lldp: map[string]*NetConf{}}
+}
+
+// remember records the config of a network served by the daemon. It's
+// called with mu held.
+func (w *bridgeWatcher) remember(n *NetConf) {
+	if n.Standby != nil {
+		w.standby[n.Name] = n
+	}
+	if n.LLDP != nil {
+		w.lldp[n.BrName] = n
+	}
+	// an adopted bridge is not ours to recreate
+	if bridgeName(n) == "" || n.AdoptExisting {
+		return
+	}
+	w.nets[n.BrName] = n
+}
+
+// run watches for deleted links until the netlink subscription ends
+func (w *bridgeWatcher) run() error {
+	updates := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribe(updates, nil); err != nil {
+		return err
+	}
+
+	for u := range updates {
+		if u.Header.Type != syscall.RTM_DELLINK {
+			continue
+		}
+		w.mu.Lock()
+		if n := w.nets[u.Link.Attrs().Name]; n != nil {
+			w.restore(n)
+		}
+		w.mu.Unlock()
+	}
+	logrus.Errorf("rancher-cni-bridge: link updates stopped, no longer watching bridges")
+	return nil
+}
+
+// restore recreates the bridge of n by repairing every attachment on it.
+// Without attachments left there's nothing to do, the next ADD creates
+// the bridge again.
+func (w *bridgeWatcher) restore(n *NetConf) {
+	as, err := listAttachments(n)
+	if err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to restore bridge %v: %v", n.BrName, err)
+		return
+	}
+
+	for _, a := range as {
+		if a.HostVeth == "" || a.Bridge != n.BrName {
+			continue
+		}
+		logrus.Infof("rancher-cni-bridge: bridge %v was deleted, restoring port of %v", n.BrName, a.ContainerID)
+		args := &skel.CmdArgs{
+			ContainerID: a.ContainerID,
+			Netns:       a.Netns,
+			IfName:      a.IfName,
+			Args:        a.Args,
+		}
+		nArgs, err := loadNetArgs(a.Args)
+		if err == nil {
+			err = repairHostPort(args, n, nArgs, a)
+		}
+		if err != nil {
+			logrus.Errorf("rancher-cni-bridge: failed to restore port of %v: %v", a.ContainerID, err)
+		}
+	}
+}
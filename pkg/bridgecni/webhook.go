@@ -0,0 +1,77 @@
+package bridgecni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+const webhookTimeout = 5 * time.Second
+
+// webhookEvent is POSTed to webhookURL after every successful ADD
+// ("attach") and DEL ("detach")
+type webhookEvent struct {
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host"`
+	Network     string    `json:"network"`
+	ContainerID string    `json:"containerID"`
+	IfName      string    `json:"ifName"`
+	Bridge      string    `json:"bridge,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	MAC         string    `json:"mac,omitempty"`
+}
+
+// notifyWebhook sends the event for a, if a webhook is configured.
+// Like the audit log it never fails the operation.
+func notifyWebhook(n *NetConf, event string, args *skel.CmdArgs, a *attachment) {
+	if n.WebhookURL == "" {
+		return
+	}
+
+	ev := &webhookEvent{
+		Event:       event,
+		Time:        time.Now().UTC(),
+		Network:     n.Name,
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Bridge:      bridgeName(n),
+	}
+	ev.Host, _ = os.Hostname()
+	if a != nil {
+		ev.Bridge = a.Bridge
+		ev.MAC = a.MAC
+		if a.Result != nil && a.Result.IP4 != nil {
+			ev.IP = a.Result.IP4.IP.IP.String()
+		}
+	}
+
+	if err := postWebhook(n.WebhookURL, ev); err != nil {
+		logrus.Errorf("rancher-cni-bridge: failed to notify %v of %v: %v", n.WebhookURL, event, err)
+	}
+}
+
+func postWebhook(url string, ev *webhookEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}